@@ -0,0 +1,13 @@
+// reposurgeon is an editor for version-control histories. The
+// interpreter and the repository machinery live in the surgeon
+// package; this is only the command-line entry point.
+//
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import "gitlab.com/esr/reposurgeon/surgeon"
+
+func main() {
+	surgeon.Main()
+}
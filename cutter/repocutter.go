@@ -1091,7 +1091,7 @@ func doreduce(source DumpfileSource) {
 			continue
 		}
 		prev = item
-		selection += string(item)
+		selection += string(rune(item))
 	}
 	source.Lbs.Rewind()
 	// -1 is to trim off trailing comma
@@ -0,0 +1,227 @@
+/*
+ * Library interface
+ *
+ * Everything else in this package exists to serve the reposurgeon
+ * interpreter. The functions and methods here are the part that other
+ * Go programs can rely on: reading and writing streams, walking and
+ * changing events, evaluating selection expressions, and running
+ * interpreter commands without a terminal. Failures come back as
+ * errors rather than as croaks or panics.
+ *
+ * The interpreter keeps its flags, its abort state, and the last croak
+ * in process-global state, so Sessions are not independent: a set
+ * command in one affects all, and they must not run concurrently.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	kommandant "gitlab.com/ianbruene/kommandant"
+)
+
+var setupOnce sync.Once
+
+// setup initializes the global state the interpreter normally sets up in Main.
+func setup() {
+	setupOnce.Do(func() {
+		if control.baton == nil {
+			control.init()
+		}
+	})
+}
+
+// recoverError turns a thrown exception into an error for library callers.
+func recoverError(err *error, x interface{}) {
+	if x == nil {
+		return
+	}
+	if e, ok := x.(*exception); ok {
+		*err = e
+		return
+	}
+	panic(x)
+}
+
+// ReadStream builds a repository from a fast-import stream or a
+// Subversion dump. Options are the same as those of the read command,
+// e.g. "--nobranch". Call Close on the result when done with it; on
+// failure there is no result.
+func ReadStream(r io.Reader, name string, options ...string) (repo *Repository, err error) {
+	setup()
+	repo = newRepository(name)
+	defer func() {
+		recoverError(&err, recover())
+		if err != nil {
+			repo.cleanup()
+			repo = nil
+		}
+	}()
+	opts := newStringSet(options...)
+	repo.fastImport(context.TODO(), r, opts, "")
+	return repo, nil
+}
+
+// WriteStream serializes the repository, or the events at the given
+// indices if selection is non-nil, as a fast-import stream.
+func (repo *Repository) WriteStream(w io.Writer, selection []int) (err error) {
+	setup()
+	defer func() { recoverError(&err, recover()) }()
+	return repo.fastExport(selection, w, newStringSet(), nil)
+}
+
+// Close releases the scratch storage held by a repository.
+func (repo *Repository) Close() {
+	repo.cleanup()
+}
+
+// Name returns the repository's name.
+func (repo *Repository) Name() string {
+	return repo.name
+}
+
+// Events returns the repository's event list in order. Indices into
+// it are what selections contain.
+func (repo *Repository) Events() []Event {
+	return repo.events
+}
+
+// Commits returns the repository's commits in event order.
+func (repo *Repository) Commits() []*Commit {
+	return repo.commits(nil)
+}
+
+// Delete removes the events at the given indices. Commits are
+// deleted with their fileops pushed forward to their children, as the
+// delete command does.
+func (repo *Repository) Delete(selection []int) (err error) {
+	setup()
+	defer func() { recoverError(&err, recover()) }()
+	repo.delete(selection, nil)
+	return nil
+}
+
+// Mark returns the commit's mark.
+func (commit *Commit) Mark() string {
+	return commit.mark
+}
+
+// LegacyID returns the ID the commit had in the VCS it was lifted from, if any.
+func (commit *Commit) LegacyID() string {
+	return commit.legacyID
+}
+
+// Parents returns the commit's parent commits; callouts are skipped.
+func (commit *Commit) Parents() []*Commit {
+	out := make([]*Commit, 0)
+	for _, parent := range commit.parents() {
+		if p, ok := parent.(*Commit); ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Paths returns every path present in the commit's tree.
+func (commit *Commit) Paths() []string {
+	return commit.manifest().pathnames()
+}
+
+// Content returns the content of a path in the commit's tree, and
+// whether the path is present there.
+func (commit *Commit) Content(path string) ([]byte, bool) {
+	return commit.blobByName(path)
+}
+
+// Session is an interpreter instance driven from a Go program rather
+// than a terminal. Commands are the same as the interactive ones.
+// Sessions share the interpreter's global settings; see above.
+type Session struct {
+	rs *Reposurgeon
+}
+
+// NewSession creates an interpreter with no repositories loaded.
+func NewSession() *Session {
+	setup()
+	rs := newReposurgeon()
+	kommandant.NewKommandant(rs)
+	return &Session{rs: rs}
+}
+
+// Do executes one command line, selection prefix included. It
+// returns an error if the command failed.
+func (s *Session) Do(line string) error {
+	if _, e := s.rs.execute(context.TODO(), line); e != nil {
+		return e
+	}
+	return nil
+}
+
+// execute runs one command line as a script would, reporting failure
+// as an exception whether it was thrown or croaked.
+func (rs *Reposurgeon) execute(ctx context.Context, line string) (stop bool, e *exception) {
+	control.setAbort(false)
+	control.lastCroak = ""
+	rs.unknown = false
+	defer func() {
+		if x := recover(); x != nil {
+			err, ok := x.(*exception)
+			if !ok {
+				panic(x)
+			}
+			e = err
+		}
+	}()
+	line = rs.cmd.PreCmd(ctx, line)
+	stop = rs.cmd.OneCmd(ctx, line)
+	stop = rs.cmd.PostCmd(ctx, stop, line)
+	if rs.unknown {
+		return stop, throw("command", "unknown command: %s", strings.TrimSpace(line))
+	}
+	if control.getAbort() {
+		if control.lastCroak == "" {
+			return stop, throw("command", "command failed")
+		}
+		return stop, throw("command", "%s", control.lastCroak)
+	}
+	return stop, nil
+}
+
+// Repository returns the session's chosen repository, or nil.
+func (s *Session) Repository() *Repository {
+	return s.rs.chosen()
+}
+
+// Adopt adds a repository built elsewhere to the session and chooses it.
+func (s *Session) Adopt(repo *Repository) {
+	repo.name = s.rs.uniquify(repo.name)
+	s.rs.repolist = append(s.rs.repolist, repo)
+	s.rs.choose(repo)
+}
+
+// Select evaluates a selection expression against the chosen
+// repository and returns the matching event indices.
+func (s *Session) Select(expr string) (selection []int, err error) {
+	defer func() { recoverError(&err, recover()) }()
+	repo := s.rs.chosen()
+	if repo == nil {
+		return nil, errors.New("no repo has been chosen")
+	}
+	// The parser expects a command to follow the expression, and some
+	// productions need to see the separating space.
+	machine, rest := s.rs.parseSelectionSet(expr + " ")
+	if rest = strings.TrimSpace(rest); rest != "" {
+		return nil, errors.New("junk after selection expression: " + rest)
+	}
+	if machine == nil {
+		return repo.all(), nil
+	}
+	return s.rs.evalSelectionSet(machine, repo), nil
+}
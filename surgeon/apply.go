@@ -0,0 +1,536 @@
+/*
+ * Applying patch series as commits
+ *
+ * Patches that were mailed about or kept as loose diff files, and never
+ * committed, can be turned into commits. Input is either an mbox, each
+ * message of which becomes a commit attributed to its sender on its
+ * date and described by its subject and the text before the diff, or a
+ * bare unified diff. Both plain diff -u output and git's extended
+ * headers, with renames, copies and mode changes, are understood.
+ * Hunks are applied to the content of the parent commit's tree, with
+ * an offset if the text has moved but without fuzz; every patch in a
+ * series has to apply before anything is added to the repository.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// patchHunk is one hunk of a unified diff. Each line keeps its ' ',
+// '-' or '+' prefix and its line ending, which is missing where the
+// diff says there is no newline at end of file.
+type patchHunk struct {
+	oldStart int
+	lines    []string
+}
+
+// patchFile is the change a patch makes to one file. A path is empty
+// where the diff has /dev/null, so an addition has no old path and a
+// deletion no new one.
+type patchFile struct {
+	oldPath string
+	newPath string
+	oldMode string
+	newMode string
+	copied  bool
+	binary  bool
+	hunks   []*patchHunk
+	date    time.Time // From a diff -u header, if any
+}
+
+// patch is one patch of a series: a message and the diff it carries.
+type patch struct {
+	author  *Attribution // nil for a bare diff
+	comment string
+	files   []*patchFile
+}
+
+var (
+	hunkHeaderRE   = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+	subjectTagsRE  = regexp.MustCompile(`^\s*(\[[^\]]*\]\s*)+`)
+	mboxFromRE     = regexp.MustCompile(`^>+From `)
+	diffDateLayout = []string{
+		"2006-01-02 15:04:05.999999999 -0700",
+		"2006-01-02 15:04:05 -0700",
+		"Mon Jan _2 15:04:05 2006",
+	}
+)
+
+// splitMbox divides an mbox into its messages, undoing the quoting of
+// body lines that begin with "From ". Input that is not an mbox is
+// returned whole.
+func splitMbox(data []byte) [][]byte {
+	if !bytes.HasPrefix(data, []byte("From ")) {
+		return [][]byte{data}
+	}
+	var messages [][]byte
+	var current []byte
+	blank := true
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("From ")) && blank {
+			if current != nil {
+				messages = append(messages, current)
+			}
+			current = []byte{}
+			blank = false
+			continue
+		}
+		blank = len(bytes.TrimRight(line, "\r\n")) == 0
+		if mboxFromRE.Match(line) {
+			line = line[1:]
+		}
+		current = append(current, line...)
+	}
+	return append(messages, current)
+}
+
+// stripPath removes the timestamp diff -u puts after a path, and
+// strip leading components, as patch -p does. /dev/null becomes the
+// empty string.
+func stripPath(name string, strip int) (string, time.Time) {
+	var when time.Time
+	if tab := strings.Index(name, "\t"); tab != -1 {
+		for _, layout := range diffDateLayout {
+			if t, err := time.Parse(layout, strings.TrimSpace(name[tab+1:])); err == nil {
+				when = t
+				break
+			}
+		}
+		name = name[:tab]
+	}
+	name = strings.TrimSpace(name)
+	if name == "/dev/null" {
+		return "", when
+	}
+	parts := strings.Split(name, "/")
+	if strip < len(parts) {
+		parts = parts[strip:]
+	} else {
+		parts = parts[len(parts)-1:]
+	}
+	return path.Clean(strings.Join(parts, "/")), when
+}
+
+// parseDiff reads the file changes of a unified diff, skipping any
+// text between them, and returns them with the text that came before
+// the first.
+func parseDiff(text string, strip int) (string, []*patchFile, error) {
+	lines := strings.SplitAfter(text, "\n")
+	var preamble strings.Builder
+	var files []*patchFile
+	var current *patchFile
+	git := false // Whether current came from a diff --git line
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		bare := strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(bare, "diff --git "):
+			names := strings.TrimPrefix(bare, "diff --git ")
+			current = &patchFile{}
+			if at := strings.Index(names, " b/"); at != -1 {
+				current.oldPath, _ = stripPath(names[:at], strip)
+				current.newPath, _ = stripPath(names[at+1:], strip)
+			}
+			files = append(files, current)
+			git = true
+		case current != nil && git && strings.HasPrefix(bare, "new file mode "):
+			current.oldPath = ""
+			current.newMode = strings.TrimPrefix(bare, "new file mode ")
+		case current != nil && git && strings.HasPrefix(bare, "deleted file mode "):
+			current.newPath = ""
+			current.oldMode = strings.TrimPrefix(bare, "deleted file mode ")
+		case current != nil && git && strings.HasPrefix(bare, "old mode "):
+			current.oldMode = strings.TrimPrefix(bare, "old mode ")
+		case current != nil && git && strings.HasPrefix(bare, "new mode "):
+			current.newMode = strings.TrimPrefix(bare, "new mode ")
+		case current != nil && git && (strings.HasPrefix(bare, "rename from ") || strings.HasPrefix(bare, "copy from ")):
+			current.oldPath = bare[strings.Index(bare, "from ")+5:]
+			current.copied = strings.HasPrefix(bare, "copy")
+		case current != nil && git && (strings.HasPrefix(bare, "rename to ") || strings.HasPrefix(bare, "copy to ")):
+			current.newPath = bare[strings.Index(bare, "to ")+3:]
+		case current != nil && (strings.HasPrefix(bare, "GIT binary patch") || strings.HasPrefix(bare, "Binary files ")):
+			current.binary = true
+		case strings.HasPrefix(bare, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			if current == nil || !git || len(current.hunks) > 0 {
+				current = &patchFile{}
+				files = append(files, current)
+				git = false
+			}
+			var oldWhen, newWhen time.Time
+			current.oldPath, oldWhen = stripPath(bare[4:], strip)
+			current.newPath, newWhen = stripPath(strings.TrimRight(lines[i+1][4:], "\r\n"), strip)
+			if !git && current.oldPath != "" && current.newPath != "" {
+				// Outside git, differing names are a backup and the
+				// file being patched, not a rename.
+				current.oldPath = current.newPath
+			}
+			if newWhen.After(oldWhen) {
+				current.date = newWhen
+			} else {
+				current.date = oldWhen
+			}
+			i++
+		case strings.HasPrefix(bare, "@@ ") && current != nil:
+			m := hunkHeaderRE.FindStringSubmatch(bare)
+			if m == nil {
+				return "", nil, fmt.Errorf("malformed hunk header %q", bare)
+			}
+			count := func(s string) int {
+				if s == "" {
+					return 1
+				}
+				n, _ := strconv.Atoi(s)
+				return n
+			}
+			hunk := &patchHunk{}
+			hunk.oldStart, _ = strconv.Atoi(m[1])
+			oldCount, newCount := count(m[2]), count(m[4])
+			for oldCount > 0 || newCount > 0 {
+				i++
+				if i >= len(lines) || lines[i] == "" {
+					return "", nil, fmt.Errorf("hunk of %s ends early", current.newPath)
+				}
+				body := lines[i]
+				if strings.TrimRight(body, "\r\n") == "" {
+					// Mailers like to eat the space of an empty context line.
+					body = " " + body
+				}
+				switch body[0] {
+				case ' ':
+					oldCount--
+					newCount--
+				case '-':
+					oldCount--
+				case '+':
+					newCount--
+				default:
+					return "", nil, fmt.Errorf("unexpected line in hunk of %s: %q", current.newPath, strings.TrimRight(body, "\r\n"))
+				}
+				if i+1 < len(lines) && strings.HasPrefix(lines[i+1], `\`) {
+					// No newline at end of file.
+					body = strings.TrimSuffix(body, "\n")
+					i++
+				}
+				hunk.lines = append(hunk.lines, body)
+			}
+			current.hunks = append(current.hunks, hunk)
+		case strings.HasPrefix(bare, "diff "), strings.HasPrefix(bare, "Index: "), strings.HasPrefix(bare, "===="):
+			// Headers of diff -r and of Subversion and CVS diffs.
+		case len(files) == 0:
+			preamble.WriteString(line)
+		}
+	}
+	return preamble.String(), files, nil
+}
+
+// applyHunks applies a file's hunks to its old content. A hunk that is
+// not found where the diff says is looked for above and below, after
+// the end of the previous one.
+func applyHunks(old []byte, hunks []*patchHunk) ([]byte, error) {
+	lines := strings.SplitAfter(string(old), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var out []string
+	cursor := 0
+	for n, hunk := range hunks {
+		var before, after []string
+		for _, line := range hunk.lines {
+			if line[0] != '+' {
+				before = append(before, line[1:])
+			}
+			if line[0] != '-' {
+				after = append(after, line[1:])
+			}
+		}
+		matches := func(at int) bool {
+			if at < cursor || at+len(before) > len(lines) {
+				return false
+			}
+			for i, line := range before {
+				if lines[at+i] != line {
+					return false
+				}
+			}
+			return true
+		}
+		expected := hunk.oldStart - 1
+		if len(before) == 0 {
+			expected = hunk.oldStart
+		}
+		found := -1
+		for offset := 0; found == -1 && (expected-offset >= cursor || expected+offset <= len(lines)); offset++ {
+			if matches(expected - offset) {
+				found = expected - offset
+			} else if matches(expected + offset) {
+				found = expected + offset
+			}
+		}
+		if found == -1 {
+			return nil, fmt.Errorf("hunk %d does not apply", n+1)
+		}
+		out = append(out, lines[cursor:found]...)
+		out = append(out, after...)
+		cursor = found + len(before)
+	}
+	out = append(out, lines[cursor:]...)
+	return []byte(strings.Join(out, "")), nil
+}
+
+// decodeBody undoes a message's content transfer encoding.
+func decodeBody(header mail.Header, body io.Reader) ([]byte, error) {
+	if strings.HasPrefix(strings.ToLower(header.Get("Content-Type")), "multipart/") {
+		return nil, fmt.Errorf("multipart messages are not supported")
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	return ioutil.ReadAll(body)
+}
+
+// parsePatch reads one patch, a mail message or a bare diff.
+func parsePatch(data []byte, mbox bool, strip int) (*patch, error) {
+	p := new(patch)
+	text := string(data)
+	var subject string
+	if mbox {
+		msg, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, err
+		}
+		decoder := new(mime.WordDecoder)
+		from, err := (&mail.AddressParser{WordDecoder: decoder}).Parse(msg.Header.Get("From"))
+		if err != nil {
+			return nil, fmt.Errorf("bad From header: %v", err)
+		}
+		when, err := msg.Header.Date()
+		if err != nil {
+			return nil, fmt.Errorf("bad Date header: %v", err)
+		}
+		p.author, _ = newAttribution("")
+		p.author.fullname, p.author.email = from.Name, from.Address
+		if p.author.fullname == "" {
+			p.author.fullname = from.Address
+		}
+		p.author.date = Date{timestamp: when}
+		subject, err = decoder.DecodeHeader(msg.Header.Get("Subject"))
+		if err != nil {
+			subject = msg.Header.Get("Subject")
+		}
+		subject = strings.TrimSpace(subjectTagsRE.ReplaceAllString(subject, ""))
+		body, err := decodeBody(msg.Header, msg.Body)
+		if err != nil {
+			return nil, err
+		}
+		text = string(body)
+	}
+	preamble, files, err := parseDiff(text, strip)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no diff found")
+	}
+	// A format-patch message ends its description with a --- line,
+	// followed by a diffstat.
+	if at := strings.Index(preamble, "\n---\n"); at != -1 {
+		preamble = preamble[:at+1]
+	} else if strings.HasPrefix(preamble, "---\n") {
+		preamble = ""
+	}
+	preamble = strings.TrimSpace(preamble)
+	switch {
+	case subject != "" && preamble != "":
+		p.comment = subject + "\n\n" + preamble + "\n"
+	case subject != "":
+		p.comment = subject + "\n"
+	case preamble != "":
+		p.comment = preamble + "\n"
+	}
+	p.files = files
+	return p, nil
+}
+
+// readPatches reads a patch series from an mbox or a bare diff.
+func readPatches(data []byte, strip int) ([]*patch, error) {
+	messages := splitMbox(data)
+	mbox := bytes.HasPrefix(data, []byte("From "))
+	var patches []*patch
+	for i, message := range messages {
+		p, err := parsePatch(message, mbox, strip)
+		if err != nil {
+			if mbox {
+				return nil, fmt.Errorf("message %d: %v", i+1, err)
+			}
+			return nil, err
+		}
+		patches = append(patches, p)
+	}
+	return patches, nil
+}
+
+// patchOps works out the fileops that make a patch's change to tree,
+// which is updated to match. New content is returned by the fileop
+// that carries it, whose ref is left to be filled in.
+func (repo *Repository) patchOps(p *patch, tree *PathMap, content map[*FileOp][]byte) ([]*FileOp, error) {
+	var ops []*FileOp
+	// textOf finds the content of a path in the tree, which may not be
+	// in any blob yet.
+	textOf := func(entry *FileOp) ([]byte, bool) {
+		if text, ok := content[entry]; ok {
+			return text, true
+		}
+		return fileopContent(entry)
+	}
+	for _, file := range p.files {
+		name := file.newPath
+		if name == "" {
+			name = file.oldPath
+		}
+		if file.binary {
+			return nil, fmt.Errorf("%s: binary patches are not supported", name)
+		}
+		var entry *FileOp
+		var old []byte
+		if file.oldPath != "" {
+			entry = treeEntry(tree, file.oldPath)
+			if entry == nil {
+				return nil, fmt.Errorf("%s: no such file", file.oldPath)
+			}
+			text, ok := textOf(entry)
+			if !ok {
+				return nil, fmt.Errorf("%s: not a file", file.oldPath)
+			}
+			old = text
+		} else if treeEntry(tree, file.newPath) != nil {
+			return nil, fmt.Errorf("%s: already exists", file.newPath)
+		}
+		updated, err := applyHunks(old, file.hunks)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if file.newPath == "" {
+			if len(updated) > 0 {
+				return nil, fmt.Errorf("%s: deletion leaves content behind", file.oldPath)
+			}
+			ops = append(ops, newFileOp(repo).construct(opD, file.oldPath))
+			tree.remove(file.oldPath)
+			continue
+		}
+		mode := file.newMode
+		if mode == "" && entry != nil {
+			mode = entry.mode
+		}
+		if mode == "" {
+			mode = "100644"
+		}
+		if file.oldPath != "" && file.oldPath != file.newPath {
+			if file.copied {
+				ops = append(ops, newFileOp(repo).construct(opC, file.oldPath, file.newPath))
+			} else {
+				ops = append(ops, newFileOp(repo).construct(opR, file.oldPath, file.newPath))
+				tree.remove(file.oldPath)
+			}
+			tree.set(file.newPath, entry)
+		}
+		if entry != nil && bytes.Equal(old, updated) && mode == entry.mode {
+			continue
+		}
+		var op *FileOp
+		if entry != nil && bytes.Equal(old, updated) {
+			op = newFileOp(repo).construct(opM, mode, entry.ref, file.newPath)
+			if entry.ref == "inline" {
+				op.inline = entry.inline
+			}
+		} else {
+			op = newFileOp(repo).construct(opM, mode, "", file.newPath)
+			content[op] = updated
+		}
+		ops = append(ops, op)
+		tree.set(file.newPath, op)
+	}
+	return ops, nil
+}
+
+// applyPatches turns a patch series into commits chained onto parent,
+// on the given branch and following parent in the event sequence.
+// Nothing is added unless every patch applies. A bare diff gets the
+// attribution given and, for a date, the latest in its file headers
+// or failing that the given one.
+func (repo *Repository) applyPatches(patches []*patch, parent *Commit, branch string, fallback *Attribution) ([]*Commit, error) {
+	tree := parent.manifest().snapshot()
+	content := make(map[*FileOp][]byte)
+	planned := make([][]*FileOp, len(patches))
+	for i, p := range patches {
+		ops, err := repo.patchOps(p, tree, content)
+		if err != nil {
+			return nil, fmt.Errorf("patch %d: %v", i+1, err)
+		}
+		planned[i] = ops
+	}
+	where := repo.eventToIndex(parent)
+	var commits []*Commit
+	var previous CommitLike = parent
+	for i, p := range patches {
+		commit := newCommit(repo)
+		if p.author != nil {
+			commit.committer = *p.author.clone()
+			commit.authors = append(commit.authors, *p.author.clone())
+		} else {
+			commit.committer = *fallback.clone()
+			var latest time.Time
+			for _, file := range p.files {
+				if file.date.After(latest) {
+					latest = file.date
+				}
+			}
+			if !latest.IsZero() {
+				commit.committer.date = Date{timestamp: latest}
+			}
+		}
+		commit.Comment = p.comment
+		if commit.Comment == "" {
+			commit.Comment = "Apply patch.\n"
+		}
+		commit.Branch = branch
+		for _, op := range planned[i] {
+			if text, ok := content[op]; ok {
+				blob := newBlob(repo)
+				blob.setMark(repo.newmark())
+				blob.setContent(text, noOffset)
+				blob.addalias(op.Path)
+				op.ref = blob.mark
+				where++
+				repo.insertEvent(blob, where, "apply")
+			}
+		}
+		commit.setMark(repo.newmark())
+		commit.setParents([]CommitLike{previous})
+		commit.setOperations(planned[i])
+		where++
+		repo.insertEvent(commit, where, "apply")
+		commits = append(commits, commit)
+		previous = commit
+	}
+	return commits, nil
+}
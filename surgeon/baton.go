@@ -4,7 +4,7 @@
  * SPDX-License-Identifier: BSD-2-Clause
  */
 
-package main
+package surgeon
 
 import (
 	"bytes"
@@ -21,7 +21,8 @@ import (
 type Baton struct {
 	progressEnabled bool
 	logFunc         func(string)
-	stream          *os.File
+	progressFunc    func(string) // When set, receives progress instead of the terminal
+	stream          io.Writer
 	channel         chan Message
 	start           time.Time
 	twirly          Twirly
@@ -111,7 +112,7 @@ func newBaton(interactive bool, logFunc func(string)) *Baton {
 				me.channel <- msg
 			} else if me.stream != nil {
 				if msg.ty == LOG {
-					if me.progressEnabled {
+					if me.progressEnabled && me.progressFunc == nil {
 						me.stream.Write(tiColZero)
 						me.stream.Write(tiClrEol)
 						me.stream.Write(msg.str)
@@ -128,6 +129,10 @@ func newBaton(interactive bool, logFunc func(string)) *Baton {
 							me.stream.Write([]byte{'\n'})
 						}
 					}
+				} else if msg.ty == PROGRESS && me.progressFunc != nil {
+					if len(msg.str) != 0 {
+						me.progressFunc(string(msg.str))
+					}
 				} else if msg.ty == PROGRESS {
 					me.stream.Write(tiColZero)
 					me.stream.Write(tiClrEol)
@@ -150,6 +155,24 @@ func (baton *Baton) setInteractivity(enabled bool) {
 	}
 }
 
+// setStream redirects baton output, returning the previous destination.
+func (baton *Baton) setStream(stream io.Writer) io.Writer {
+	baton.channel <- Message{SYNC, nil}
+	old := baton.stream
+	baton.stream = stream
+	<-baton.channel
+	return old
+}
+
+// setProgressFunc hands progress reports to a function rather than
+// drawing them on the status line; log messages are then written
+// plainly. Passing nil restores normal display.
+func (baton *Baton) setProgressFunc(hook func(string)) {
+	baton.channel <- Message{SYNC, nil}
+	baton.progressFunc = hook
+	<-baton.channel
+}
+
 // log prints out a simple log message
 func (baton *Baton) printLog(str []byte) {
 	if baton != nil {
@@ -166,7 +189,7 @@ func (baton *Baton) printLogString(str string) {
 		if baton.progressEnabled {
 			baton.channel <- Message{LOG, _copystr(str)}
 		} else {
-			baton.stream.WriteString(str)
+			io.WriteString(baton.stream, str)
 		}
 	}
 }
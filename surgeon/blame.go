@@ -0,0 +1,142 @@
+/*
+ * Line-level blame over the in-memory history
+ *
+ * Each line of a file as it stands at some commit is traced back
+ * through the commit's ancestry to the commit that introduced it.
+ * A line is inherited from a parent when the parent's version of the
+ * file has it in the same place, as found by a sequence match; when a
+ * commit renames or copies the file its parents are looked at under
+ * the source path.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	difflib "github.com/ianbruene/go-difflib/difflib"
+)
+
+type blameKey struct {
+	commit *Commit
+	path   string
+}
+
+// blamer finds the origins of lines, remembering what it has found.
+type blamer struct {
+	origins map[blameKey][]*Commit
+}
+
+func newBlamer() *blamer {
+	return &blamer{origins: make(map[blameKey][]*Commit)}
+}
+
+// sourcePath returns the path a file had before a commit renamed or
+// copied it into place.
+func sourcePath(commit *Commit, path string) string {
+	for i := len(commit.fileops) - 1; i >= 0; i-- {
+		op := commit.fileops[i]
+		if (op.op == opR || op.op == opC) && op.Target == path {
+			path = op.Source
+		} else if (op.op == opD && op.Path == path) || op.op == deleteall {
+			break
+		}
+	}
+	return path
+}
+
+// blame returns, for each line of the file at path in commit, the
+// commit that introduced it.
+func (b *blamer) blame(commit *Commit, path string) []*Commit {
+	key := blameKey{commit, path}
+	if origins, ok := b.origins[key]; ok {
+		return origins
+	}
+	text, _ := commit.blobByName(path)
+	lines := contentLines(text)
+	origins := make([]*Commit, len(lines))
+
+	// Walk back while the file is unchanged, to keep recursion shallow
+	// on long stretches of history that do not touch it.
+	here, herePath := commit, path
+	for {
+		from := sourcePath(here, herePath)
+		if !here.hasParents() {
+			break
+		}
+		parent, ok := here.parents()[0].(*Commit)
+		if !ok {
+			break
+		}
+		previous, present := parent.blobByName(from)
+		if !present || !bytes.Equal(previous, text) || len(here.parents()) > 1 {
+			break
+		}
+		here, herePath = parent, from
+	}
+
+	from := sourcePath(here, herePath)
+	for _, p := range here.parents() {
+		parent, ok := p.(*Commit)
+		if !ok {
+			continue
+		}
+		previous, present := parent.blobByName(from)
+		if !present {
+			continue
+		}
+		inherited := b.blame(parent, from)
+		m := difflib.NewMatcher(contentLines(previous), lines)
+		for _, block := range m.GetMatchingBlocks() {
+			for k := 0; k < block.Size; k++ {
+				if origins[block.B+k] == nil {
+					origins[block.B+k] = inherited[block.A+k]
+				}
+			}
+		}
+	}
+	for i := range origins {
+		if origins[i] == nil {
+			origins[i] = here
+		}
+	}
+	b.origins[key] = origins
+	return origins
+}
+
+// writeBlame prints each line of a file with the mark, legacy ID,
+// author, and date of the commit that introduced it.
+func writeBlame(w io.Writer, commit *Commit, path string) {
+	text, _ := commit.blobByName(path)
+	lines := contentLines(text)
+	origins := newBlamer().blame(commit, path)
+	columns := make([][4]string, len(lines))
+	var widths [3]int
+	for i, origin := range origins {
+		legacy := origin.showlegacy()
+		if legacy == "" {
+			legacy = "-"
+		}
+		author := origin.committer
+		if len(origin.authors) > 0 {
+			author = origin.authors[0]
+		}
+		columns[i] = [4]string{origin.mark, legacy, author.fullname, author.date.rfc3339()}
+		for j := range widths {
+			if len(columns[i][j]) > widths[j] {
+				widths[j] = len(columns[i][j])
+			}
+		}
+	}
+	numwidth := len(fmt.Sprint(len(lines)))
+	for i, line := range lines {
+		fmt.Fprintf(w, "%-*s %-*s %-*s %s %*d) %s\n",
+			widths[0], columns[i][0], widths[1], columns[i][1], widths[2], columns[i][2],
+			columns[i][3], numwidth, i+1, strings.TrimSuffix(line, "\n"))
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Turning a subdirectory back into a branch
+ *
+ * This is the inverse of debranch. Repositories converted from
+ * Subversion often have a directory that was really a separately
+ * evolving line of development. Its history, as seen from the tip of
+ * some branch, is copied onto a new branch with a root of its own,
+ * the directory's contents becoming the top level there, and pruned
+ * the way carve prunes. The directory can then be removed from the
+ * branch it came from.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"sort"
+	"strings"
+)
+
+// dropDirOps returns a commit's fileops without those affecting the
+// subdirectory at prefix, which ends with a slash. A file renamed or
+// copied out of the subdirectory becomes a modification.
+func dropDirOps(commit *Commit, prefix string) []*FileOp {
+	dir := strings.TrimSuffix(prefix, "/")
+	inside := func(path string) bool {
+		return path == dir || strings.HasPrefix(path, prefix)
+	}
+	var ops []*FileOp
+	for _, op := range commit.operations() {
+		switch op.op {
+		case opM, opD:
+			if !inside(op.Path) {
+				ops = append(ops, op)
+			}
+		case opR, opC:
+			switch {
+			case inside(op.Source) && inside(op.Target):
+			case inside(op.Source):
+				commit.manifest().iter(func(name string, entry interface{}) {
+					if name == op.Target || strings.HasPrefix(name, op.Target+"/") {
+						modify := entry.(*FileOp).Copy()
+						modify.Path = name
+						ops = append(ops, modify)
+					}
+				})
+			case inside(op.Target):
+				if op.op == opR {
+					ops = append(ops, newFileOp(commit.repo).construct(opD, op.Source))
+				}
+			default:
+				ops = append(ops, op)
+			}
+		default:
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// branchifyDir copies the history of the subdirectory at prefix in
+// the given commits, which must be in event order and include all
+// ancestors of each, onto a new branch. Returns the new branch's
+// commits that survive pruning.
+func (repo *Repository) branchifyDir(commits []*Commit, prefix string, branch string) []*Commit {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	copies := make(map[*Commit]*Commit, len(commits))
+	var created []*Commit
+	for _, commit := range commits {
+		scratch := newCommit(repo)
+		for _, op := range commit.operations() {
+			scratch.fileops = append(scratch.fileops, op.Copy())
+		}
+		c := newCommit(repo)
+		c.committer = commit.committer
+		c.authors = append(c.authors, commit.authors...)
+		c.Comment = commit.Comment
+		c.Branch = branch
+		c.setMark(repo.newmark())
+		c.fileops = carveOps(scratch, commit, prefix)
+		var parents []CommitLike
+		for _, parent := range commit.parents() {
+			if p, ok := parent.(*Commit); ok && copies[p] != nil {
+				parents = append(parents, copies[p])
+			}
+		}
+		c.setParents(parents)
+		copies[commit] = c
+		created = append(created, c)
+		control.baton.twirl()
+	}
+	// Each copy goes just after its original.
+	events := make([]Event, 0, len(repo.events)+len(created))
+	for _, event := range repo.events {
+		events = append(events, event)
+		if commit, ok := event.(*Commit); ok && copies[commit] != nil {
+			events = append(events, copies[commit])
+		}
+	}
+	repo.events = events
+	repo.declareSequenceMutation("branchifydir")
+
+	deletia := repo.pruneCommits(created, false)
+	dropped := make(map[Event]bool, len(deletia))
+	for _, ei := range deletia {
+		dropped[repo.events[ei]] = true
+	}
+	repo.delete(deletia, orderedStringSet{"--tagback"})
+	var survivors []*Commit
+	for _, commit := range created {
+		if !dropped[commit] {
+			survivors = append(survivors, commit)
+		}
+	}
+	return survivors
+}
+
+// removeDir removes the subdirectory at prefix from the given commits,
+// deleting those it leaves with no fileops that had some. Returns the
+// number of commits deleted.
+func (repo *Repository) removeDir(commits []*Commit, prefix string) int {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	// Manifests are wanted for renames out of the directory, so all
+	// fileops are worked out before any is changed.
+	remaining := make(map[*Commit][]*FileOp, len(commits))
+	for _, commit := range commits {
+		remaining[commit] = dropDirOps(commit, prefix)
+	}
+	emptied := make(map[*Commit]bool)
+	for _, commit := range commits {
+		emptied[commit] = len(remaining[commit]) == 0 && len(commit.fileops) > 0
+		commit.setOperations(remaining[commit])
+	}
+	// Deleting a commit reparents its children, which can leave a
+	// merge with the same parent twice, and so with one parent and
+	// free to go in turn.
+	removed := 0
+	for {
+		var deletia orderedIntSet
+		for _, commit := range commits {
+			if emptied[commit] {
+				seen := make(map[CommitLike]bool)
+				var parents []CommitLike
+				for _, parent := range commit.parents() {
+					if !seen[parent] {
+						seen[parent] = true
+						parents = append(parents, parent)
+					}
+				}
+				if len(parents) < len(commit.parents()) {
+					commit.setParents(parents)
+				}
+				if len(parents) == 1 {
+					emptied[commit] = false
+					deletia = append(deletia, repo.eventToIndex(commit))
+				}
+			}
+		}
+		if len(deletia) == 0 {
+			return removed
+		}
+		sort.Ints(deletia)
+		repo.delete(deletia, orderedStringSet{"--tagback"})
+		removed += len(deletia)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ * Carving a subdirectory out into a repository of its own
+ *
+ * The chosen repository is copied, each commit's fileops are cut down
+ * to those under a path prefix with the prefix stripped, and the
+ * history is then pruned: commits that no longer change anything are
+ * dropped, or turned into tags, and merge links that have become
+ * redundant are removed, so a merge whose other side never touched
+ * the subdirectory becomes an ordinary commit or disappears. The
+ * result is the history a repository holding only that subdirectory
+ * would have had.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"sort"
+	"strings"
+)
+
+// carveOps cuts a commit's fileops down to those affecting the tree
+// under prefix, which ends with a slash, and strips the prefix. A file
+// renamed or copied in from outside becomes a modification, taking its
+// content from original, the commit as it was before carving.
+func carveOps(commit *Commit, original *Commit, prefix string) []*FileOp {
+	dir := strings.TrimSuffix(prefix, "/")
+	inside := func(path string) bool {
+		return strings.HasPrefix(path, prefix)
+	}
+	// covers tells whether a path is the subdirectory or contains it.
+	covers := func(path string) bool {
+		return path == dir || strings.HasPrefix(prefix, path+"/")
+	}
+	var ops []*FileOp
+	arrive := func(target string) {
+		if covers(target) {
+			ops = append(ops, newFileOp(commit.repo).construct(deleteall))
+		}
+		var arrivals []*FileOp
+		original.manifest().iter(func(name string, entry interface{}) {
+			if inside(name) && (covers(target) || name == target || strings.HasPrefix(name, target+"/")) {
+				op := entry.(*FileOp).Copy()
+				op.Path = strings.TrimPrefix(name, prefix)
+				arrivals = append(arrivals, op)
+			}
+		})
+		sort.Slice(arrivals, func(i, j int) bool { return arrivals[i].Path < arrivals[j].Path })
+		ops = append(ops, arrivals...)
+	}
+	for _, op := range commit.operations() {
+		switch op.op {
+		case deleteall:
+			ops = append(ops, op)
+		case opM, opD:
+			if inside(op.Path) {
+				op.Path = strings.TrimPrefix(op.Path, prefix)
+				ops = append(ops, op)
+			} else if op.op == opD && covers(op.Path) {
+				ops = append(ops, newFileOp(commit.repo).construct(deleteall))
+			}
+		case opR, opC:
+			switch {
+			case inside(op.Source) && inside(op.Target):
+				op.Source = strings.TrimPrefix(op.Source, prefix)
+				op.Target = strings.TrimPrefix(op.Target, prefix)
+				ops = append(ops, op)
+			case inside(op.Target) || covers(op.Target):
+				arrive(op.Target)
+			case op.op == opR && inside(op.Source):
+				ops = append(ops, newFileOp(commit.repo).construct(opD, strings.TrimPrefix(op.Source, prefix)))
+			case op.op == opR && covers(op.Source):
+				ops = append(ops, newFileOp(commit.repo).construct(deleteall))
+			}
+		}
+	}
+	return ops
+}
+
+// changesNothing tells whether a commit's fileops leave the tree of its
+// first parent, or the empty tree if it has none, as it was.
+func changesNothing(commit *Commit) bool {
+	var tree *PathMap
+	if commit.hasParents() {
+		parent, ok := commit.parents()[0].(*Commit)
+		if !ok {
+			return false
+		}
+		tree = parent.manifest()
+	}
+	for _, op := range commit.operations() {
+		switch op.op {
+		case opM:
+			if tree == nil || op.ref == "inline" {
+				return false
+			}
+			entry, ok := tree.get(op.Path)
+			if !ok || entry.(*FileOp).ref != op.ref || entry.(*FileOp).mode != op.mode {
+				return false
+			}
+		case opD:
+			if tree != nil {
+				if _, ok := tree.get(op.Path); ok {
+					return false
+				}
+			}
+		case deleteall:
+			if tree != nil && tree.size() > 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// treeOps returns fileops that turn the tree of base, or the empty tree
+// if base is nil, into the given tree.
+func treeOps(repo *Repository, base *Commit, tree map[string]*FileOp) []*FileOp {
+	var ops []*FileOp
+	have := make(map[string]*FileOp)
+	if base != nil {
+		base.manifest().iter(func(name string, entry interface{}) {
+			have[name] = entry.(*FileOp)
+			if _, ok := tree[name]; !ok {
+				ops = append(ops, newFileOp(repo).construct(opD, name))
+			}
+		})
+	}
+	for name, entry := range tree {
+		if old, ok := have[name]; ok && old.ref == entry.ref && old.mode == entry.mode && entry.ref != "inline" {
+			continue
+		}
+		op := entry.Copy()
+		op.Path = name
+		ops = append(ops, op)
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Path < ops[j].Path })
+	return ops
+}
+
+// carve reduces the repository, which must be a copy made by
+// duplicate, to the history of the subdirectory at prefix. origins
+// maps its events to those of the repository it was copied from.
+// Commits left changing nothing are deleted, or tagified if tagify
+// is set. Returns the number of commits removed.
+func (repo *Repository) carve(prefix string, origins map[Event]Event, tagify bool) int {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	commits := repo.commits(nil)
+	// All fileops are rewritten before any manifest of the copy is
+	// needed, as rewriting one commit invalidates its descendants'.
+	carved := make(map[*Commit][]*FileOp, len(commits))
+	for _, commit := range commits {
+		carved[commit] = carveOps(commit, origins[commit].(*Commit), prefix)
+		control.baton.twirl()
+	}
+	for _, commit := range commits {
+		commit.fileops = carved[commit]
+		commit._manifest = nil
+	}
+	deletia := repo.pruneCommits(commits, tagify)
+	repo.delete(deletia, orderedStringSet{"--tagback"})
+	repo.gcBlobs()
+	return len(deletia)
+}
+
+// pruneCommits goes through commits, which must be in event order and
+// include every child of each, removing redundant merge links and
+// finding those that change nothing. Each such commit's children are
+// reparented, it is tagified if tagify is set, and its index is
+// returned for deletion.
+func (repo *Repository) pruneCommits(commits []*Commit, tagify bool) orderedIntSet {
+	// A dropped commit is stood in for by its first parent, or by
+	// nothing if it was a root.
+	standin := make(map[*Commit]CommitLike)
+	var deletia orderedIntSet
+	for _, commit := range commits {
+		seen := make(map[CommitLike]bool)
+		var parents []CommitLike
+		var first CommitLike
+		for i, parent := range commit.parents() {
+			if p, ok := parent.(*Commit); ok {
+				if s, dropped := standin[p]; dropped {
+					parent = s
+				}
+			}
+			if i == 0 {
+				first = parent
+			}
+			if parent != nil && !seen[parent] {
+				seen[parent] = true
+				parents = append(parents, parent)
+			}
+		}
+		// A parent that is an ancestor of another adds nothing.
+		// Each parent's ancestry is walked once, and only for merges.
+		ancestry := make([]map[*Commit]bool, len(parents))
+		if len(parents) > 1 {
+			for i, parent := range parents {
+				if p, ok := parent.(*Commit); ok {
+					ancestry[i] = p.ancestorSet()
+				}
+			}
+		}
+		var kept []CommitLike
+		for i, parent := range parents {
+			redundant := false
+			if p, ok := parent.(*Commit); ok {
+				for j := range parents {
+					if i != j && ancestry[j][p] {
+						redundant = true
+						break
+					}
+				}
+			}
+			if !redundant {
+				kept = append(kept, parent)
+			}
+		}
+		if first != firstOf(kept) {
+			// The tree must come out the same from the new first parent.
+			tree := make(map[string]*FileOp)
+			commit.manifest().iter(func(name string, entry interface{}) {
+				tree[name] = entry.(*FileOp)
+			})
+			commit.setParents(kept)
+			base, _ := firstOf(kept).(*Commit)
+			commit.setOperations(treeOps(repo, base, tree))
+		} else {
+			commit.setParents(kept)
+		}
+		if len(kept) <= 1 && changesNothing(commit) {
+			commit.setOperations(nil)
+			if tagify && len(kept) == 1 {
+				repo.tagify(commit, defaultEmptyTagName(commit), kept[0].getMark(), "", false)
+			}
+			standin[commit] = firstOf(kept)
+			deletia = append(deletia, repo.eventToIndex(commit))
+		}
+		control.baton.twirl()
+	}
+	sort.Ints(deletia)
+	return deletia
+}
+
+// firstOf returns the first of a list of parents, or nil.
+func firstOf(parents []CommitLike) CommitLike {
+	if len(parents) == 0 {
+		return nil
+	}
+	return parents[0]
+}
@@ -0,0 +1,195 @@
+/*
+ * Generating changelogs from commit history
+ *
+ * This is the reverse of the changelogs command. Projects that give up
+ * keeping a ChangeLog by hand when they are converted often still want
+ * one, and Debian packaging wants debian/changelog; both can be made
+ * from the commit comments. Except for the FSF format, which is a flat
+ * list of entries, commits are grouped into releases at tags: a tagged
+ * commit closes the release the tag names.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// changelogPaths maps each changelog format to the path it is
+// committed at by default.
+var changelogPaths = map[string]string{
+	"fsf":      "ChangeLog",
+	"debian":   "debian/changelog",
+	"markdown": "NEWS.md",
+}
+
+// changelogRelease is a run of commits, in event order, closed by a
+// tagged commit. An empty version marks the commits after the last tag.
+type changelogRelease struct {
+	version string
+	commits []*Commit
+}
+
+// releaseName returns the name of the first tag pointing at a commit,
+// without any leading v before a digit, or "" if there is none.
+func releaseName(commit *Commit) string {
+	var name string
+	for _, event := range commit.attachments {
+		var ref string
+		switch e := event.(type) {
+		case *Tag:
+			ref = e.name
+		case *Reset:
+			ref = e.ref
+		}
+		if strings.HasPrefix(ref, "refs/tags/") {
+			name = ref[len("refs/tags/"):]
+			break
+		}
+	}
+	if len(name) > 1 && (name[0] == 'v' || name[0] == 'V') && name[1] >= '0' && name[1] <= '9' {
+		name = name[1:]
+	}
+	return name
+}
+
+// changelogAuthor returns the attribution a commit is credited to.
+func changelogAuthor(commit *Commit) *Attribution {
+	if len(commit.authors) > 0 {
+		return &commit.authors[0]
+	}
+	return &commit.committer
+}
+
+// changelogCommits returns the commits that belong in a changelog,
+// leaving out merges.
+func changelogCommits(commits []*Commit) []*Commit {
+	var kept []*Commit
+	for _, commit := range commits {
+		if len(commit.parents()) <= 1 {
+			kept = append(kept, commit)
+		}
+	}
+	return kept
+}
+
+// changelogReleases groups commits, in event order, into releases.
+func changelogReleases(commits []*Commit) []changelogRelease {
+	var releases []changelogRelease
+	var current []*Commit
+	for _, commit := range commits {
+		current = append(current, commit)
+		if version := releaseName(commit); version != "" {
+			releases = append(releases, changelogRelease{version, current})
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		releases = append(releases, changelogRelease{"", current})
+	}
+	return releases
+}
+
+// debianUnreleased returns the Debian version for the commits after
+// the last tag: the one given, or else the last release's with +git
+// appended. It is "" if there is neither.
+func debianUnreleased(releases []changelogRelease, given string) string {
+	if given != "" {
+		return given
+	}
+	for i := len(releases) - 1; i >= 0; i-- {
+		if releases[i].version != "" {
+			return releases[i].version + "+git"
+		}
+	}
+	return ""
+}
+
+// writeFSFChangelog writes commits, newest first, as FSF ChangeLog
+// entries with the comment indented by a tab. Consecutive commits by
+// the same author on the same day share a header.
+func writeFSFChangelog(w io.Writer, commits []*Commit) {
+	previous := ""
+	for i := len(commits) - 1; i >= 0; i-- {
+		author := changelogAuthor(commits[i])
+		header := fmt.Sprintf("%s  %s  <%s>\n\n",
+			author.date.timestamp.Format("2006-01-02"), author.fullname, author.email)
+		if header != previous {
+			fmt.Fprint(w, header)
+			previous = header
+		}
+		for _, line := range strings.Split(strings.TrimSpace(commits[i].Comment), "\n") {
+			if line = strings.TrimRight(line, " \t"); line != "" {
+				line = "\t" + line
+			}
+			fmt.Fprintln(w, line)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// writeDebianChangelog writes releases, newest first, as debian/changelog
+// entries, one line per commit. Each is signed off by the author of its
+// last commit. The commits after the last tag go under unreleased,
+// which names their version.
+func writeDebianChangelog(w io.Writer, releases []changelogRelease, pkg string, unreleased string) {
+	for i := len(releases) - 1; i >= 0; i-- {
+		release := releases[i]
+		version, distribution := release.version, "unstable"
+		if version == "" {
+			version, distribution = unreleased, "UNRELEASED"
+		}
+		fmt.Fprintf(w, "%s (%s) %s; urgency=medium\n\n", pkg, version, distribution)
+		for _, commit := range release.commits {
+			fmt.Fprintf(w, "  * %s\n", firstLine(commit.Comment))
+		}
+		signer := changelogAuthor(release.commits[len(release.commits)-1])
+		fmt.Fprintf(w, "\n -- %s <%s>  %s\n\n", signer.fullname, signer.email, signer.date.rfc1123())
+	}
+}
+
+// writeMarkdownChangelog writes releases, newest first, as a Markdown
+// NEWS file with a section per release and an item per commit. The
+// commits after the last tag go under unreleased if it is not empty,
+// and under an Unreleased heading otherwise.
+func writeMarkdownChangelog(w io.Writer, releases []changelogRelease, unreleased string) {
+	for i := len(releases) - 1; i >= 0; i-- {
+		release := releases[i]
+		last := changelogAuthor(release.commits[len(release.commits)-1])
+		switch {
+		case release.version != "":
+			fmt.Fprintf(w, "## %s (%s)\n\n", release.version, last.date.timestamp.Format("2006-01-02"))
+		case unreleased != "":
+			fmt.Fprintf(w, "## %s (%s)\n\n", unreleased, last.date.timestamp.Format("2006-01-02"))
+		default:
+			fmt.Fprint(w, "## Unreleased\n\n")
+		}
+		for _, commit := range release.commits {
+			fmt.Fprintf(w, "- %s (%s)\n", firstLine(commit.Comment), changelogAuthor(commit).fullname)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// commitChangelog puts content into the tree of commit at path, in a
+// new blob placed just before it. Commits after it on the branch inherit
+// the file.
+func (repo *Repository) commitChangelog(commit *Commit, path string, content []byte) {
+	blob := newBlob(repo)
+	blob.setMark(repo.newmark())
+	blob.setContent(content, noOffset)
+	blob.addalias(path)
+	repo.insertEvent(blob, repo.eventToIndex(commit), "mkchangelog")
+	var ops []*FileOp
+	for _, op := range commit.operations() {
+		if op.Path != path {
+			ops = append(ops, op)
+		}
+	}
+	ops = append(ops, newFileOp(repo).construct(opM, "100644", blob.mark, path))
+	commit.setOperations(ops)
+}
@@ -0,0 +1,297 @@
+/*
+ * Static checking of lift scripts
+ *
+ * A long conversion can run for hours before reaching a mistyped
+ * command near the end of its script. The checker reads a script the
+ * way the interpreter would and reports every error it can find
+ * without loading a repository: control-flow mismatches, unknown
+ * commands, options a command does not accept, selection expressions
+ * that do not compile, and macro calls that do not match their
+ * definitions.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	shlex "github.com/anmitsu/go-shlex"
+)
+
+// commandOptions lists the options each command accepts, including
+// those it passes on to the code doing the work. A command that is
+// not listed takes none. Keep this in step with the commands;
+// TestCommandOptions catches options a Do method tests for that are
+// missing here.
+var commandOptions = map[string]orderedStringSet{
+	"append": {"--legacy", "--rstrip"},
+	"apply":  {"--branch", "--dry-run", "--strip"},
+	"assign": {"--singleton"},
+	"branchifydir": {"--dry-run",
+		"--remove"},
+	"carve":       {"--dry-run", "--tagify"},
+	"coalesce":    {"--changelog", "--debug", "--dry-run"},
+	"delete":      append(orderedStringSet{"--dry-run"}, allPolicies...),
+	"diff":        {"--find-copies", "--find-renames", "--name-status", "--stat"},
+	"expunge":     {"--dry-run", "--notagify"},
+	"filter":      {"--dedos", "--regex", "--regexp", "--replace", "--shell"},
+	"graft":       {"--prune"},
+	"incorporate": {"--after", "--date", "--firewall", "--strip"},
+	"infermerges": {"--apply", "--threshold"},
+	"legacy":      {"--strip"},
+	"lint":        {"--attributions", "--connected", "--deletealls", "--names", "--options", "--roots", "--uniqueness"},
+	"mkchangelog": {"--commit", "--dry-run", "--format", "--package", "--path", "--version"},
+	"msgin":       {"--changed", "--create", "--empty-only"},
+	"msgout":      {"--filter"},
+	"path":        {"--dry-run", "--force"},
+	"pick":        {"--branch", "--dry-run", "--force"},
+	"read": {"--cvsignores", "--dry-run", "--format", "--git-svn-id",
+		"--ignore-properties", "--no-automatic-ignore", "--no-automatic-ignores",
+		"--no-implicit", "--nobranch", "--preserve", "--quiet", "--revprops",
+		"--use-uuid", "--user-ignores"},
+	"rebase":   {"--dry-run", "--force"},
+	"renames":  {"--copies", "--dry-run", "--similarity"},
+	"reorder":  {"--quiet"},
+	"reparent": {"--rebase", "--use-order"},
+	"repodiff": {"--match"},
+	"squash":   append(orderedStringSet{"--dry-run"}, allPolicies...),
+	"tagify":   {"--canonicalize", "--tagify-merges", "--tipdeletes"},
+	"unite":    {"--join", "--mainline", "--prune", "--subdirs"},
+	"unmerge":  {"--rebase"},
+	"write":    {"--callout", "--format", "--legacy", "--no-implicit", "--noincremental"},
+}
+
+// freeformCommands take text in which a word beginning with "--" is
+// not necessarily an option, so their arguments are not checked.
+var freeformCommands = newOrderedStringSet("assert", "define", "do",
+	"expect", "let", "print", "shell", "script")
+
+// scriptReferenceRE matches script arguments and variable references,
+// which cannot be known until the script runs.
+var scriptReferenceRE = regexp.MustCompile(`\$\{[^}]*\}|\$[0-9$]`)
+
+// branchNameStartRE matches the start of a name that could be a branch or tag.
+var branchNameStartRE = regexp.MustCompile(`^[\pL\pN_]`)
+
+// macroArgRE matches an argument placeholder in a macro body.
+var macroArgRE = regexp.MustCompile(`\{([0-9]+)\}`)
+
+// scriptChecker holds what a static check has learned about a script.
+type scriptChecker struct {
+	rs       *Reposurgeon
+	commands map[string]bool
+	macros   map[string]int // Macro name to number of arguments
+	problems []*scriptError
+}
+
+func newScriptChecker(rs *Reposurgeon) *scriptChecker {
+	sc := &scriptChecker{
+		rs:       rs,
+		commands: make(map[string]bool),
+		macros:   make(map[string]int),
+	}
+	// Commands are found the way the command loop finds them.
+	t := reflect.TypeOf(rs)
+	for i := 0; i < t.NumMethod(); i++ {
+		if name := t.Method(i).Name; strings.HasPrefix(name, "Do") {
+			sc.commands[strings.ToLower(name[len("Do"):])] = true
+		}
+	}
+	sc.commands["help"] = true
+	return sc
+}
+
+func (sc *scriptChecker) complain(lineno int, msg string, args ...interface{}) {
+	sc.problems = append(sc.problems, &scriptError{lineno, fmt.Sprintf(msg, args...)})
+}
+
+// compiles reports whether a selection expression is well-formed,
+// complaining if not. It returns what follows the expression.
+func (sc *scriptChecker) compiles(lineno int, expr string) (rest string, ok bool) {
+	defer func() {
+		if e := catch("command", recover()); e != nil {
+			sc.complain(lineno, "bad selection: %s", e.message)
+			ok = false
+		}
+	}()
+	_, rest = sc.rs.parseSelectionSet(expr)
+	return rest, true
+}
+
+// check examines a whole script, returning a description of each
+// problem found in line order.
+func (sc *scriptChecker) check(r io.Reader) []string {
+	stmts := splitScript(r)
+	sc.problems = append(sc.problems, matchBlocks(stmts)...)
+	for _, stmt := range stmts {
+		text := stmt.text
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = inlineCommentRE.Split(text, 2)[0]
+		text = scriptReferenceRE.ReplaceAllString(text, "1")
+		header := strings.TrimSpace(strings.TrimPrefix(text, stmt.keyword))
+		switch stmt.keyword {
+		case "if":
+			sc.checkCondition(stmt.lineno, header)
+		case "for":
+			sc.checkLoop(stmt.lineno, header)
+		case "else", "end":
+		default:
+			sc.checkCommand(stmt.lineno, text, stmt.block)
+		}
+	}
+	sort.SliceStable(sc.problems, func(i, j int) bool {
+		return sc.problems[i].lineno < sc.problems[j].lineno
+	})
+	report := make([]string, len(sc.problems))
+	for i, problem := range sc.problems {
+		report[i] = problem.Error()
+	}
+	return report
+}
+
+func (sc *scriptChecker) checkCondition(lineno int, cond string) {
+	if strings.HasPrefix(cond, "not ") {
+		cond = strings.TrimSpace(cond[len("not "):])
+	}
+	if strings.Contains(cond, "==") || strings.Contains(cond, "!=") {
+		words, err := shlex.Split(cond, true)
+		if err != nil || len(words) != 3 || (words[1] != "==" && words[1] != "!=") {
+			sc.complain(lineno, "malformed comparison %q", cond)
+		}
+		return
+	}
+	if cond == "" {
+		sc.complain(lineno, "if requires a condition")
+	} else if rest, ok := sc.compiles(lineno, cond+" "); ok && strings.TrimSpace(rest) != "" {
+		sc.complain(lineno, "junk after selection expression: %s", strings.TrimSpace(rest))
+	}
+}
+
+func (sc *scriptChecker) checkLoop(lineno int, header string) {
+	fields := strings.Fields(header)
+	if len(fields) < 2 || !variableNameRE.MatchString(fields[0]) {
+		sc.complain(lineno, "for requires a variable name and a source")
+		return
+	}
+	switch fields[1] {
+	case "in":
+	case "over":
+		expr := strings.Join(fields[2:], " ")
+		if rest, ok := sc.compiles(lineno, expr+" "); ok && strings.TrimSpace(rest) != "" {
+			sc.complain(lineno, "junk after selection expression: %s", strings.TrimSpace(rest))
+		}
+	case "branches", "tags":
+		if len(fields) > 2 {
+			sc.complain(lineno, "for %s takes nothing after it", fields[1])
+		}
+	default:
+		sc.complain(lineno, "unknown for form %q", fields[1])
+	}
+}
+
+// checkCommand examines one command line; block is the body of a
+// multi-line macro definition, if the line begins one.
+func (sc *scriptChecker) checkCommand(lineno int, line string, block []string) {
+	rest, ok := sc.compiles(lineno, line)
+	if !ok {
+		return
+	}
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, "?") {
+		rest = "help " + rest[1:]
+	} else if strings.HasPrefix(rest, "!") {
+		rest = "shell " + rest[1:]
+	}
+	cmd := rest
+	arg := ""
+	if i := strings.IndexAny(rest, " \t"); i != -1 {
+		cmd, arg = rest[:i], strings.TrimSpace(rest[i:])
+	}
+	cmd = strings.ToLower(cmd)
+	if !sc.commands[cmd] {
+		// A leading branch or tag name is a selection too, but
+		// recognizing one needs a loaded repository.
+		next := strings.ToLower(strings.Fields(arg + " x")[0])
+		if !sc.commands[next] || !branchNameStartRE.MatchString(cmd) {
+			sc.complain(lineno, "unknown command %q", cmd)
+		}
+		return
+	}
+	if !freeformCommands.Contains(cmd) {
+		stripped := regexp.MustCompile("<[^ ]+|>>?[^ ]+").ReplaceAllString(arg, "")
+		for _, word := range strings.Fields(stripped) {
+			if !strings.HasPrefix(word, "--") {
+				continue
+			}
+			option := strings.SplitN(word, "=", 2)[0]
+			if !commandOptions[cmd].Contains(option) {
+				sc.complain(lineno, "%s does not take a %s option", cmd, option)
+			}
+		}
+	}
+	switch cmd {
+	case "define":
+		sc.checkDefine(lineno, arg, block)
+	case "undefine":
+		delete(sc.macros, arg)
+	case "do":
+		words, err := shlex.Split(regexp.MustCompile(">>?[^ ]+").ReplaceAllString(arg, ""), true)
+		if err != nil {
+			sc.complain(lineno, "macro parse failed, %s", err)
+		} else if len(words) == 0 {
+			sc.complain(lineno, "no macro name was given")
+		} else if want, ok := sc.macros[words[0]]; !ok {
+			sc.complain(lineno, "'%s' is not a macro defined earlier in the script", words[0])
+		} else if len(words)-1 != want {
+			sc.complain(lineno, "macro %s takes %d argument(s), given %d", words[0], want, len(words)-1)
+		}
+	case "let":
+		if fields := strings.Fields(arg); len(fields) > 0 && !variableNameRE.MatchString(fields[0]) {
+			sc.complain(lineno, "%q is not a valid variable name", fields[0])
+		}
+	}
+}
+
+// checkDefine records a macro and checks the commands in its body.
+func (sc *scriptChecker) checkDefine(lineno int, arg string, block []string) {
+	words := strings.SplitN(arg, " ", 2)
+	if words[0] == "" || len(words) == 1 {
+		return
+	}
+	body := []string{words[1]}
+	if strings.HasPrefix(words[1], "{") {
+		body = block
+	}
+	arity := 0
+	for _, line := range body {
+		for _, m := range macroArgRE.FindAllStringSubmatch(line, -1) {
+			if n, _ := strconv.Atoi(m[1]); n+1 > arity {
+				arity = n + 1
+			}
+		}
+	}
+	sc.macros[words[0]] = arity
+	// A multi-line body ends on the line before the statement's last.
+	first := lineno
+	if len(body) > 0 && strings.HasPrefix(words[1], "{") {
+		first = lineno - len(body)
+	}
+	for i, line := range body {
+		line = macroArgRE.ReplaceAllString(line, "1")
+		line = scriptReferenceRE.ReplaceAllString(line, "1")
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "}") {
+			sc.checkCommand(first+i, inlineCommentRE.Split(line, 2)[0], nil)
+		}
+	}
+}
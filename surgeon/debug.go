@@ -0,0 +1,208 @@
+/*
+ * Script debugging
+ *
+ * Breakpoints stop a running script or macro before a command runs,
+ * by script line or by command name. At a stop the user gets a
+ * prompt at which any command can be run against the repository as
+ * it stands, or execution continued, single-stepped, or abandoned.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	kommandant "gitlab.com/ianbruene/kommandant"
+)
+
+// debugFrame is an active script or macro and where it has got to.
+type debugFrame struct {
+	name   string // Script filename or macro name
+	args   []string
+	macro  bool
+	lineno int
+	line   string
+}
+
+// debugger is the breakpoint and stepping state of an interpreter.
+type debugger struct {
+	breakpoints orderedStringSet
+	stepping    bool
+	stepDepth   int       // Stop only at this frame depth or shallower; 0 for any
+	input       io.Reader // Commands given to break, if any
+	frames      []*debugFrame
+}
+
+func newDebugger() *debugger {
+	return &debugger{
+		breakpoints: newOrderedStringSet(),
+	}
+}
+
+func (dbg *debugger) push(name string, args []string, macro bool) {
+	dbg.frames = append(dbg.frames, &debugFrame{name: name, args: args, macro: macro})
+}
+
+func (dbg *debugger) pop() {
+	dbg.frames = dbg.frames[:len(dbg.frames)-1]
+}
+
+// breakpointRE matches a line breakpoint, optionally qualified by a
+// script or macro name.
+var breakpointRE = regexp.MustCompile(`^(?:(.+):)?([0-9]+)$`)
+
+// matches tells whether a breakpoint applies to a frame about to run
+// a command of the given name.
+func (dbg *debugger) matches(breakpoint string, frame *debugFrame, command string) bool {
+	m := breakpointRE.FindStringSubmatch(breakpoint)
+	if m == nil {
+		return breakpoint == command
+	}
+	if lineno, _ := strconv.Atoi(m[2]); lineno != frame.lineno {
+		return false
+	}
+	if m[1] == "" {
+		return !frame.macro
+	}
+	if frame.macro {
+		return m[1] == frame.name
+	}
+	return m[1] == frame.name || m[1] == filepath.Base(frame.name)
+}
+
+// where reports the active scripts and macros, innermost first.
+func (dbg *debugger) where(w io.Writer) {
+	for i := len(dbg.frames) - 1; i >= 0; i-- {
+		frame := dbg.frames[i]
+		kind := "script"
+		if frame.macro {
+			kind = "macro"
+		}
+		call := strings.Join(append([]string{frame.name}, frame.args...), " ")
+		fmt.Fprintf(w, "  #%d %s %s, line %d: %s\n", len(dbg.frames)-1-i, kind, call, frame.lineno, frame.line)
+	}
+}
+
+// debugReadline reads a debugger command. Unless break was given
+// some, it reads from the interpreter's own input as define does for a
+// macro body, so that the commands after it are left to the command loop.
+func (rs *Reposurgeon) debugReadline() (string, error) {
+	if rs.debug.input != nil {
+		if control.isInteractive() {
+			fmt.Fprint(control.baton, "(debug) ")
+		}
+		return kommandant.ReadToDelimiter(rs.debug.input, '\n')
+	}
+	if rs.cmd == nil {
+		return "", io.EOF
+	}
+	existingPrompt := rs.cmd.GetPrompt()
+	if control.isInteractive() {
+		rs.cmd.SetPrompt("(debug) ")
+	} else {
+		rs.cmd.SetPrompt("")
+	}
+	defer rs.cmd.SetPrompt(existingPrompt)
+	text, err := rs.cmd.Readline()
+	if err == io.EOF {
+		// The input is used up; let the command loop see that too.
+		rs.cmd.CommandQueue = append(rs.cmd.CommandQueue, "EOF")
+	}
+	return text, err
+}
+
+// debugStop is called before each command of a script or macro runs.
+// It records the position, and if a breakpoint or single-step applies
+// it holds a debugging dialogue. It returns true if the user asked
+// for the script to be abandoned.
+func (rs *Reposurgeon) debugStop(ctx context.Context, lineno int, line string) bool {
+	dbg := rs.debug
+	if len(dbg.frames) == 0 {
+		return false
+	}
+	frame := dbg.frames[len(dbg.frames)-1]
+	frame.lineno, frame.line = lineno, line
+	if len(dbg.breakpoints) == 0 && !dbg.stepping {
+		return false
+	}
+
+	// Find the command without running anything.
+	var machine selEvaluator
+	command := ""
+	func() {
+		defer func() { catch("command", recover()) }()
+		var rest string
+		machine, rest = rs.parseSelectionSet(line)
+		if fields := strings.Fields(rest); len(fields) > 0 {
+			command = strings.ToLower(fields[0])
+		}
+	}()
+
+	stop := dbg.stepping && (dbg.stepDepth == 0 || len(dbg.frames) <= dbg.stepDepth)
+	for _, breakpoint := range dbg.breakpoints {
+		if dbg.matches(breakpoint, frame, command) {
+			stop = true
+		}
+	}
+	if !stop {
+		return false
+	}
+
+	// Only now is the waiting command's selection worth evaluating.
+	var pending []int
+	func() {
+		defer func() { catch("command", recover()) }()
+		if machine != nil && rs.chosen() != nil {
+			pending = rs.evalSelectionSet(machine, rs.chosen())
+		}
+	}()
+
+	fmt.Fprintf(control.baton, "stopped at %s:%d: %s\n", frame.name, lineno, line)
+	dbg.where(control.baton)
+	for {
+		text, err := rs.debugReadline()
+		if err != nil && text == "" {
+			// Out of input; carry on as though told to.
+			dbg.stepping = false
+			return false
+		}
+		text = strings.TrimSpace(text)
+		switch text {
+		case "":
+			continue
+		case "continue", "c":
+			dbg.stepping = false
+			return false
+		case "step", "s":
+			dbg.stepping, dbg.stepDepth = true, 0
+			return false
+		case "next", "n":
+			dbg.stepping, dbg.stepDepth = true, len(dbg.frames)
+			return false
+		case "where", "w":
+			dbg.where(control.baton)
+			continue
+		case "abort":
+			dbg.stepping = false
+			return true
+		}
+		// Anything else is an ordinary command. Without a selection
+		// of its own it gets that of the command waiting to run.
+		text = rs.cmd.PreCmd(ctx, text)
+		if rs.selection == nil {
+			rs.selection = pending
+		}
+		rs.cmd.OneCmd(ctx, text)
+		rs.cmd.PostCmd(ctx, false, text)
+		// An error here is the user's, not the script's.
+		control.setAbort(false)
+	}
+}
@@ -0,0 +1,431 @@
+/*
+ * Differences between commit trees
+ *
+ * The diff command compares the trees of two commits, or of a commit
+ * and its first parent. This is the machinery behind it: pairing up
+ * the paths of the two trees, detecting renames and copies by content
+ * similarity, spotting binary files, and rendering the result as a
+ * unified diff, a name-status list, or a diffstat.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	difflib "github.com/ianbruene/go-difflib/difflib"
+)
+
+// renameThreshold is the least similarity, in percent, at which an
+// added file is taken to be a rename or copy, as in git.
+const renameThreshold = 50
+
+// fileDelta is the change to one path, or pair of paths, between trees.
+type fileDelta struct {
+	status     byte // A, D, M, T (mode only), R, or C
+	from       string
+	to         string
+	fromMode   string
+	toMode     string
+	similarity int // Percent, for renames and copies
+	fromText   []byte
+	toText     []byte
+}
+
+// diffOptions controls what treeDelta reports.
+type diffOptions struct {
+	renames bool
+	copies  bool
+	paths   []string         // Report only these paths and directories...
+	regexps []*regexp.Regexp // ...and paths matching these
+}
+
+// wants tells whether a path passes the path limits.
+func (opts *diffOptions) wants(path string) bool {
+	if len(opts.paths) == 0 && len(opts.regexps) == 0 {
+		return true
+	}
+	for _, p := range opts.paths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	for _, re := range opts.regexps {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBinary guesses, the way git does, whether content is binary.
+func isBinary(text []byte) bool {
+	if len(text) > 8000 {
+		text = text[:8000]
+	}
+	return bytes.IndexByte(text, 0) != -1
+}
+
+// contentLines splits file content into lines for comparison.
+func contentLines(text []byte) []string {
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// similarity returns how alike two file contents are, in percent, or
+// 0 if they are less alike than renameThreshold.
+func similarity(a []byte, b []byte) int {
+	return similarityAbove(a, b, renameThreshold)
+}
+
+// similarityAbove is similarity with a given floor, below which
+// contents are not compared closely.
+func similarityAbove(a []byte, b []byte, floor int) int {
+	if bytes.Equal(a, b) {
+		return 100
+	}
+	if floor >= 100 || isBinary(a) || isBinary(b) {
+		return 0
+	}
+	m := difflib.NewMatcher(contentLines(a), contentLines(b))
+	if m.RealQuickRatio()*100 < float64(floor) || m.QuickRatio()*100 < float64(floor) {
+		return 0
+	}
+	return int(m.Ratio() * 100)
+}
+
+// treeDelta lists the changes from the tree of lower to that of upper.
+// A nil lower stands for the empty tree.
+func treeDelta(lower *Commit, upper *Commit, opts diffOptions) []*fileDelta {
+	entries := func(commit *Commit) map[string]*FileOp {
+		out := make(map[string]*FileOp)
+		if commit != nil {
+			commit.manifest().iter(func(name string, entry interface{}) {
+				out[name] = entry.(*FileOp)
+			})
+		}
+		return out
+	}
+	content := func(commit *Commit, path string) []byte {
+		text, _ := commit.blobByName(path)
+		return text
+	}
+	before, after := entries(lower), entries(upper)
+	paths := newOrderedStringSet()
+	for path := range before {
+		paths.Add(path)
+	}
+	for path := range after {
+		paths.Add(path)
+	}
+	sort.Strings(paths)
+
+	var deltas, added, deleted []*fileDelta
+	var sources []string // Paths of lower that might be copied
+	for _, path := range paths {
+		old, inBefore := before[path]
+		cur, inAfter := after[path]
+		switch {
+		case inBefore && inAfter:
+			sources = append(sources, path)
+			if old.ref == cur.ref && old.ref != "inline" && old.mode == cur.mode {
+				continue
+			}
+			d := &fileDelta{status: 'M', from: path, to: path, fromMode: old.mode, toMode: cur.mode,
+				fromText: content(lower, path), toText: content(upper, path)}
+			if bytes.Equal(d.fromText, d.toText) {
+				if d.fromMode == d.toMode {
+					continue
+				}
+				d.status = 'T'
+			}
+			if opts.wants(path) {
+				deltas = append(deltas, d)
+			}
+		case inBefore:
+			sources = append(sources, path)
+			deleted = append(deleted, &fileDelta{status: 'D', from: path, to: path,
+				fromMode: old.mode, fromText: content(lower, path)})
+		default:
+			added = append(added, &fileDelta{status: 'A', from: path, to: path,
+				toMode: cur.mode, toText: content(upper, path)})
+		}
+	}
+
+	if opts.renames || opts.copies {
+		// Pair each added file with the most similar deleted one.
+		var unpaired []*fileDelta
+		for _, a := range added {
+			best, score := -1, renameThreshold-1
+			for i, d := range deleted {
+				if d.status != 'D' {
+					continue
+				}
+				if s := similarity(d.fromText, a.toText); s > score {
+					best, score = i, s
+				}
+			}
+			if best == -1 {
+				unpaired = append(unpaired, a)
+				continue
+			}
+			d := deleted[best]
+			d.status, d.to, d.toMode, d.toText, d.similarity = 'R', a.to, a.toMode, a.toText, score
+		}
+		added = unpaired
+	}
+	if opts.copies {
+		// Any file of the lower tree may be the source of a copy.
+		texts := make(map[string][]byte)
+		unpaired := added[:0]
+		for _, a := range added {
+			best, score := "", renameThreshold-1
+			for _, path := range sources {
+				if _, ok := texts[path]; !ok {
+					texts[path] = content(lower, path)
+				}
+				if s := similarity(texts[path], a.toText); s > score {
+					best, score = path, s
+				}
+			}
+			if best == "" {
+				unpaired = append(unpaired, a)
+				continue
+			}
+			a.status, a.from, a.fromMode, a.similarity = 'C', best, before[best].mode, score
+			a.fromText = texts[best]
+			if opts.wants(a.from) || opts.wants(a.to) {
+				deltas = append(deltas, a)
+			}
+		}
+		added = unpaired
+	}
+
+	for _, d := range append(deleted, added...) {
+		if opts.wants(d.from) || opts.wants(d.to) {
+			deltas = append(deltas, d)
+		}
+	}
+	sort.SliceStable(deltas, func(i, j int) bool { return deltas[i].to < deltas[j].to })
+	return deltas
+}
+
+// lineCounts returns the lines added and removed by a change.
+func (d *fileDelta) lineCounts() (insertions int, deletions int) {
+	m := difflib.NewMatcher(contentLines(d.fromText), contentLines(d.toText))
+	for _, op := range m.GetOpCodes() {
+		if op.Tag == 'r' || op.Tag == 'd' {
+			deletions += op.I2 - op.I1
+		}
+		if op.Tag == 'r' || op.Tag == 'i' {
+			insertions += op.J2 - op.J1
+		}
+	}
+	return
+}
+
+func (d *fileDelta) binary() bool {
+	return isBinary(d.fromText) || isBinary(d.toText)
+}
+
+// name describes the path or paths of a change for a report.
+func (d *fileDelta) name() string {
+	if d.from != d.to {
+		return d.from + " -> " + d.to
+	}
+	return d.to
+}
+
+// writeUnified renders changes as unified diffs; lowerID and upperID
+// label the two sides.
+func writeUnified(w io.Writer, deltas []*fileDelta, lowerID string, upperID string) {
+	for _, d := range deltas {
+		switch d.status {
+		case 'A':
+			fmt.Fprintf(w, "%s: added\n", d.to)
+			continue
+		case 'D':
+			fmt.Fprintf(w, "%s: removed\n", d.from)
+			continue
+		case 'R':
+			fmt.Fprintf(w, "%s: renamed, %d%% similar\n", d.name(), d.similarity)
+		case 'C':
+			fmt.Fprintf(w, "%s: copied, %d%% similar\n", d.name(), d.similarity)
+		}
+		if d.fromMode != d.toMode {
+			fmt.Fprintf(w, "%s: mode %s -> %s\n", d.to, d.fromMode, d.toMode)
+		}
+		if bytes.Equal(d.fromText, d.toText) {
+			continue
+		}
+		if d.binary() {
+			fmt.Fprintf(w, "%s: binary files differ\n", d.name())
+			continue
+		}
+		diff := difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(d.fromText)),
+			B:        difflib.SplitLines(string(d.toText)),
+			FromFile: d.from + " (" + lowerID + ")",
+			ToFile:   d.to + " (" + upperID + ")",
+			Context:  3,
+		}
+		text, _ := difflib.GetUnifiedDiffString(diff)
+		fmt.Fprint(w, text)
+	}
+}
+
+// writeNameStatus lists changes one per line in the style of git
+// diff --name-status.
+func writeNameStatus(w io.Writer, deltas []*fileDelta) {
+	for _, d := range deltas {
+		switch d.status {
+		case 'R', 'C':
+			fmt.Fprintf(w, "%c%03d\t%s\t%s\n", d.status, d.similarity, d.from, d.to)
+		case 'D':
+			fmt.Fprintf(w, "D\t%s\n", d.from)
+		default:
+			fmt.Fprintf(w, "%c\t%s\n", d.status, d.to)
+		}
+	}
+}
+
+// statWidth is the widest a diffstat histogram bar gets.
+const statWidth = 50
+
+// writeStat summarizes changes in the style of git diff --stat.
+func writeStat(w io.Writer, deltas []*fileDelta) {
+	type statLine struct {
+		name       string
+		insertions int
+		deletions  int
+		binary     bool
+	}
+	var lines []statLine
+	namewidth, most := 0, 0
+	totalIns, totalDel := 0, 0
+	for _, d := range deltas {
+		line := statLine{name: d.name(), binary: d.binary()}
+		if !line.binary {
+			line.insertions, line.deletions = d.lineCounts()
+		}
+		if len(line.name) > namewidth {
+			namewidth = len(line.name)
+		}
+		if n := line.insertions + line.deletions; n > most {
+			most = n
+		}
+		totalIns += line.insertions
+		totalDel += line.deletions
+		lines = append(lines, line)
+	}
+	for _, line := range lines {
+		if line.binary {
+			fmt.Fprintf(w, " %-*s | Bin\n", namewidth, line.name)
+			continue
+		}
+		plus, minus := line.insertions, line.deletions
+		if most > statWidth {
+			plus = (plus*statWidth + most - 1) / most
+			minus = (minus*statWidth + most - 1) / most
+		}
+		bar := strings.Repeat("+", plus) + strings.Repeat("-", minus)
+		fmt.Fprintf(w, " %-*s | %s\n", namewidth, line.name,
+			strings.TrimSpace(fmt.Sprintf("%d %s", line.insertions+line.deletions, bar)))
+	}
+	fmt.Fprintf(w, " %d file(s) changed, %d insertion(s)(+), %d deletion(s)(-)\n",
+		len(lines), totalIns, totalDel)
+}
+
+// unifiedRange formats a hunk's line range the way diff -u does.
+func unifiedRange(start int, end int) string {
+	switch length := end - start; length {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, length)
+	}
+}
+
+// writeHunks writes the hunks of a unified diff between two contents,
+// marking a last line that has no newline as patch(1) expects.
+func writeHunks(w io.Writer, a []byte, b []byte) {
+	before, after := contentLines(a), contentLines(b)
+	line := func(prefix string, text string) {
+		fmt.Fprint(w, prefix, text)
+		if !strings.HasSuffix(text, "\n") {
+			fmt.Fprint(w, "\n\\ No newline at end of file\n")
+		}
+	}
+	for _, group := range difflib.NewMatcher(before, after).GetGroupedOpCodes(3) {
+		first, last := group[0], group[len(group)-1]
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", unifiedRange(first.I1, last.I2), unifiedRange(first.J1, last.J2))
+		for _, op := range group {
+			if op.Tag == 'e' {
+				for _, text := range before[op.I1:op.I2] {
+					line(" ", text)
+				}
+				continue
+			}
+			if op.Tag == 'r' || op.Tag == 'd' {
+				for _, text := range before[op.I1:op.I2] {
+					line("-", text)
+				}
+			}
+			if op.Tag == 'r' || op.Tag == 'i' {
+				for _, text := range after[op.J1:op.J2] {
+					line("+", text)
+				}
+			}
+		}
+	}
+}
+
+// writeGitDiff renders changes as a diff with git's extended headers,
+// which git apply and the apply command can both read.
+func writeGitDiff(w io.Writer, deltas []*fileDelta) {
+	for _, d := range deltas {
+		fmt.Fprintf(w, "diff --git a/%s b/%s\n", d.from, d.to)
+		switch d.status {
+		case 'A':
+			fmt.Fprintf(w, "new file mode %s\n", d.toMode)
+		case 'D':
+			fmt.Fprintf(w, "deleted file mode %s\n", d.fromMode)
+		case 'R', 'C':
+			verb := "rename"
+			if d.status == 'C' {
+				verb = "copy"
+			}
+			fmt.Fprintf(w, "similarity index %d%%\n%s from %s\n%s to %s\n", d.similarity, verb, d.from, verb, d.to)
+		}
+		if d.status != 'A' && d.status != 'D' && d.fromMode != d.toMode {
+			fmt.Fprintf(w, "old mode %s\nnew mode %s\n", d.fromMode, d.toMode)
+		}
+		if bytes.Equal(d.fromText, d.toText) {
+			continue
+		}
+		from, to := "a/"+d.from, "b/"+d.to
+		if d.status == 'A' {
+			from = "/dev/null"
+		} else if d.status == 'D' {
+			to = "/dev/null"
+		}
+		if d.binary() {
+			fmt.Fprintf(w, "Binary files %s and %s differ\n", from, to)
+			continue
+		}
+		fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+		writeHunks(w, d.fromText, d.toText)
+	}
+}
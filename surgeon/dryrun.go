@@ -0,0 +1,409 @@
+/*
+ * Dry runs of mutating commands
+ *
+ * On a large repository an expunge or squash can take a long time and
+ * is hard to undo. A dry run carries the command out against a scratch
+ * copy of the chosen repository, reports how the copy differs from the
+ * original - events deleted, added, or altered, fileops, parents, refs,
+ * and any repositories the command would have created - and then
+ * throws the copy away.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// dryRunRE matches the per-command option requesting a dry run.
+var dryRunRE = regexp.MustCompile(`(^|\s)--dry-run(\s|$)`)
+
+// scratchCopy makes a copy of the repository that can be altered
+// freely without touching the original, and returns it along with a
+// map from each event of the copy to the original it came from.
+func (repo *Repository) scratchCopy() (*Repository, map[Event]Event) {
+	return repo.duplicate(repo.name, filepath.Join(repo.subdir(""), "dryrun"))
+}
+
+// duplicate makes a copy of the repository under a new name, keeping
+// its storage under basedir. Blob files are hard-linked (or copied,
+// where links can't be made) into separate storage so that commands
+// moving them about leave the originals in place.
+func (repo *Repository) duplicate(name string, basedir string) (*Repository, map[Event]Event) {
+	sandbox := newRepository(name)
+	sandbox.basedir = basedir
+	sandbox.readtime = repo.readtime
+	sandbox.vcs = repo.vcs
+	sandbox.stronghint = repo.stronghint
+	sandbox.hintlist = repo.hintlist
+	sandbox.sourcedir = repo.sourcedir
+	sandbox.seekstream = repo.seekstream
+	sandbox.preserveSet = newOrderedStringSet(repo.preserveSet...)
+	sandbox.uuid = repo.uuid
+	sandbox.writeLegacy = repo.writeLegacy
+	sandbox.legacyCount = repo.legacyCount
+	sandbox.inlines = repo.inlines
+	sandbox.uniqueness = repo.uniqueness
+	sandbox.markseq = repo.markseq
+	sandbox.preferred = repo.preferred
+	for name, selection := range repo.assignments {
+		sandbox.assignments[name] = append(orderedIntSet(nil), selection...)
+	}
+	for k, v := range repo.authormap {
+		sandbox.authormap[k] = v
+	}
+	for k, v := range repo.tzmap {
+		sandbox.tzmap[k] = v
+	}
+	for k, v := range repo.aliases {
+		sandbox.aliases[k] = v
+	}
+
+	copies := make(map[Event]Event, len(repo.events))
+	origins := make(map[Event]Event, len(repo.events))
+	sandbox.events = make([]Event, 0, len(repo.events))
+	for _, event := range repo.events {
+		var c Event
+		switch e := event.(type) {
+		case *Blob:
+			b := *e
+			b.repo = sandbox
+			b.pathlist = append([]string(nil), e.pathlist...)
+			b.pathlistmap = make(map[string]bool, len(e.pathlistmap))
+			for k := range e.pathlistmap {
+				b.pathlistmap[k] = true
+			}
+			b._expungehook = nil
+			b.colors.Clear()
+			if e.hasfile() && e.abspath == "" {
+				src, dst := e.getBlobfile(false), b.getBlobfile(true)
+				if os.Link(src, dst) != nil {
+					if _, err := filecopy(src, dst); err != nil {
+						panic(throw("command", "while copying blob %s: %v", e.mark, err))
+					}
+				}
+			}
+			c = &b
+		case *Commit:
+			commit := *e
+			commit.repo = sandbox
+			commit.authors = append([]Attribution(nil), e.authors...)
+			if e.properties != nil {
+				properties := newOrderedMap()
+				for _, key := range e.properties.keys {
+					properties.set(key, e.properties.get(key))
+				}
+				properties.valueLess = e.properties.valueLess
+				commit.properties = &properties
+			}
+			commit.fileops = make([]*FileOp, len(e.fileops))
+			for i, op := range e.fileops {
+				fileop := *op
+				fileop.repo = sandbox
+				commit.fileops[i] = &fileop
+			}
+			commit._manifest = nil
+			commit._parentNodes = nil
+			commit._childNodes = nil
+			commit.attachments = nil
+			commit._expungehook = nil
+			c = &commit
+		case *Callout:
+			callout := *e
+			callout._childNodes = append([]string(nil), e._childNodes...)
+			c = &callout
+		case *Tag:
+			tag := *e
+			tag.repo = sandbox
+			if e.tagger != nil {
+				tagger := *e.tagger
+				tag.tagger = &tagger
+			}
+			c = &tag
+		case *Reset:
+			reset := *e
+			reset.repo = sandbox
+			c = &reset
+		case *Passthrough:
+			passthrough := *e
+			passthrough.repo = sandbox
+			c = &passthrough
+		default:
+			panic(throw("command", "cannot copy %s", event.idMe()))
+		}
+		copies[event] = c
+		origins[c] = event
+		sandbox.events = append(sandbox.events, c)
+	}
+
+	// Now every event has a copy the commit graph can be rebuilt.
+	for _, event := range repo.events {
+		commit, ok := event.(*Commit)
+		if !ok {
+			continue
+		}
+		c := copies[commit].(*Commit)
+		for _, parent := range commit.parents() {
+			p := copies[parent].(CommitLike)
+			c._parentNodes = append(c._parentNodes, p)
+			if pc, ok := p.(*Commit); ok {
+				pc._childNodes = append(pc._childNodes, c)
+			}
+		}
+		for _, attachment := range commit.attachments {
+			if a, ok := copies[attachment]; ok {
+				c.attachments = append(c.attachments, a)
+			}
+		}
+	}
+	for k, commit := range repo.legacyMap {
+		if c, ok := copies[commit]; ok {
+			sandbox.legacyMap[k] = c.(*Commit)
+		}
+	}
+	return sandbox, origins
+}
+
+// refTips returns a map from each ref in the repository to the mark
+// it points at.
+func (repo *Repository) refTips() map[string]string {
+	tips := repo.branchmap()
+	for _, event := range repo.events {
+		if tag, ok := event.(*Tag); ok {
+			tips[tag.name] = tag.committish
+		}
+	}
+	return tips
+}
+
+// fileopLines returns the fileops of a commit in dump form.
+func fileopLines(commit *Commit) []string {
+	lines := make([]string, len(commit.fileops))
+	for i, op := range commit.fileops {
+		lines[i] = strings.TrimSuffix(op.String(), "\n")
+	}
+	return lines
+}
+
+// listDifference returns the items of a not in b, counting repeats.
+func listDifference(a []string, b []string) []string {
+	count := make(map[string]int)
+	for _, s := range b {
+		count[s]++
+	}
+	var out []string
+	for _, s := range a {
+		if count[s] > 0 {
+			count[s]--
+		} else {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// reportChanges describes how a scratch copy has come to differ from
+// the repository it was made from.
+func reportChanges(w io.Writer, repo *Repository, sandbox *Repository, origins map[Event]Event) {
+	survivors := make(map[Event]Event)
+	var added []Event
+	for _, event := range sandbox.events {
+		if original, ok := origins[event]; ok {
+			survivors[original] = event
+		} else {
+			added = append(added, event)
+		}
+	}
+	var deletions, alterations, fileops int
+	for i, original := range repo.events {
+		event, ok := survivors[original]
+		if !ok {
+			fmt.Fprintf(w, "event %d %s: deleted\n", i+1, original.idMe())
+			deletions++
+			continue
+		}
+		var changes []string
+		switch o := original.(type) {
+		case *Commit:
+			c := event.(*Commit)
+			if c.Branch != o.Branch {
+				changes = append(changes, fmt.Sprintf("branch %s -> %s", o.Branch, c.Branch))
+			}
+			if before, after := strings.Join(o.parentMarks(), " "), strings.Join(c.parentMarks(), " "); before != after {
+				changes = append(changes, fmt.Sprintf("parents [%s] -> [%s]", before, after))
+			}
+			if c.Comment != o.Comment {
+				changes = append(changes, "comment changed")
+			}
+			before, after := fileopLines(o), fileopLines(c)
+			for _, line := range listDifference(before, after) {
+				changes = append(changes, "- "+line)
+				fileops++
+			}
+			for _, line := range listDifference(after, before) {
+				changes = append(changes, "+ "+line)
+				fileops++
+			}
+		case *Tag:
+			t := event.(*Tag)
+			if t.name != o.name {
+				changes = append(changes, fmt.Sprintf("name %s -> %s", o.name, t.name))
+			}
+			if t.committish != o.committish {
+				changes = append(changes, fmt.Sprintf("target %s -> %s", o.committish, t.committish))
+			}
+		case *Reset:
+			r := event.(*Reset)
+			if r.ref != o.ref {
+				changes = append(changes, fmt.Sprintf("ref %s -> %s", o.ref, r.ref))
+			}
+			if r.committish != o.committish {
+				changes = append(changes, fmt.Sprintf("target %s -> %s", o.committish, r.committish))
+			}
+		}
+		if len(changes) > 0 {
+			fmt.Fprintf(w, "event %d %s:\n", i+1, original.idMe())
+			for _, change := range changes {
+				fmt.Fprintf(w, "  %s\n", change)
+			}
+			alterations++
+		}
+	}
+	for _, event := range added {
+		fmt.Fprintf(w, "new event %d %s\n", sandbox.eventToIndex(event)+1, event.idMe())
+	}
+
+	before, after := repo.refTips(), sandbox.refTips()
+	refs := newOrderedStringSet()
+	for ref := range before {
+		refs.Add(ref)
+	}
+	for ref := range after {
+		refs.Add(ref)
+	}
+	sort.Strings(refs)
+	moved := 0
+	for _, ref := range refs {
+		was, wok := before[ref]
+		now, nok := after[ref]
+		switch {
+		case !nok:
+			fmt.Fprintf(w, "ref %s: deleted, was at %s\n", ref, was)
+		case !wok:
+			fmt.Fprintf(w, "ref %s: created at %s\n", ref, now)
+		case was != now:
+			fmt.Fprintf(w, "ref %s: moves from %s to %s\n", ref, was, now)
+		default:
+			continue
+		}
+		moved++
+	}
+
+	blobs := 0
+	for _, original := range repo.events {
+		if _, ok := original.(*Blob); ok {
+			if _, ok := survivors[original]; !ok {
+				blobs++
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d event(s) deleted (%d blob(s)), %d altered, %d added; %d fileop(s) and %d ref(s) changed\n",
+		deletions, blobs, alterations, len(added), fileops, moved)
+}
+
+// reportRepository describes a repository a command would have created.
+func reportRepository(w io.Writer, repo *Repository) {
+	counts := make(map[string]int)
+	for _, event := range repo.events {
+		switch event.(type) {
+		case *Blob:
+			counts["blob"]++
+		case *Commit:
+			counts["commit"]++
+		case *Tag:
+			counts["tag"]++
+		}
+	}
+	fmt.Fprintf(w, "would create repository %s: %d events, %d commits, %d blobs, %d tags\n",
+		repo.name, len(repo.events), counts["commit"], counts["blob"], counts["tag"])
+	tips := repo.refTips()
+	refs := make([]string, 0, len(tips))
+	for ref := range tips {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		fmt.Fprintf(w, "  %s at %s\n", ref, tips[ref])
+	}
+}
+
+// dryRun carries out a command as a dry run if one was asked for,
+// either with a --dry-run option or by the dryrun flag, and returns
+// true if it did. The command works on a scratch copy of the chosen
+// repository if scratch is set; repositories it creates are reported
+// and discarded.
+func (rs *Reposurgeon) dryRun(line string, do func(string) bool, scratch bool) bool {
+	if rs.dryRunning || !(control.flagOptions["dryrun"] || dryRunRE.MatchString(line)) {
+		return false
+	}
+	line = strings.TrimSpace(dryRunRE.ReplaceAllString(line, " "))
+	original := rs.chosen()
+	repolist := append([]*Repository(nil), rs.repolist...)
+	existing := make(map[string]bool)
+	streams := make(map[*os.File]bool)
+	for _, repo := range repolist {
+		existing[repo.name] = true
+		streams[repo.seekstream] = true
+	}
+	var sandbox *Repository
+	var origins map[Event]Event
+	if scratch && original != nil {
+		sandbox, origins = original.scratchCopy()
+		rs.repolist = make([]*Repository, len(repolist))
+		for i, repo := range repolist {
+			if repo == original {
+				repo = sandbox
+			}
+			rs.repolist[i] = repo
+		}
+		rs.choose(sandbox)
+	}
+	rs.dryRunning = true
+	defer func() {
+		rs.dryRunning = false
+		for _, repo := range rs.repolist {
+			if repo != sandbox && !existing[repo.name] {
+				if repo.seekstream != nil && !streams[repo.seekstream] {
+					repo.seekstream.Close()
+				}
+				repo.cleanup()
+			}
+		}
+		if sandbox != nil {
+			nuke(sandbox.basedir, "")
+		}
+		rs.repolist = repolist
+		rs.choose(original)
+	}()
+
+	do(line)
+
+	w := control.baton
+	if sandbox != nil {
+		reportChanges(w, original, sandbox, origins)
+	}
+	for _, repo := range rs.repolist {
+		if repo != sandbox && !existing[repo.name] {
+			reportRepository(w, repo)
+		}
+	}
+	return true
+}
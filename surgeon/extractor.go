@@ -31,7 +31,7 @@
 //
 // SPDX-License-Identifier: BSD-2-Clause
 
-package main
+package surgeon
 
 import (
 	"bufio"
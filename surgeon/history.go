@@ -0,0 +1,138 @@
+/*
+ * History of a single path
+ *
+ * Finds every commit that touched a file under its present name or
+ * any earlier one. Commits are examined newest first; a name is taken
+ * to be an earlier one for the file when a commit renames or copies it
+ * into place with an R or C fileop, or creates the file with the very
+ * blob some other path already had - the form that Subversion
+ * copy-froms and git renames take in an import stream. Empty blobs
+ * are not matched, and paths with the file's basename are preferred.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// pathHistory returns, in event order, the indices of the commits
+// touching path or its earlier names, along with the fileops of each
+// that did so.
+func (repo *Repository) pathHistory(path string) ([]int, map[int][]*FileOp) {
+	names := newOrderedStringSet(path)
+	touches := make(map[int][]*FileOp)
+	var hits []int
+	for i := len(repo.events) - 1; i >= 0; i-- {
+		commit, ok := repo.events[i].(*Commit)
+		if !ok {
+			continue
+		}
+		var ops []*FileOp
+		var earlier []string
+		for _, op := range commit.operations() {
+			switch op.op {
+			case opM, opD:
+				if !names.Contains(op.Path) {
+					continue
+				}
+				ops = append(ops, op)
+				if op.op == opM && op.ref != "inline" {
+					earlier = append(earlier, commit.copySources(op)...)
+				}
+			case opR, opC:
+				if names.Contains(op.Target) {
+					ops = append(ops, op)
+					earlier = append(earlier, op.Source)
+				} else if names.Contains(op.Source) {
+					ops = append(ops, op)
+				}
+			}
+		}
+		if len(ops) > 0 {
+			hits = append(hits, i)
+			touches[i] = ops
+		}
+		for _, name := range earlier {
+			names.Add(name)
+		}
+	}
+	for i, j := 0, len(hits)-1; i < j; i, j = i+1, j-1 {
+		hits[i], hits[j] = hits[j], hits[i]
+	}
+	return hits, touches
+}
+
+// copySources returns the paths a file created by a modify op may have
+// been copied from: those with the same blob in a parent's tree. An
+// empty blob says nothing about where a file came from, and an R or C
+// op bringing the file into place names its source already. When some
+// candidates share the file's basename, only those are returned.
+func (commit *Commit) copySources(op *FileOp) []string {
+	for _, other := range commit.operations() {
+		if (other.op == opR || other.op == opC) && other.Target == op.Path {
+			return nil
+		}
+	}
+	if blob, ok := commit.repo.markToEvent(op.ref).(*Blob); ok && blob.size == 0 {
+		return nil
+	}
+	var sources, namesakes []string
+	for i, p := range commit.parents() {
+		parent, ok := p.(*Commit)
+		if !ok {
+			continue
+		}
+		if i == 0 {
+			if _, present := parent.manifest().get(op.Path); present {
+				// Not a new file, so not a copy.
+				return nil
+			}
+		}
+		parent.manifest().iter(func(name string, entry interface{}) {
+			if entry.(*FileOp).ref == op.ref && name != op.Path {
+				sources = append(sources, name)
+				if path.Base(name) == path.Base(op.Path) {
+					namesakes = append(namesakes, name)
+				}
+			}
+		})
+	}
+	if len(namesakes) > 0 {
+		return namesakes
+	}
+	return sources
+}
+
+// describeFileop summarizes a fileop for a history listing.
+func describeFileop(op *FileOp) string {
+	switch op.op {
+	case opR, opC:
+		return fmt.Sprintf("%c %s -> %s", op.op, op.Source, op.Target)
+	default:
+		return fmt.Sprintf("%c %s", op.op, op.Path)
+	}
+}
+
+// writePathHistory lists the commits in a path's history that are in
+// the selection.
+func (repo *Repository) writePathHistory(w io.Writer, path string, selection orderedIntSet) {
+	hits, touches := repo.pathHistory(path)
+	for _, i := range hits {
+		if selection != nil && !selection.Contains(i) {
+			continue
+		}
+		commit := repo.events[i].(*Commit)
+		ops := make([]string, len(touches[i]))
+		for j, op := range touches[i] {
+			ops[j] = describeFileop(op)
+		}
+		fmt.Fprintf(w, "%6d %6s %s %s\t%s\n", i+1, commit.mark,
+			commit.committer.date.rfc3339(), strings.Join(ops, "; "), firstLine(commit.Comment))
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * Uniting repositories into subdirectories of one
+ *
+ * Each repository's tree is moved under a subdirectory named after it
+ * and its refs into a namespace of the same name, all but the mainline
+ * branch, which the repositories share. The events of the
+ * repositories are interleaved by commit date, and the mainline commits
+ * are chained in that order, so each mainline commit sees the latest
+ * state of every subdirectory. A repository can instead keep its early
+ * history to itself and be merged into the mainline at a given commit.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// namespaceRef puts a ref into a repository's namespace, so that
+// refs/heads/topic becomes refs/heads/NAME/topic.
+func namespaceRef(ref string, name string) string {
+	parts := strings.SplitN(ref, "/", 3)
+	if len(parts) < 3 || parts[0] != "refs" {
+		return ref
+	}
+	return parts[0] + "/" + parts[1] + "/" + name + "/" + parts[2]
+}
+
+// moveUnder moves a commit's fileops under a subdirectory. A deleteall
+// becomes a deletion of the subdirectory, so the rest of the tree is
+// left alone.
+func (commit *Commit) moveUnder(dir string) {
+	for i, op := range commit.fileops {
+		switch op.op {
+		case opM, opD:
+			op.Path = dir + "/" + op.Path
+		case opR, opC:
+			op.Source = dir + "/" + op.Source
+			op.Target = dir + "/" + op.Target
+		case deleteall:
+			commit.fileops[i] = newFileOp(commit.repo).construct(opD, dir)
+		}
+	}
+	commit._manifest = nil
+}
+
+// interleave merges the event sequences of several repositories,
+// keeping the order within each and otherwise taking commits in date
+// order. Passthroughs leading a sequence go first.
+func interleave(factors []*Repository) []Event {
+	var front, events []Event
+	queues := make([][]Event, len(factors))
+	for i, factor := range factors {
+		queue := factor.events
+		for len(queue) > 0 {
+			if passthrough, ok := queue[0].(*Passthrough); ok {
+				front = append(front, passthrough)
+				queue = queue[1:]
+			} else {
+				break
+			}
+		}
+		queues[i] = queue
+	}
+	// nextCommit finds the first commit in a queue, or -1.
+	nextCommit := func(queue []Event) int {
+		for i, event := range queue {
+			if _, ok := event.(*Commit); ok {
+				return i
+			}
+		}
+		return -1
+	}
+	for {
+		best, at := -1, -1
+		for i, queue := range queues {
+			if j := nextCommit(queue); j != -1 {
+				if best == -1 || queue[j].(*Commit).when().Before(queues[best][at].(*Commit).when()) {
+					best, at = i, j
+				}
+			}
+		}
+		if best == -1 {
+			break
+		}
+		events = append(events, queues[best][:at+1]...)
+		queues[best] = queues[best][at+1:]
+	}
+	for _, queue := range queues {
+		events = append(events, queue...)
+	}
+	return append(front, events...)
+}
+
+// uniteSubdirs unites repositories into one in which each lives under
+// a subdirectory named after it. Commits on the mainline branch of
+// each are chained into one shared mainline in date order. joins maps
+// a repository name to a reference to one of its mainline commits;
+// that repository's mainline up to the commit is kept on a branch of
+// its own and merged into the shared mainline there.
+func (rl *RepositoryList) uniteSubdirs(factors []*Repository, mainline string, joins map[string]string) error {
+	for _, factor := range factors {
+		if len(factor.commits(nil)) == 0 {
+			return fmt.Errorf("empty factor %s", factor.name)
+		}
+		if strings.Contains(factor.name, "/") || strings.Contains(factor.name, "+") {
+			return fmt.Errorf("repository name %s cannot be used as a subdirectory", factor.name)
+		}
+	}
+	sort.SliceStable(factors, func(i, j int) bool {
+		return factors[i].earliest().Before(factors[j].earliest())
+	})
+	mainref := "refs/heads/" + mainline
+	owner := make(map[*Commit]*Repository)
+	onMainline := make(map[*Commit]bool)
+	joinAt := make(map[*Repository]*Commit)
+	for _, factor := range factors {
+		for _, commit := range factor.commits(nil) {
+			owner[commit] = factor
+			onMainline[commit] = commit.Branch == mainref
+		}
+		if ref, ok := joins[factor.name]; ok {
+			var event Event
+			if strings.HasPrefix(ref, ":") {
+				event = factor.markToEvent(ref)
+			} else if selection := factor.named(ref); len(selection) == 1 {
+				event = factor.events[selection[0]]
+			}
+			if event == nil {
+				return fmt.Errorf("join point %s does not identify a single commit in %s", ref, factor.name)
+			}
+			commit, ok := event.(*Commit)
+			if !ok || !onMainline[commit] {
+				return fmt.Errorf("join point %s is not a commit on %s in %s", ref, mainline, factor.name)
+			}
+			joinAt[factor] = commit
+		}
+	}
+	for name := range joins {
+		found := false
+		for _, factor := range factors {
+			found = found || factor.name == name
+		}
+		if !found {
+			return fmt.Errorf("join point given for %s, which is not being united", name)
+		}
+	}
+
+	// Move each repository into its subdirectory and namespace. The
+	// mainline is namespaced too for now, so that marks can be made
+	// unique without any names colliding.
+	uname := ""
+	persist := make(map[string]string)
+	for _, factor := range factors {
+		uname += "+" + factor.name
+		for _, event := range factor.events {
+			switch e := event.(type) {
+			case *Commit:
+				e.moveUnder(factor.name)
+				e.Branch = namespaceRef(e.Branch, factor.name)
+			case *Tag:
+				e.name = namespaceRef(e.name, factor.name)
+			case *Reset:
+				e.ref = namespaceRef(e.ref, factor.name)
+			}
+		}
+		persist = factor.uniquify(factor.name, persist)
+	}
+	union := newRepository(uname[1:])
+	union.makedir()
+	events := interleave(factors)
+	for _, factor := range factors {
+		union.preserveSet = union.preserveSet.Union(factor.preserveSet)
+		for _, event := range factor.events {
+			event.moveto(union)
+		}
+		factor.events = nil
+		factor.cleanup()
+		rl.removeByName(factor.name)
+	}
+
+	// Chain the mainline commits, merging in repositories that join
+	// part way along.
+	var previous *Commit
+	last := make(map[*Repository]*Commit)
+	joined := make(map[*Repository]bool)
+	for _, factor := range factors {
+		joined[factor] = joinAt[factor] == nil
+	}
+	for _, event := range events {
+		union.events = append(union.events, event)
+		commit, ok := event.(*Commit)
+		if !ok || !onMainline[commit] {
+			continue
+		}
+		factor := owner[commit]
+		if !joined[factor] {
+			if commit != joinAt[factor] {
+				continue
+			}
+			joined[factor] = true
+			last[factor] = commit
+			if previous == nil {
+				commit.Branch = mainref
+				previous = commit
+				continue
+			}
+			join := newCommit(union)
+			join.committer = commit.committer
+			join.Comment = fmt.Sprintf("Merge %s into %s.\n", factor.name, mainline)
+			join.Branch = mainref
+			join.setMark(union.newmark())
+			join.setParents([]CommitLike{previous, commit})
+			var ops []*FileOp
+			commit.manifest().iter(func(name string, entry interface{}) {
+				op := entry.(*FileOp).Copy()
+				op.Path = name
+				ops = append(ops, op)
+			})
+			sort.Slice(ops, func(i, j int) bool { return ops[i].Path < ops[j].Path })
+			join.setOperations(ops)
+			union.events = append(union.events, join)
+			previous = join
+			continue
+		}
+		commit.Branch = mainref
+		parents := commit.parents()
+		if previous == nil {
+			previous, last[factor] = commit, commit
+			continue
+		}
+		var first CommitLike
+		if len(parents) > 0 {
+			first = parents[0]
+		}
+		if first == CommitLike(last[factor]) && last[factor] != nil {
+			// The usual case: the fileops apply as they stand, since
+			// they touch only this repository's subdirectory.
+			commit.setParents(append([]CommitLike{previous}, parents[1:]...))
+		} else {
+			// Forked from elsewhere; keep that link as a merge and
+			// rebuild the tree from the rest of the mainline and this
+			// repository's part.
+			tree := make(map[string]*FileOp)
+			previous.manifest().iter(func(name string, entry interface{}) {
+				if !strings.HasPrefix(name, factor.name+"/") {
+					tree[name] = entry.(*FileOp)
+				}
+			})
+			commit.manifest().iter(func(name string, entry interface{}) {
+				tree[name] = entry.(*FileOp)
+			})
+			commit.setParents(append([]CommitLike{previous}, parents...))
+			commit.setOperations(treeOps(union, previous, tree))
+		}
+		previous, last[factor] = commit, commit
+	}
+	union.declareSequenceMutation("unite")
+	union.renumber(1, nil)
+	rl.repolist = append(rl.repolist, union)
+	rl.choose(union)
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Exporting commits as a patch series
+ *
+ * The selected commits are written as an mbox in the form git
+ * format-patch produces, one message per commit: the author in the
+ * From and Date headers, the first line of the comment as the subject
+ * and the rest as the body, then a diffstat and a diff against the
+ * first parent with git's extended headers. This is the form upstream
+ * maintainers are used to reviewing, and git am or the apply command
+ * can turn it back into commits.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// mboxQuote escapes body lines that an mbox reader would take for the
+// start of a message, the way mboxrd does.
+func mboxQuote(text string) string {
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			lines[i] = ">" + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// writePatch writes a commit as one mbox message. number and total
+// go in the subject tag when there is more than one patch.
+func (commit *Commit) writePatch(w io.Writer, number int, total int) {
+	author := commit.committer
+	if len(commit.authors) > 0 {
+		author = commit.authors[0]
+	}
+	from := mail.Address{Name: author.fullname, Address: author.email}
+	subject, body := commit.Comment, ""
+	if nl := strings.Index(subject, "\n"); nl != -1 {
+		subject, body = subject[:nl], strings.TrimSpace(subject[nl+1:])
+	}
+	tag := "[PATCH]"
+	if total > 1 {
+		tag = fmt.Sprintf("[PATCH %d/%d]", number, total)
+	}
+	fmt.Fprintf(w, "From %s Mon Sep 17 00:00:00 2001\n", commit.mark)
+	fmt.Fprintf(w, "From: %s\n", from.String())
+	fmt.Fprintf(w, "Date: %s\n", author.date.rfc1123())
+	fmt.Fprintf(w, "Subject: %s\n", mime.QEncoding.Encode("utf-8", tag+" "+subject))
+	fmt.Fprint(w, "MIME-Version: 1.0\nContent-Type: text/plain; charset=UTF-8\nContent-Transfer-Encoding: 8bit\n\n")
+	if body != "" {
+		fmt.Fprint(w, mboxQuote(body+"\n"), "\n")
+	}
+	var parent *Commit
+	if commit.hasParents() {
+		parent, _ = commit.parents()[0].(*Commit)
+	}
+	deltas := treeDelta(parent, commit, diffOptions{renames: true})
+	fmt.Fprint(w, "---\n")
+	writeStat(w, deltas)
+	fmt.Fprint(w, "\n")
+	writeGitDiff(w, deltas)
+	fmt.Fprintf(w, "-- \nreposurgeon %s\n\n", version)
+}
+
+// writePatches writes the given commits as an mbox patch series,
+// leaving out merges and commits that change nothing. Returns the
+// number of patches written.
+func writePatches(w io.Writer, commits []*Commit) int {
+	var series []*Commit
+	for _, commit := range commits {
+		if len(commit.parents()) > 1 {
+			continue
+		}
+		var parent *Commit
+		if commit.hasParents() {
+			var ok bool
+			if parent, ok = commit.parents()[0].(*Commit); !ok {
+				continue
+			}
+		}
+		if len(treeDelta(parent, commit, diffOptions{})) > 0 {
+			series = append(series, commit)
+		}
+	}
+	for i, commit := range series {
+		commit.writePatch(w, i+1, len(series))
+		control.baton.twirl()
+	}
+	return len(series)
+}
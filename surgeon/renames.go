@@ -0,0 +1,233 @@
+/*
+ * Inference of renames and copies
+ *
+ * Streams made from CVS, and by some exporters, record a move as the
+ * deletion of one path and the addition of another in the same
+ * commit, so history-following tools lose track of the file. Here the
+ * deleted and added paths of each commit are paired up, first by
+ * identical content and then, if asked, by content similarity, and
+ * the pairs are rewritten as R fileops. Added paths can likewise be
+ * matched against files that survive the commit and rewritten as C
+ * fileops.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// inference is a rename or copy found in a commit.
+type inference struct {
+	commit     *Commit
+	op         rune // opR or opC
+	source     string
+	target     string
+	similarity int
+}
+
+func (inf *inference) String() string {
+	return fmt.Sprintf("%s %c %s -> %s (%d%%)", inf.commit.mark, inf.op, inf.source, inf.target, inf.similarity)
+}
+
+// fileopContent returns the content a modify op puts in place, or
+// false if it is not available, as for a submodule link.
+func fileopContent(op *FileOp) ([]byte, bool) {
+	if op.ref == "inline" {
+		return op.inline, true
+	}
+	if blob, ok := op.repo.markToEvent(op.ref).(*Blob); ok {
+		return blob.getContent(), true
+	}
+	return nil, false
+}
+
+// inferRenames finds the renames, and copies if asked, implied by the
+// deletions and additions of a commit. Pairs whose contents are less
+// than threshold percent similar are not made; 100 accepts identical
+// content only. Copies are looked for among all files of the parent
+// tree with the same blob, and among files the commit modifies.
+func (commit *Commit) inferRenames(threshold int, copies bool) []*inference {
+	if !commit.hasParents() {
+		return nil
+	}
+	parent, ok := commit.parents()[0].(*Commit)
+	if !ok {
+		return nil
+	}
+	// Only paths touched by a single D or M are candidates, so moving
+	// the ops about cannot change what the commit does.
+	touches := make(map[string]int)
+	for _, op := range commit.operations() {
+		switch op.op {
+		case deleteall:
+			return nil
+		case opR, opC:
+			touches[op.Source]++
+			touches[op.Target]++
+		default:
+			touches[op.Path]++
+		}
+	}
+	type candidate struct {
+		op   *FileOp
+		text []byte
+	}
+	var deleted, added, modified []candidate
+	for _, op := range commit.operations() {
+		if touches[op.Path] != 1 {
+			continue
+		}
+		_, inParent := parent.manifest().get(op.Path)
+		switch {
+		case op.op == opD && inParent:
+			text, _ := parent.blobByName(op.Path)
+			deleted = append(deleted, candidate{op, text})
+		case op.op == opM && op.mode != "160000":
+			text, ok := fileopContent(op)
+			if !ok {
+				continue
+			}
+			if inParent {
+				modified = append(modified, candidate{op, text})
+			} else {
+				added = append(added, candidate{op, text})
+			}
+		}
+	}
+
+	var found []*inference
+	paired := make(map[*FileOp]bool)
+	pair := func(op rune, source string, target *FileOp, score int) {
+		found = append(found, &inference{commit, op, source, target.Path, score})
+		paired[target] = true
+	}
+	// Identical content first, so a fuzzy match cannot take a file
+	// that has an exact one elsewhere.
+	for _, a := range added {
+		for _, d := range deleted {
+			if !paired[d.op] && bytes.Equal(d.text, a.text) {
+				paired[d.op] = true
+				pair(opR, d.op.Path, a.op, 100)
+				break
+			}
+		}
+	}
+	if threshold < 100 {
+		for _, a := range added {
+			if paired[a.op] {
+				continue
+			}
+			best, score := -1, threshold-1
+			for i, d := range deleted {
+				if paired[d.op] {
+					continue
+				}
+				if s := similarityAbove(d.text, a.text, threshold); s > score {
+					best, score = i, s
+				}
+			}
+			if best != -1 {
+				paired[deleted[best].op] = true
+				pair(opR, deleted[best].op.Path, a.op, score)
+			}
+		}
+	}
+	if copies {
+		byRef := make(map[string]string)
+		parent.manifest().iter(func(name string, entry interface{}) {
+			op := entry.(*FileOp)
+			if _, ok := byRef[op.ref]; !ok && op.ref != "inline" && touches[name] == 0 {
+				byRef[op.ref] = name
+			}
+		})
+		for _, a := range added {
+			if paired[a.op] {
+				continue
+			}
+			if source, ok := byRef[a.op.ref]; ok {
+				pair(opC, source, a.op, 100)
+				continue
+			}
+			best, score := "", threshold-1
+			for _, m := range modified {
+				text, _ := parent.blobByName(m.op.Path)
+				if s := similarityAbove(text, a.text, threshold); s > score {
+					best, score = m.op.Path, s
+				}
+			}
+			if best != "" {
+				pair(opC, best, a.op, score)
+			}
+		}
+	}
+	return found
+}
+
+// applyInferences rewrites a commit's fileops to carry out renames and
+// copies found by inferRenames. Each rename replaces the deletion of
+// its source, or comes just before the addition of its target if that
+// is earlier; copies go first, so they copy the parent's version of
+// their source. The addition is kept only if the content or mode of
+// the target differs from the source's.
+func (commit *Commit) applyInferences(found []*inference) {
+	parent := commit.parents()[0].(*Commit)
+	var copyOps []*FileOp
+	renames := make(map[string]*inference) // By source and by target
+	for _, inf := range found {
+		if inf.op == opC {
+			copyOps = append(copyOps, newFileOp(commit.repo).construct(opC, inf.source, inf.target))
+		} else {
+			renames[inf.source] = inf
+		}
+		renames[inf.target] = inf
+	}
+	ops := copyOps
+	done := make(map[*inference]bool)
+	for _, op := range commit.operations() {
+		inf, ok := renames[op.Path]
+		if !ok || (op.op != opM && op.op != opD) {
+			ops = append(ops, op)
+			continue
+		}
+		if inf.op == opR && !done[inf] {
+			ops = append(ops, newFileOp(commit.repo).construct(opR, inf.source, inf.target))
+			done[inf] = true
+		}
+		if op.op == opM {
+			value, _ := parent.manifest().get(inf.source)
+			if inf.similarity < 100 || value.(*FileOp).mode != op.mode {
+				ops = append(ops, op)
+			}
+		}
+	}
+	commit.setOperations(ops)
+}
+
+// rewriteRenames finds and makes renames and copies in the selected
+// commits, writing a line to w for each.
+func (repo *Repository) rewriteRenames(w io.Writer, selection orderedIntSet, threshold int, copies bool) (renames int, copied int) {
+	for _, commit := range repo.commits(selection) {
+		found := commit.inferRenames(threshold, copies)
+		if len(found) == 0 {
+			continue
+		}
+		for _, inf := range found {
+			fmt.Fprintln(w, inf)
+			if inf.op == opR {
+				renames++
+			} else {
+				copied++
+			}
+		}
+		commit.applyInferences(found)
+	}
+	if renames+copied > 0 && !control.flagOptions["defergc"] {
+		repo.gcBlobs()
+	}
+	return
+}
@@ -0,0 +1,209 @@
+/*
+ * Replaying commits onto another parent
+ *
+ * A commit's fileops say how to get from its first parent's tree to
+ * its own. To move the change it makes somewhere else, the paths that
+ * differ between those two trees are found and applied to the tree of
+ * the new parent, which is worked out ahead as a PathMap so that a run
+ * of commits can be replayed without touching the repository until
+ * every one is known to apply. A path the change touches that the new
+ * parent has in a third state is a conflict.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// replayConflict is a path that a replayed commit changes and that the
+// tree it is replayed onto already has in a different state.
+type replayConflict struct {
+	commit *Commit
+	path   string
+}
+
+func (rc replayConflict) String() string {
+	return fmt.Sprintf("%s %s", rc.commit.idMe(), rc.path)
+}
+
+// sameEntry tells whether two manifest entries have the same mode and
+// content; either may be nil for an absent path.
+func sameEntry(a *FileOp, b *FileOp) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.mode != b.mode || a.ref != b.ref {
+		return false
+	}
+	return a.ref != "inline" || bytes.Equal(a.inline, b.inline)
+}
+
+// treeEntry looks up a path in a manifest, returning nil if it is absent.
+func treeEntry(tree *PathMap, path string) *FileOp {
+	if entry, ok := tree.get(path); ok {
+		return entry.(*FileOp)
+	}
+	return nil
+}
+
+// commitByRef resolves a mark or a name to a commit, following a tag
+// to the commit it points at. Returns nil if there is no such commit.
+func (repo *Repository) commitByRef(ref string) *Commit {
+	var event Event
+	if strings.HasPrefix(ref, ":") {
+		event = repo.markToEvent(ref)
+	} else if selection := repo.named(ref); len(selection) == 1 {
+		event = repo.events[selection[0]]
+	}
+	if tag, ok := event.(*Tag); ok {
+		event = repo.markToEvent(tag.committish)
+	}
+	commit, _ := event.(*Commit)
+	return commit
+}
+
+// replayOps works out the fileops that make each of commits, which must
+// be in event order and have at most one parent each, do the same to
+// the tree as before when they are chained, in order, onto onto. With
+// force, a conflicting path takes the state the replayed commit gives
+// it; otherwise conflicts are only reported.
+func replayOps(commits []*Commit, onto *Commit, force bool) (map[*Commit][]*FileOp, []replayConflict) {
+	replayed := make(map[*Commit][]*FileOp, len(commits))
+	var conflicts []replayConflict
+	tree := onto.manifest().snapshot()
+	for _, commit := range commits {
+		before := newPathMap()
+		var touched []string
+		if parent, ok := firstOf(commit.parents()).(*Commit); ok {
+			before = parent.manifest()
+			touched = commit.touchedPaths(parent)
+		} else {
+			touched = commit.manifest().pathnames()
+		}
+		sort.Strings(touched)
+		var ops []*FileOp
+		for _, path := range touched {
+			old := treeEntry(before, path)
+			now := treeEntry(commit.manifest(), path)
+			there := treeEntry(tree, path)
+			if sameEntry(old, now) || sameEntry(there, now) {
+				continue
+			}
+			if !sameEntry(there, old) {
+				conflicts = append(conflicts, replayConflict{commit, path})
+				if !force {
+					continue
+				}
+			}
+			if now == nil {
+				ops = append(ops, newFileOp(commit.repo).construct(opD, path))
+				tree.remove(path)
+			} else {
+				op := now.Copy()
+				op.Path = path
+				ops = append(ops, op)
+				tree.set(path, now)
+			}
+		}
+		replayed[commit] = ops
+		control.baton.twirl()
+	}
+	return replayed, conflicts
+}
+
+// pick copies commits onto onto, chaining the copies in order on the
+// given branch and placing them after onto and the last of commits.
+// fileops are those computed by replayOps. Each copy records its
+// original with a cherry-pick line. Returns the copies.
+func (repo *Repository) pick(commits []*Commit, onto *Commit, branch string, fileops map[*Commit][]*FileOp) []*Commit {
+	where := repo.eventToIndex(onto)
+	if last := repo.eventToIndex(commits[len(commits)-1]); last > where {
+		where = last
+	}
+	var copies []*Commit
+	var previous CommitLike = onto
+	for _, commit := range commits {
+		c := commit.clone(repo)
+		c.setMark(repo.newmark())
+		c.legacyID = ""
+		c.Branch = branch
+		c.Comment = appendTrailers(commit.Comment, cherrypickTrailer(commit))
+		c.setParents([]CommitLike{previous})
+		c.setOperations(fileops[commit])
+		where++
+		repo.insertEvent(c, where, "pick")
+		copies = append(copies, c)
+		previous = c
+	}
+	return copies
+}
+
+// rebase moves commits onto onto, chaining them in order and giving
+// each the fileops computed by replayOps. A child of a moved commit
+// that was not moved keeps its tree. Events are resorted so that each
+// moved commit follows its new parent.
+func (repo *Repository) rebase(commits []*Commit, onto *Commit, fileops map[*Commit][]*FileOp) {
+	moved := make(map[*Commit]bool, len(commits))
+	for _, commit := range commits {
+		moved[commit] = true
+	}
+	// Trees of the children left behind are taken before anything
+	// changes, as changing a commit invalidates its descendants'.
+	trees := make(map[*Commit]map[string]*FileOp)
+	for _, commit := range commits {
+		for _, child := range commit.children() {
+			c, ok := child.(*Commit)
+			if !ok || moved[c] || firstOf(c.parents()) != CommitLike(commit) {
+				continue
+			}
+			tree := make(map[string]*FileOp)
+			c.manifest().iter(func(name string, entry interface{}) {
+				tree[name] = entry.(*FileOp)
+			})
+			trees[c] = tree
+		}
+	}
+	previous := onto
+	for _, commit := range commits {
+		commit.setParents([]CommitLike{previous})
+		commit.setOperations(fileops[commit])
+		previous = commit
+	}
+	for child, tree := range trees {
+		child.setOperations(treeOps(repo, firstOf(child.parents()).(*Commit), tree))
+	}
+	repo.resort()
+}
+
+// replayable checks that the selected commits can be replayed onto the
+// commit ref names, returning them in event order and the commit.
+func (repo *Repository) replayable(selection orderedIntSet, ref string) ([]*Commit, *Commit, error) {
+	selection = append(orderedIntSet(nil), selection...)
+	selection.Sort()
+	commits := repo.commits(selection)
+	if len(commits) == 0 {
+		return nil, nil, fmt.Errorf("no commits selected")
+	}
+	onto := repo.commitByRef(ref)
+	if onto == nil {
+		return nil, nil, fmt.Errorf("%s does not name a commit", ref)
+	}
+	for _, commit := range commits {
+		if commit == onto {
+			return nil, nil, fmt.Errorf("%s is both selected and the target", commit.idMe())
+		}
+		if len(commit.parents()) > 1 {
+			return nil, nil, fmt.Errorf("%s is a merge and cannot be replayed", commit.idMe())
+		}
+		if _, ok := firstOf(commit.parents()).(*Callout); ok {
+			return nil, nil, fmt.Errorf("%s has a callout parent", commit.idMe())
+		}
+	}
+	return commits, onto, nil
+}
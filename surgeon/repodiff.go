@@ -0,0 +1,271 @@
+/*
+ * Structural comparison of two repositories
+ *
+ * Commits of one repository are paired with their counterparts in the
+ * other by legacy ID, action stamp, or tree content, tried in a given
+ * order. The report lists commits found on only one side, metadata
+ * differences between paired commits, differences in the refs, and
+ * the paths that differ between the tips of refs the two share.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// matchMethods names the ways commits can be paired, in default order.
+var matchMethods = orderedStringSet{"legacy", "stamp", "tree"}
+
+var matchDescriptions = map[string]string{
+	"legacy": "legacy ID",
+	"stamp":  "action stamp",
+	"tree":   "tree content",
+}
+
+// repoComparison pairs the commits of two repositories.
+type repoComparison struct {
+	a       *Repository
+	b       *Repository
+	matched map[*Commit]*Commit // From a to b
+	reverse map[*Commit]*Commit // From b to a
+	method  map[*Commit]string  // How each commit of a was matched
+	trees   map[*Commit]string  // Memoized tree hashes
+}
+
+// compareRepositories pairs the commits of a and b, trying each of the
+// given methods in turn on the commits not yet paired.
+func compareRepositories(a *Repository, b *Repository, methods []string) *repoComparison {
+	rc := &repoComparison{
+		a:       a,
+		b:       b,
+		matched: make(map[*Commit]*Commit),
+		reverse: make(map[*Commit]*Commit),
+		method:  make(map[*Commit]string),
+		trees:   make(map[*Commit]string),
+	}
+	for _, method := range methods {
+		index := make(map[string][]*Commit)
+		for _, commit := range b.commits(nil) {
+			if _, ok := rc.reverse[commit]; !ok {
+				if key := rc.key(method, commit); key != "" {
+					index[key] = append(index[key], commit)
+				}
+			}
+		}
+		for _, commit := range a.commits(nil) {
+			if _, ok := rc.matched[commit]; ok {
+				continue
+			}
+			key := rc.key(method, commit)
+			if candidates := index[key]; key != "" && len(candidates) > 0 {
+				rc.matched[commit] = candidates[0]
+				rc.reverse[candidates[0]] = commit
+				rc.method[commit] = method
+				index[key] = candidates[1:]
+			}
+		}
+	}
+	return rc
+}
+
+// key returns what a commit is matched on by a method.
+func (rc *repoComparison) key(method string, commit *Commit) string {
+	switch method {
+	case "legacy":
+		return commit.legacyID
+	case "stamp":
+		return commit.actionStamp()
+	case "tree":
+		return rc.treeHash(commit)
+	}
+	return ""
+}
+
+func (rc *repoComparison) treeHash(commit *Commit) string {
+	hash, ok := rc.trees[commit]
+	if !ok {
+		hash = commit.treeHash()
+		rc.trees[commit] = hash
+	}
+	return hash
+}
+
+// describeCommit identifies a commit for a comparison report.
+func describeCommit(commit *Commit) string {
+	return fmt.Sprintf("%s %s %s", commit.mark, commit.actionStamp(), firstLine(commit.Comment))
+}
+
+func firstLine(text string) string {
+	return strings.SplitN(strings.TrimSpace(text), "\n", 2)[0]
+}
+
+// commitChanges lists the metadata differences between paired commits.
+func (rc *repoComparison) commitChanges(ca *Commit, cb *Commit) []string {
+	var changes []string
+	if ca.Branch != cb.Branch {
+		changes = append(changes, fmt.Sprintf("branch: %s -> %s", ca.Branch, cb.Branch))
+	}
+	if ca.committer.String() != cb.committer.String() {
+		changes = append(changes, fmt.Sprintf("committer: %s -> %s", ca.committer, cb.committer))
+	}
+	var authorsA, authorsB []string
+	for _, author := range ca.authors {
+		authorsA = append(authorsA, author.String())
+	}
+	for _, author := range cb.authors {
+		authorsB = append(authorsB, author.String())
+	}
+	if strings.Join(authorsA, ", ") != strings.Join(authorsB, ", ") {
+		changes = append(changes, fmt.Sprintf("author: %s -> %s", strings.Join(authorsA, ", "), strings.Join(authorsB, ", ")))
+	}
+	if ca.Comment != cb.Comment {
+		changes = append(changes, "comment differs")
+	}
+	// Parents correspond if each is paired with its opposite number.
+	same := len(ca.parents()) == len(cb.parents())
+	if same {
+		for i, parent := range ca.parents() {
+			pa, ok := parent.(*Commit)
+			if !ok {
+				same = parent.getMark() == cb.parents()[i].getMark()
+			} else {
+				same = rc.matched[pa] == cb.parents()[i]
+			}
+			if !same {
+				break
+			}
+		}
+	}
+	if !same {
+		changes = append(changes, fmt.Sprintf("parents: [%s] -> [%s]",
+			strings.Join(ca.parentMarks(), " "), strings.Join(cb.parentMarks(), " ")))
+	}
+	return changes
+}
+
+// treeChanges lists the paths that differ between the trees of two commits.
+func treeChanges(ca *Commit, cb *Commit) []string {
+	paths := newOrderedStringSet()
+	ca.manifest().iter(func(name string, _ interface{}) {
+		paths.Add(name)
+	})
+	cb.manifest().iter(func(name string, _ interface{}) {
+		paths.Add(name)
+	})
+	sort.Strings(paths)
+	var changes []string
+	for _, path := range paths {
+		opa, oka := ca.manifest().get(path)
+		opb, okb := cb.manifest().get(path)
+		switch {
+		case !okb:
+			changes = append(changes, path+": removed")
+		case !oka:
+			changes = append(changes, path+": added")
+		case opa.(*FileOp).mode != opb.(*FileOp).mode:
+			changes = append(changes, fmt.Sprintf("%s: mode %s -> %s", path, opa.(*FileOp).mode, opb.(*FileOp).mode))
+		default:
+			contentA, _ := ca.blobByName(path)
+			contentB, _ := cb.blobByName(path)
+			if !bytes.Equal(contentA, contentB) {
+				changes = append(changes, path+": modified")
+			}
+		}
+	}
+	return changes
+}
+
+// report writes out the comparison.
+func (rc *repoComparison) report(w io.Writer) {
+	var onlyA, onlyB []*Commit
+	for _, commit := range rc.a.commits(nil) {
+		if _, ok := rc.matched[commit]; !ok {
+			onlyA = append(onlyA, commit)
+		}
+	}
+	for _, commit := range rc.b.commits(nil) {
+		if _, ok := rc.reverse[commit]; !ok {
+			onlyB = append(onlyB, commit)
+		}
+	}
+	counts := make(map[string]int)
+	for _, method := range rc.method {
+		counts[method]++
+	}
+	var how []string
+	for _, method := range matchMethods {
+		if counts[method] > 0 {
+			how = append(how, fmt.Sprintf("%d by %s", counts[method], matchDescriptions[method]))
+		}
+	}
+	summary := ""
+	if len(how) > 0 {
+		summary = " (" + strings.Join(how, ", ") + ")"
+	}
+	fmt.Fprintf(w, "%d commits matched%s, %d only in %s, %d only in %s\n",
+		len(rc.matched), summary, len(onlyA), rc.a.name, len(onlyB), rc.b.name)
+
+	for _, commit := range onlyA {
+		fmt.Fprintf(w, "- %s\n", describeCommit(commit))
+	}
+	for _, commit := range onlyB {
+		fmt.Fprintf(w, "+ %s\n", describeCommit(commit))
+	}
+	for _, ca := range rc.a.commits(nil) {
+		cb, ok := rc.matched[ca]
+		if !ok {
+			continue
+		}
+		if changes := rc.commitChanges(ca, cb); len(changes) > 0 {
+			fmt.Fprintf(w, "~ %s -> %s, matched by %s\n", ca.mark, cb.mark, matchDescriptions[rc.method[ca]])
+			for _, change := range changes {
+				fmt.Fprintf(w, "    %s\n", change)
+			}
+		}
+	}
+
+	tipsA, tipsB := rc.a.refTips(), rc.b.refTips()
+	refs := newOrderedStringSet()
+	for ref := range tipsA {
+		refs.Add(ref)
+	}
+	for ref := range tipsB {
+		refs.Add(ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		markA, okA := tipsA[ref]
+		markB, okB := tipsB[ref]
+		if !okB {
+			fmt.Fprintf(w, "ref %s: only in %s, at %s\n", ref, rc.a.name, markA)
+			continue
+		}
+		if !okA {
+			fmt.Fprintf(w, "ref %s: only in %s, at %s\n", ref, rc.b.name, markB)
+			continue
+		}
+		tipA, okA := rc.a.markToEvent(markA).(*Commit)
+		tipB, okB := rc.b.markToEvent(markB).(*Commit)
+		if !okA || !okB {
+			continue
+		}
+		var changes []string
+		if rc.matched[tipA] != tipB {
+			changes = append(changes, fmt.Sprintf("tips do not correspond: %s -> %s", markA, markB))
+		}
+		changes = append(changes, treeChanges(tipA, tipB)...)
+		if len(changes) > 0 {
+			fmt.Fprintf(w, "ref %s:\n", ref)
+			for _, change := range changes {
+				fmt.Fprintf(w, "    %s\n", change)
+			}
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package surgeon
 
 // This code is intended to be hackable to support for special-purpose or
 // custom operations, though it's even better if you can come up with a new
@@ -82,6 +82,7 @@ import (
 	"container/heap"
 	"context"
 	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html"
@@ -1479,6 +1480,14 @@ commands frequently. Set this flag to skip the garbage collection, then clear
 it and run the dedup command at the end of your lift script to do the garbage
 collection all at once. Currently the "tag" and "dedup" commands are the only
 ones which do this garbage collection.
+`},
+	{"dryrun",
+		`Carry out the expunge, squash, delete, path, coalesce, renames,
+branchifydir, pick, rebase, apply, carve, and mkchangelog commands as
+dry runs, as though each had been given the --dry-run option: report
+what the command would change and leave the repositories as they were.
+The read command is not affected, so that there is a repository to
+try them on; give it --dry-run to preview a read.
 `},
 	{"echo",
 		`Echo commands before executing them. Setting this im test scripts may
@@ -1522,10 +1531,12 @@ type Control struct {
 	// The abort flag
 	abortScript    bool
 	abortLock      sync.Mutex
+	lastCroak      string // Most recent error message, for library callers
 	flagOptions    map[string]bool
 	listOptions    map[string]orderedStringSet
 	mapOptions     map[string]map[string]string
 	branchMappings []branchMapping
+	branchify      []branchifyEntry // svn_branchify, parsed
 	readLimit      uint64
 	profilename    string
 }
@@ -1537,10 +1548,11 @@ func (ctx *Control) isInteractive() bool {
 type branchMapping struct {
 	match   *regexp.Regexp
 	replace string
+	scope   revisionScope
 }
 
 func (b branchMapping) String() string {
-	return fmt.Sprintf("{match=%s, replace=%s}", b.match, b.replace)
+	return fmt.Sprintf("{match=%s, replace=%s, scope=%s}", b.match, b.replace, b.scope)
 }
 
 func (ctx *Control) init() {
@@ -1558,6 +1570,12 @@ func (ctx *Control) init() {
 	var b interface{} = baton
 	ctx.logfp = b.(io.Writer)
 	ctx.baton = baton
+}
+
+// catchSignals turns interrupts into script aborts. Only the
+// standalone interpreter does this; a program importing this package
+// keeps its own signal handling.
+func (ctx *Control) catchSignals() {
 	signal.Notify(control.signals, os.Interrupt)
 	go func() {
 		for {
@@ -1566,7 +1584,6 @@ func (ctx *Control) init() {
 			respond("Interrupt\n")
 		}
 	}()
-
 }
 
 var control Control
@@ -1634,6 +1651,7 @@ func nuke(directory string, legend string) {
 
 func croak(msg string, args ...interface{}) {
 	content := fmt.Sprintf(msg, args...)
+	control.lastCroak = content
 	control.baton.printLogString("reposurgeon: " + content + "\n")
 	if !control.flagOptions["relax"] {
 		control.setAbort(true)
@@ -3626,6 +3644,34 @@ func (commit *Commit) hasProperties() bool {
 	return commit.properties != nil
 }
 
+var trailerRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*: `)
+
+// appendTrailers adds trailer lines (Key: value) to the end of a comment,
+// starting a new paragraph unless the comment already ends in trailers.
+func appendTrailers(comment string, trailers ...string) string {
+	if len(trailers) == 0 {
+		return comment
+	}
+	comment = strings.TrimRight(comment, "\n")
+	if comment != "" {
+		paragraphs := strings.Split(comment, "\n\n")
+		last := strings.Split(paragraphs[len(paragraphs)-1], "\n")
+		inTrailers := len(paragraphs) > 1
+		for _, line := range last {
+			if !trailerRE.MatchString(line) && !strings.HasPrefix(line, " ") {
+				inTrailers = false
+				break
+			}
+		}
+		if inTrailers {
+			comment += "\n"
+		} else {
+			comment += "\n\n"
+		}
+	}
+	return comment + strings.Join(trailers, "\n") + "\n"
+}
+
 // lister enables DoList() to report commits.
 func (commit *Commit) lister(_modifiers orderedStringSet, eventnum int, cols int) string {
 	topline := strings.Split(commit.Comment, "\n")[0]
@@ -4600,6 +4646,78 @@ func (commit *Commit) blobByName(pathname string) ([]byte, bool) {
 	}
 }
 
+// treeHash returns the hash git would give the commit's tree, so a
+// conversion can be checked against a tree known from elsewhere.
+func (commit *Commit) treeHash() string {
+	type treeEntry struct {
+		mode string
+		name string
+		hash []byte
+	}
+	dirs := map[string][]treeEntry{"": nil}
+	var adddir func(dir string)
+	adddir = func(dir string) {
+		if _, ok := dirs[dir]; ok {
+			return
+		}
+		parent := path.Dir(dir)
+		if parent == "." {
+			parent = ""
+		}
+		adddir(parent)
+		dirs[dir] = nil
+		dirs[parent] = append(dirs[parent], treeEntry{"40000", path.Base(dir), nil})
+	}
+	object := func(kind string, body []byte) []byte {
+		h := sha1.New()
+		fmt.Fprintf(h, "%s %d\x00", kind, len(body))
+		h.Write(body)
+		return h.Sum(nil)
+	}
+	commit.manifest().iter(func(pathname string, pentry interface{}) {
+		entry := pentry.(*FileOp)
+		dir := path.Dir(pathname)
+		if dir == "." {
+			dir = ""
+		}
+		adddir(dir)
+		mode := strings.TrimLeft(entry.mode, "0")
+		if len(mode) == 3 {
+			mode = "100" + mode
+		}
+		var hash []byte
+		if mode == "160000" {
+			hash, _ = hex.DecodeString(entry.ref)
+		} else {
+			content, _ := commit.blobByName(pathname)
+			hash = object("blob", content)
+		}
+		dirs[dir] = append(dirs[dir], treeEntry{mode, path.Base(pathname), hash})
+	})
+	var hashdir func(dir string) []byte
+	hashdir = func(dir string) []byte {
+		entries := dirs[dir]
+		// Git orders a subdirectory as though its name ended in a slash.
+		sortkey := func(e treeEntry) string {
+			if e.mode == "40000" {
+				return e.name + "/"
+			}
+			return e.name
+		}
+		sort.Slice(entries, func(i, j int) bool { return sortkey(entries[i]) < sortkey(entries[j]) })
+		var body bytes.Buffer
+		for _, e := range entries {
+			if e.mode == "40000" {
+				e.hash = hashdir(path.Join(dir, e.name))
+			}
+			fmt.Fprintf(&body, "%s %s\x00", e.mode, e.name)
+			body.Write(e.hash)
+		}
+		return object("tree", body.Bytes())
+	}
+	return hex.EncodeToString(hashdir(""))
+}
+
 // decodable tells whether this commi us enriirely composed of decodable UTF-8.
 func (commit *Commit) decodable() bool {
 	valid := func(s string) bool {
@@ -6473,6 +6591,49 @@ func (repo *Repository) readLegacyMap(fp io.Reader) error {
 	return nil
 }
 
+var gitSvnIDRE = regexp.MustCompile(`(?m)^git-svn-id: (\S+)@([0-9]+)(?: ([0-9A-Fa-f-]+))?[ \t]*\n?`)
+
+// recoverGitSvnIDs sets Subversion legacy IDs from the git-svn-id trailers
+// left by git-svn, optionally removing the trailers.
+func (repo *Repository) recoverGitSvnIDs(strip bool) {
+	// A commit's old legacy ID is dropped from the map when it gets a
+	// new one; the map is keyed in several ways, so find the keys first.
+	keys := make(map[*Commit][]string)
+	for key, commit := range repo.legacyMap {
+		keys[commit] = append(keys[commit], key)
+	}
+	matched := 0
+	repo.byCommit(func(commit *Commit) {
+		m := gitSvnIDRE.FindStringSubmatch(commit.Comment)
+		if m == nil {
+			return
+		}
+		legacy := "SVN:" + m[2]
+		if other, ok := repo.legacyMap[legacy]; ok && other != commit {
+			logit(logWARN, "r%s is claimed by both %s and %s; keeping the former",
+				m[2], other.idMe(), commit.idMe())
+		} else {
+			for _, key := range keys[commit] {
+				if key != legacy {
+					delete(repo.legacyMap, key)
+				}
+			}
+			commit.legacyID = m[2]
+			repo.legacyMap[legacy] = commit
+			matched++
+		}
+		if repo.uuid == "" {
+			repo.uuid = m[3]
+		}
+		if strip {
+			commit.Comment = gitSvnIDRE.ReplaceAllString(commit.Comment, "")
+			commit.Comment = strings.TrimRight(commit.Comment, "\n") + "\n"
+		}
+		control.baton.twirl()
+	})
+	respond("%d legacy IDs recovered from git-svn-id trailers", matched)
+}
+
 // commits returns a slice of the commits in a specified selection set
 // or all commits if the selection set is nil.
 func (repo *Repository) commits(selection orderedIntSet) []*Commit {
@@ -8006,11 +8167,17 @@ func (repo *Repository) renumber(origin int, baton *Baton) {
 	}
 	for _, commit := range repo.commits(nil) {
 		for i, fileop := range commit.operations() {
-			if fileop.op == opM && strings.HasPrefix(fileop.ref, ":") {
+			if (fileop.op == opM || fileop.op == opN) && strings.HasPrefix(fileop.ref, ":") {
 				newmark = remark(fileop.ref, "fileop")
 				logit(logUNITE, fmt.Sprintf("renumbering %s -> %s in fileop", fileop.ref, newmark))
 				commit.fileops[i].ref = newmark
 			}
+			// A note's path is the mark of the commit it annotates
+			if _, ok := markmap[fileop.Path]; ok && fileop.op == opN {
+				newmark = remark(fileop.Path, "note")
+				logit(logUNITE, fmt.Sprintf("renumbering %s -> %s in note", fileop.Path, newmark))
+				commit.fileops[i].Path = newmark
+			}
 		}
 		if baton != nil {
 			baton.bumpcounter()
@@ -10730,6 +10897,11 @@ type Reposurgeon struct {
 	RepositoryList
 	SelectionParser
 	callstack    [][]string
+	scopes       []map[string]string // Script variables, innermost last
+	expectFails  int                 // Failed expect checks in the running script
+	debug        *debugger
+	dryRunning   bool // A dry run is in progress
+	unknown      bool // The last line named no command
 	selection    orderedIntSet
 	history      []string
 	preferred    *VCS
@@ -10747,13 +10919,15 @@ func newReposurgeon() *Reposurgeon {
 	rs.SelectionParser.subclass = rs
 	rs.startTime = time.Now()
 	rs.definitions = make(map[string][]string)
+	rs.scopes = []map[string]string{make(map[string]string)}
+	rs.debug = newDebugger()
 	rs.inputIsStdin = true
 	rs.promptFormat = "reposurgeon% "
 	// These are globals and should probably be set in init().
 	for _, option := range optionFlags {
 		control.listOptions[option[0]] = newOrderedStringSet()
 	}
-	control.listOptions["svn_branchify"] = orderedStringSet{"trunk", "tags/*", "branches/*", "*"}
+	setBranchify(orderedStringSet{"trunk", "tags/*", "branches/*", "*"})
 	return rs
 }
 
@@ -10772,6 +10946,16 @@ func (rs *Reposurgeon) SetCore(k *kommandant.Kmdt) {
 	}
 }
 
+// Default is the Kommandant hook for lines that name no command. It
+// reports them as Kommandant would, through the baton so the report
+// goes wherever command output is going, and notes the failure, which
+// is not a croak, for callers that need to tell.
+func (rs *Reposurgeon) Default(line string) bool {
+	control.baton.WriteString("*** Unknown syntax: " + line + "\n")
+	rs.unknown = true
+	return false
+}
+
 // helpOutput handles Go multiline literals that may have a leading \n
 // to make them more readable in source. It just clips off any leading \n.
 func (rs *Reposurgeon) helpOutput(help string) {
@@ -11034,6 +11218,46 @@ func (rs *Reposurgeon) evalNeighborhood(state selEvalState,
 	return value
 }
 
+// parseFuncall adds @hist(), whose argument is a path rather than a
+// selection.
+func (rs *Reposurgeon) parseFuncall() selEvaluator {
+	rs.eatWS()
+	if !strings.HasPrefix(rs.line, "@hist(") {
+		return rs.SelectionParser.parseFuncall()
+	}
+	// Find the matching parenthesis; a path may contain balanced ones.
+	closer, depth := -1, 0
+	for i := len("@hist("); i < len(rs.line) && closer == -1; i++ {
+		switch rs.line[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				closer = i
+			}
+			depth--
+		}
+	}
+	if closer == -1 {
+		panic(throw("command", "missing close parenthesis for function call"))
+	}
+	path := strings.TrimSpace(rs.line[len("@hist("):closer])
+	rs.line = rs.line[closer+1:]
+	if path == "" {
+		panic(throw("command", "@hist requires a path"))
+	}
+	return func(x selEvalState, s *fastOrderedIntSet) *fastOrderedIntSet {
+		hits, _ := rs.chosen().pathHistory(path)
+		result := newFastOrderedIntSet()
+		for _, i := range hits {
+			if s.Contains(i) {
+				result.Add(i)
+			}
+		}
+		return result
+	}
+}
+
 func (rs *Reposurgeon) parseTerm() selEvaluator {
 	term := rs.SelectionParser.parseTerm()
 	if term == nil {
@@ -12096,14 +12320,41 @@ func (rs *Reposurgeon) DoNames(line string) bool {
 
 func (rs *Reposurgeon) HelpHistory() {
 	rs.helpOutput(`
-Dump your command list from this session so far.
+With no argument, dump your command list from this session so far.
+
+With a path argument, list the commits that touched that file under
+its present name or any earlier one, following renames and copies
+made with R and C fileops and files created with the same blob as an
+existing path, which is how Subversion copies and git renames appear.
+Empty files are not traced that way, and where several paths had the
+blob those with the file's basename are preferred. Commits on all
+branches are included. Each is listed with its event
+number, mark, date, the fileops that touched the file, and the first
+line of its comment. A selection set restricts the listing; the
+default is all commits. Supports > redirection.
+
+The selection function @hist(path) selects the same commits.
 `)
 }
 
-func (rs *Reposurgeon) DoHistory(_line string) bool {
-	for _, line := range rs.history {
-		control.baton.printLogString(line)
+func (rs *Reposurgeon) DoHistory(line string) bool {
+	if strings.TrimSpace(line) == "" {
+		for _, line := range rs.history {
+			control.baton.printLogString(line)
+		}
+		return false
+	}
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if len(parse.Tokens()) != 1 {
+		croak("history takes a single path.")
+		return false
 	}
+	rs.chosen().writePathHistory(parse.stdout, parse.Tokens()[0], rs.selection)
 	return false
 }
 
@@ -13189,11 +13440,22 @@ constructed with command-line arguments).
 
 The --format option can be used to read in binary repository dump files.
 For a list of supported types, invoke the 'prefer' command.
+
+With the --dry-run option the repository is read, described, and
+then discarded: the report gives
+its event counts and the branches and tags it would have, which shows
+the effect of any branchmap set up beforehand. The chosen repository
+does not change. The dryrun flag does not affect read.
 `)
 }
 
 // DoRead reads in a repository for surgery.
 func (rs *Reposurgeon) DoRead(line string) bool {
+	// The dryrun flag does not apply; a read it threw away would
+	// leave nothing to try other commands on.
+	if dryRunRE.MatchString(line) && rs.dryRun(line, rs.DoRead, false) {
+		return false
+	}
 	if rs.selection != nil {
 		croak("read does not take a selection set")
 		return false
@@ -14417,11 +14679,19 @@ outside the selection range, depending on policy flags.
 The default selection set for this command is empty.  Blobs cannot be
 directly affected by this command; they move or are deleted only when
 removal of fileops associated with commits requires this.
+
+With the --dry-run option, or while the dryrun flag is set, the
+squash is carried out on a scratch copy of the repository and the
+events, fileops, refs, and blobs it would affect are reported; the
+repository itself is left unchanged.
 `)
 }
 
 // DoSquash squashes events in the specified selection set.
 func (rs *Reposurgeon) DoSquash(line string) bool {
+	if rs.dryRun(line, rs.DoSquash, true) {
+		return false
+	}
 	if rs.chosen() == nil {
 		croak("no repo is loaded")
 		return false
@@ -14445,10 +14715,18 @@ are removed only when removal of fileops associated with commits requires this.
 When a commit is deleted, what becomes of tags and fileops attached to
 it is controlled by policy flags.  A delete is equivalent to a
 squash with the --delete flag.
+
+With the --dry-run option, or while the dryrun flag is set, the
+delete is carried out on a scratch copy of the repository and the
+events, fileops, refs, and blobs it would affect are reported; the
+repository itself is left unchanged.
 `)
 }
 
 func (rs *Reposurgeon) DoDelete(line string) bool {
+	if rs.dryRun(line, rs.DoDelete, true) {
+		return false
+	}
 	if rs.chosen() == nil {
 		croak("no repo is loaded")
 		return false
@@ -14483,11 +14761,18 @@ matches and the commit separation is small enough.  This option handles
 a convention used by Free Software Foundation projects.
 
 With  the --debug option, show messages about mismatches.
+
+The --dry-run option, and the dryrun flag, report which commits would
+be coalesced and how their fileops and refs would move without making
+the change.
 `)
 }
 
 // DoCoalesce coalesces events in the specified selection set.
 func (rs *Reposurgeon) DoCoalesce(line string) bool {
+	if rs.dryRun(line, rs.DoCoalesce, true) {
+		return false
+	}
 	repo := rs.chosen()
 	if repo == nil {
 		croak("no repo is loaded")
@@ -15169,11 +15454,19 @@ The removal set is not discarded. It is assembled into a new
 repository named after the old one with the suffix "-expunges" added.
 Thus, this command can be used to carve a repository into sections by
 file path matches.
+
+With the --dry-run option, or while the dryrun flag is set, nothing is
+expunged. Instead the events that would be deleted or altered, the
+fileops removed, the refs moved, and the "-expunges" repository that
+would be created are reported.
 `)
 }
 
 // DoExpunge expunges files from the chosen repository.
 func (rs *Reposurgeon) DoExpunge(line string) bool {
+	if rs.dryRun(line, rs.DoExpunge, true) {
+		return false
+	}
 	if rs.chosen() == nil {
 		croak("no repo has been chosen.")
 		return false
@@ -15195,6 +15488,92 @@ func (rs *Reposurgeon) DoExpunge(line string) bool {
 	return false
 }
 
+func (rs *Reposurgeon) HelpCarve() {
+	rs.helpOutput(`
+Carve a subdirectory of the chosen repository out into a repository of
+its own, with its history.
+
+    carve [--tagify] PATH [NAME]
+
+The new repository is added to the list under NAME, which defaults to
+the chosen repository's name followed by a hyphen and the last
+component of PATH; the chosen repository is left as it was. In the
+new one, every fileop outside PATH is dropped and PATH is stripped
+from the rest, so the subdirectory's content becomes the top level.
+A file renamed or copied into the subdirectory from elsewhere appears
+as added.
+
+Commits that then change nothing are dropped, their children being
+reparented. With --tagify each is replaced by a tag of the form
+emptycommit-<ident> on its parent instead. Merge links to a commit
+that is already an ancestor of another parent are removed, so merges
+whose other side never touched the subdirectory become ordinary
+commits, and are dropped if empty. Tags and branches pointing at a
+dropped commit move back to its nearest surviving ancestor. Legacy
+IDs are kept.
+
+With the --dry-run option, or while the dryrun flag is set, the
+repository that would be created is reported and then discarded.
+`)
+}
+
+// DoCarve makes a repository from the history of a subdirectory.
+func (rs *Reposurgeon) DoCarve(line string) bool {
+	if rs.dryRun(line, rs.DoCarve, false) {
+		return false
+	}
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	if rs.selection != nil {
+		croak("carve does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	args := parse.Tokens()
+	if len(args) < 1 || len(args) > 2 {
+		croak("carve requires a path and optionally a repository name.")
+		return false
+	}
+	prefix := strings.Trim(args[0], "/")
+	if prefix == "" {
+		croak("carve requires a subdirectory path.")
+		return false
+	}
+	name := repo.name + "-" + filepath.Base(prefix)
+	if len(args) == 2 {
+		name = args[1]
+	}
+	if rs.reponames().Contains(name) {
+		croak("there is already a repo named %s.", name)
+		return false
+	}
+	touched := false
+	for _, commit := range repo.commits(nil) {
+		for _, path := range commit.paths(nil) {
+			if strings.HasPrefix(path, prefix+"/") {
+				touched = true
+				break
+			}
+		}
+		if touched {
+			break
+		}
+	}
+	if !touched {
+		croak("no commit touches %s.", prefix)
+		return false
+	}
+	carved, origins := repo.duplicate(name, repo.basedir)
+	dropped := carved.carve(prefix, origins, parse.options.Contains("--tagify"))
+	rs.repolist = append(rs.repolist, carved)
+	respond("%s has %d commits; %d dropped.", name, len(carved.commits(nil)), dropped)
+	return false
+}
+
 func (rs *Reposurgeon) HelpSplit() {
 	rs.helpOutput(`
 Split a specified commit in two, the opposite of squash.
@@ -15297,6 +15676,25 @@ type.
 With the option --prune, at each join generate D ops for every
 file that doesn't have a modify operation in the root commit of the
 branch being grafted on.
+
+With the option --subdirs, the parts are instead assembled into a
+single tree in the way of a monorepo. Each repository's files are
+moved under a subdirectory named after it, and its branches, tags,
+and resets into a namespace of the same name, so that refs/heads/topic
+in the repository "lib" becomes refs/heads/lib/topic. The commits of
+the parts are interleaved by date, and those on the mainline branch
+of each part (master, unless --mainline=NAME is given) are chained
+into one shared mainline, each seeing the latest state of every
+subdirectory. A deleteall in a part becomes a deletion of its
+subdirectory.
+
+By default each part joins the mainline with its first commit. With
+--join=REPO:REF, REF being a mark, tag, or other reference to a
+mainline commit of the repository REPO, that part's mainline up to
+and including the commit stays on its own branch (refs/heads/REPO/
+followed by the mainline name) and a merge commit bringing it into
+the shared mainline is added just after it. --join may be given once
+for each part.
 `)
 }
 
@@ -15318,6 +15716,29 @@ func (rs *Reposurgeon) DoUnite(line string) bool {
 		croak("unite requires two or more repo name arguments")
 		return false
 	}
+	if parse.options.Contains("--subdirs") {
+		mainline := "master"
+		joins := make(map[string]string)
+		for _, option := range parse.options {
+			if strings.HasPrefix(option, "--mainline=") {
+				mainline = strings.TrimPrefix(option, "--mainline=")
+			} else if strings.HasPrefix(option, "--join=") {
+				spec := strings.TrimPrefix(option, "--join=")
+				colon := strings.Index(spec, ":")
+				if colon <= 0 || colon == len(spec)-1 {
+					croak("--join requires REPO:REF, not %s", spec)
+					return false
+				}
+				joins[spec[:colon]] = spec[colon+1:]
+			}
+		}
+		if err := rs.uniteSubdirs(factors, mainline, joins); err != nil {
+			croak(err.Error())
+		} else if control.isInteractive() && !control.flagOptions["quiet"] {
+			rs.DoChoose("")
+		}
+		return false
+	}
 	rs.unite(factors, parse.options.toStringSet())
 	if control.isInteractive() && !control.flagOptions["quiet"] {
 		rs.DoChoose("")
@@ -15490,6 +15911,137 @@ func (rs *Reposurgeon) DoDebranch(line string) bool {
 	return false
 }
 
+func (rs *Reposurgeon) HelpBranchifydir() {
+	rs.helpOutput(`
+Turn a subdirectory back into a branch; this is the inverse of debranch.
+
+    branchifydir [--remove] PATH [BRANCH [SOURCE]]
+
+The history of PATH as seen from the tip of the SOURCE branch, which
+defaults to 'master', is copied onto a new branch BRANCH, which
+defaults to the last component of PATH and must not already exist.
+On the new branch PATH is stripped, so the subdirectory's content
+becomes the top level, and the branch has a root commit of its own.
+Each copied commit follows its original in the event sequence and
+keeps its comment, committer and authors. Copies that change nothing
+are dropped, and merges whose other side never touched the
+subdirectory become ordinary commits, as with carve. As with
+debranch, any trailing segment of a branch name is accepted as a
+synonym for it; a segment that ends more than one branch name is
+refused as ambiguous.
+
+With --remove, PATH is also removed from the history of SOURCE.
+A file renamed or copied out of the subdirectory appears there as
+added. Commits left with no fileops are deleted, any tags and branches
+pointing at them moving back to the parent. Commits SOURCE shares with
+other branches are changed too.
+
+With the --dry-run option, or while the dryrun flag is set, the new
+branch is reported and nothing is changed.
+
+The command is branchifydir rather than branchify-dir because command
+names cannot contain a hyphen.
+`)
+}
+
+// DoBranchifydir turns a subdirectory into a branch.
+func (rs *Reposurgeon) DoBranchifydir(line string) bool {
+	if rs.dryRun(line, rs.DoBranchifydir, true) {
+		return false
+	}
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	if rs.selection != nil {
+		croak("branchifydir does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	args := parse.Tokens()
+	if len(args) < 1 || len(args) > 3 {
+		croak("branchifydir requires a path and optionally branch names.")
+		return false
+	}
+	prefix := strings.Trim(args[0], "/")
+	if prefix == "" {
+		croak("branchifydir requires a subdirectory path.")
+		return false
+	}
+	branch := filepath.Base(prefix)
+	if len(args) >= 2 {
+		branch = args[1]
+	}
+	if !strings.HasPrefix(branch, "refs/") {
+		branch = "refs/heads/" + branch
+	}
+	source := "refs/heads/master"
+	if len(args) == 3 {
+		source = args[2]
+	}
+	branches := repo.branchmap()
+	if branches[branch] != "" {
+		croak("there is already a branch named %s.", branch)
+		return false
+	}
+	if branches[source] == "" {
+		var matches []string
+		for candidate := range branches {
+			if strings.HasSuffix(candidate, "/"+source) {
+				matches = append(matches, candidate)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			croak("no branch matches source %s", source)
+			return false
+		case 1:
+			source = matches[0]
+		default:
+			sort.Strings(matches)
+			croak("source %s is ambiguous: %s", source, strings.Join(matches, ", "))
+			return false
+		}
+	}
+	tip, ok := repo.markToEvent(branches[source]).(*Commit)
+	if !ok {
+		croak("branch %s does not point at a commit", source)
+		return false
+	}
+	ancestors := tip.ancestorSet()
+	var commits []*Commit
+	touched := false
+	for _, commit := range repo.commits(nil) {
+		if !ancestors[commit] {
+			continue
+		}
+		commits = append(commits, commit)
+		for _, path := range commit.paths(nil) {
+			touched = touched || strings.HasPrefix(path, prefix+"/")
+		}
+	}
+	if !touched {
+		croak("no commit on %s touches %s.", source, prefix)
+		return false
+	}
+	made := repo.branchifyDir(commits, prefix, branch)
+	removed := 0
+	if parse.options.Contains("--remove") {
+		removed = repo.removeDir(commits, prefix)
+	}
+	if !control.flagOptions["defergc"] {
+		repo.gcBlobs()
+	}
+	if parse.options.Contains("--remove") {
+		respond("%d commits on %s, %d removed from %s.", len(made), branch, removed, source)
+	} else {
+		respond("%d commits on %s.", len(made), branch)
+	}
+	return false
+}
+
 func (rs *Reposurgeon) HelpPath() {
 	rs.helpOutput(`
 Rename a path in every fileop of every selected commit.  The
@@ -15500,6 +16052,9 @@ back-reference syntax.
 Ordinarily, if the target path already exists in the fileops, or is visible
 in the ancestry of the commit, this command throws an error.  With the
 --force option, these checks are skipped.
+
+With the --dry-run option, or while the dryrun flag is set, the
+fileops that would be renamed are listed and nothing is changed.
 `)
 }
 
@@ -15524,6 +16079,9 @@ func (pa pathAction) String() string {
 
 // DoPath rename paths in the history.
 func (rs *Reposurgeon) DoPath(line string) bool {
+	if rs.dryRun(line, rs.DoPath, true) {
+		return false
+	}
 	if rs.chosen() == nil {
 		croak("no repo has been chosen.")
 		return false
@@ -15858,41 +16416,677 @@ func (rs *Reposurgeon) DoUnmerge(_line string) bool {
 
 }
 
-func (rs *Reposurgeon) HelpReparent() {
-	rs.helpOutput(`
-Changes the parent list of a commit.  Takes a selection set, zero or
-more option arguments, and an optional policy argument.
-
-Selection set:
+//
+// Merge inference
+//
 
-    The selection set must resolve to one or more commits.  The
-    selected commit with the highest event number (not necessarily the
-    last one selected) is the commit to modify.  The remainder of the
-    selected commits, if any, become its parents:  the selected commit
-    with the lowest event number (which is not necessarily the first
-    one selected) becomes the first parent, the selected commit with
-    second lowest event number becomes the second parent, and so on.
-    All original parent links are removed.  Examples:
+// mergeCandidate describes a commit whose tree looks like the result
+// of an unrecorded merge from the tip of another branch.
+type mergeCandidate struct {
+	commit  *Commit
+	source  *Commit
+	carried int // pending source changes the commit brought over
+	pending int // source changes since the merge base not yet in the first parent
+}
 
-        # this makes 17 the parent of 33
-        17,33 reparent
+// confidence is the percentage of pending changes carried over by the commit.
+func (mc mergeCandidate) confidence() int {
+	if mc.pending == 0 {
+		return 0
+	}
+	return mc.carried * 100 / mc.pending
+}
 
-        # this also makes 17 the parent of 33
-        33,17 reparent
+// manifestKey returns a content key for a manifest entry, so that
+// blobs with identical content under different marks compare equal.
+func (repo *Repository) manifestKey(op *FileOp, shas map[string]string) string {
+	if op.ref == "inline" {
+		return fmt.Sprintf("%s inline %x", op.mode, sha1.Sum(op.inline))
+	}
+	sha, ok := shas[op.ref]
+	if !ok {
+		sha = op.ref
+		if blob, ok := repo.markToEvent(op.ref).(*Blob); ok {
+			sha = blob.sha()
+		}
+		shas[op.ref] = sha
+	}
+	return op.mode + " " + sha
+}
 
-        # this makes 33 a root (parentless) commit
-        33 reparent
+// contentAt returns the content key of a path in a commit's tree,
+// or the empty string if the path is absent there or commit is nil.
+func (repo *Repository) contentAt(commit *Commit, path string, shas map[string]string) string {
+	if commit == nil {
+		return ""
+	}
+	if op, ok := commit.manifest().get(path); ok {
+		return repo.manifestKey(op.(*FileOp), shas)
+	}
+	return ""
+}
 
-        # this makes 33 an octopus merge commit.  its first parent
-        # is commit 15, second parent is 17, and third parent is 22
-        22,33,15,17 reparent
+// ancestorSet returns a commit and everything reachable from it through any parent link.
+func (commit *Commit) ancestorSet() map[*Commit]bool {
+	seen := map[*Commit]bool{commit: true}
+	stack := []*Commit{commit}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, parent := range current.parents() {
+			if p, ok := parent.(*Commit); ok && !seen[p] {
+				seen[p] = true
+				stack = append(stack, p)
+			}
+		}
+	}
+	return seen
+}
 
-Options:
+// mergeBase returns the latest common ancestor of two commits, given
+// their ancestor sets, or nil.
+func (repo *Repository) mergeBase(aset map[*Commit]bool, bset map[*Commit]bool) *Commit {
+	var base *Commit
+	baseIndex := -1
+	for commit := range bset {
+		if aset[commit] {
+			if ei := repo.markToIndex(commit.mark); ei > baseIndex {
+				base, baseIndex = commit, ei
+			}
+		}
+	}
+	return base
+}
 
-    --use-order
+// touchedPaths returns the paths a commit's fileops may have changed
+// relative to the given parent; a deleteall makes that every path in
+// either tree.
+func (commit *Commit) touchedPaths(parent *Commit) orderedStringSet {
+	for _, op := range commit.operations() {
+		if op.op == deleteall {
+			touched := newOrderedStringSet(commit.manifest().pathnames()...)
+			for _, path := range parent.manifest().pathnames() {
+				touched.Add(path)
+			}
+			return touched
+		}
+	}
+	return commit.paths(nil)
+}
 
-        Use the selection order to determine which selected commit is
-        the commit to modify and which are the parents (and if there
+// inferMerges looks for selected single-parent commits that bring the
+// paths they touch to exactly the content those paths have at the tip
+// of some other branch, which is what a hand-made merge looks like in
+// a history without merge metadata.
+func (repo *Repository) inferMerges(selection orderedIntSet) []mergeCandidate {
+	if selection == nil {
+		selection = repo.all()
+	}
+	selected := make(map[int]bool)
+	for _, ei := range selection {
+		selected[ei] = true
+	}
+	shas := make(map[string]string)
+	tips := make(map[string]*Commit)
+	// Ancestor sets of branch tips, kept while they remain tips.
+	ancestry := make(map[*Commit]map[*Commit]bool)
+	branches := make([]string, 0)
+	candidates := make([]mergeCandidate, 0)
+	for ei, event := range repo.events {
+		commit, ok := event.(*Commit)
+		if !ok {
+			continue
+		}
+		parents := commit.parents()
+		if selected[ei] && len(parents) == 1 {
+			if parent, ok := parents[0].(*Commit); ok {
+				if best, found := repo.bestMergeSource(commit, parent, tips, branches, shas, ancestry); found {
+					candidates = append(candidates, best)
+				}
+			}
+		}
+		if old, ok := tips[commit.Branch]; !ok {
+			branches = append(branches, commit.Branch)
+		} else {
+			delete(ancestry, old)
+		}
+		tips[commit.Branch] = commit
+		control.baton.twirl()
+	}
+	return candidates
+}
+
+// bestMergeSource finds the branch tip that a commit most plausibly
+// merged. Ancestor sets are costly on long histories, so the parent's
+// is made once and the tips' are looked up in ancestry or added to it.
+func (repo *Repository) bestMergeSource(commit *Commit, parent *Commit,
+	tips map[string]*Commit, branches []string, shas map[string]string,
+	ancestry map[*Commit]map[*Commit]bool) (mergeCandidate, bool) {
+	touched := commit.touchedPaths(parent)
+	var before map[*Commit]bool // The commit's ancestors, less itself
+	var best mergeCandidate
+	found := false
+	for _, branch := range branches {
+		source := tips[branch]
+		if branch == commit.Branch || source == parent {
+			continue
+		}
+		match := len(touched) > 0
+		for _, path := range touched {
+			if repo.contentAt(commit, path, shas) != repo.contentAt(source, path, shas) {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		if before == nil {
+			before = parent.ancestorSet()
+		}
+		if before[source] {
+			continue
+		}
+		sourceAncestors, ok := ancestry[source]
+		if !ok {
+			sourceAncestors = source.ancestorSet()
+			ancestry[source] = sourceAncestors
+		}
+		base := repo.mergeBase(sourceAncestors, before)
+		candidate := mergeCandidate{commit: commit, source: source}
+		paths := newOrderedStringSet(source.manifest().pathnames()...)
+		if base != nil {
+			for _, path := range base.manifest().pathnames() {
+				paths.Add(path)
+			}
+		}
+		for _, path := range paths {
+			want := repo.contentAt(source, path, shas)
+			if repo.contentAt(base, path, shas) == want || repo.contentAt(parent, path, shas) == want {
+				continue
+			}
+			candidate.pending++
+			if repo.contentAt(commit, path, shas) == want {
+				candidate.carried++
+			}
+		}
+		if candidate.pending == 0 {
+			continue
+		}
+		if !found || candidate.confidence() >= best.confidence() {
+			best = candidate
+			found = true
+		}
+	}
+	return best, found
+}
+
+func (rs *Reposurgeon) HelpInfermerges() {
+	rs.helpOutput(`
+Look for commits that appear to be unrecorded merges, and optionally
+add the missing merge links. This is mainly useful on lifts from
+Subversion repositories older than 1.5, where merges were done by hand
+and left no svn:mergeinfo or svnmerge-integrated property behind.
+
+A commit in the selection set (default: all commits) with a single
+parent is a candidate when every path it touches ends up with exactly
+the content that path has at the tip of some other branch at that
+point in the history, and that tip is not already an ancestor of it.
+Content is compared by blob hash, so identical files under different
+blob marks match.
+
+Each candidate is reported as one line giving the commit, the branch
+tip it appears to merge, and a confidence figure. The paths changed
+on the other branch since the latest common ancestor, and not already
+present on the commit's first parent, are the pending changes; the
+confidence is the percentage of them that the commit brought over.
+100% means everything the other branch had to offer arrived in this
+commit; low figures usually mean a cherry-pick of a few changes rather
+than a merge. Where several branches qualify, the one with the highest
+confidence is reported.
+
+With --apply, each candidate whose confidence is at least the
+threshold gets the branch tip added as a merge parent. The threshold
+defaults to 100 and can be set with --threshold=N. Trees are not
+changed by adding the links.
+
+Supports > redirection.
+`)
+}
+
+// DoInfermerges reports, and optionally creates, merge links implied by tree content.
+func (rs *Reposurgeon) DoInfermerges(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	threshold := 100
+	if val, present := parse.OptVal("--threshold"); present {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 || n > 100 {
+			croak("threshold must be a percentage between 0 and 100")
+			return false
+		}
+		threshold = n
+	}
+	apply := parse.options.Contains("--apply")
+	applied := 0
+	for _, candidate := range repo.inferMerges(rs.selection) {
+		fmt.Fprintf(parse.stdout, "%s (%s) <- %s (%s): %d/%d paths, confidence %d%%\n",
+			candidate.commit.idMe(), candidate.commit.Branch,
+			candidate.source.idMe(), candidate.source.Branch,
+			candidate.carried, candidate.pending, candidate.confidence())
+		if apply && candidate.confidence() >= threshold {
+			candidate.commit.addParentCommit(candidate.source)
+			applied++
+		}
+	}
+	if apply {
+		respond("%d merge links added.", applied)
+	}
+	return false
+}
+
+func (rs *Reposurgeon) HelpRenames() {
+	rs.helpOutput(`
+Find file moves recorded as a deletion and an addition, and rewrite
+them as renames. Streams lifted from CVS, and those from some
+exporters, show a move that way, and tools following a file's history
+then lose it at the move.
+
+In each commit in the selection set (default: all commits), a deleted
+path and an added path whose contents are identical are paired and
+replaced by an R fileop. With --similarity=N, a pair whose contents
+are at least N percent alike by line is also made, and the addition
+is kept after the rename to carry the changed content. N defaults to
+100, identical content only.
+
+With --copies, an added path whose content is identical to a file of
+the parent that the commit leaves in place, or at least N percent
+like one the commit modifies, becomes a C fileop from it.
+
+Only paths touched by a single fileop of the commit are paired, and
+commits with a deleteall are skipped. Each inference is reported as a
+line giving the commit, R or C, the source and target, and how similar
+the contents were. Supports > redirection.
+
+With the --dry-run option, or while the dryrun flag is set, the
+inferences are reported and the fileop changes they would make are
+shown, but nothing is changed.
+`)
+}
+
+// DoRenames rewrites deletion/addition pairs as renames and copies.
+func (rs *Reposurgeon) DoRenames(line string) bool {
+	if rs.dryRun(line, rs.DoRenames, true) {
+		return false
+	}
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	threshold := 100
+	if val, present := parse.OptVal("--similarity"); present {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 || n > 100 {
+			croak("similarity must be a percentage between 1 and 100")
+			return false
+		}
+		threshold = n
+	}
+	renames, copies := repo.rewriteRenames(parse.stdout, rs.selection, threshold, parse.options.Contains("--copies"))
+	respond("%d renames and %d copies inferred.", renames, copies)
+	return false
+}
+
+//
+// Cherry-pick detection
+//
+
+// patchID computes a patch-equivalence ID for a commit from the line
+// changes it makes against its first parent.  Line numbers and context
+// are left out, so the same change applied to branches that differ
+// elsewhere in the touched files gets the same ID. Returns the empty
+// string for a commit that changes no content.
+func (commit *Commit) patchID(parent *Commit) string {
+	touched := commit.touchedPaths(parent)
+	sort.Strings(touched)
+	h := sha1.New()
+	changed := false
+	for _, path := range touched {
+		oldop, oldok := parent.manifest().get(path)
+		newop, newok := commit.manifest().get(path)
+		oldmode, newmode := "", ""
+		if oldok {
+			oldmode = oldop.(*FileOp).mode
+		}
+		if newok {
+			newmode = newop.(*FileOp).mode
+		}
+		oldtext, _ := parent.blobByName(path)
+		newtext, _ := commit.blobByName(path)
+		if oldmode == newmode && bytes.Equal(oldtext, newtext) {
+			continue
+		}
+		changed = true
+		fmt.Fprintf(h, "%s %s %s\n", path, oldmode, newmode)
+		a := difflib.SplitLines(string(oldtext))
+		b := difflib.SplitLines(string(newtext))
+		for _, opcode := range difflib.NewMatcher(a, b).GetOpCodes() {
+			if opcode.Tag == 'e' {
+				continue
+			}
+			for _, line := range a[opcode.I1:opcode.I2] {
+				fmt.Fprintf(h, "-%s", line)
+			}
+			for _, line := range b[opcode.J1:opcode.J2] {
+				fmt.Fprintf(h, "+%s", line)
+			}
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// cherryPick pairs a commit with the earlier commit on another branch
+// that made the same change.
+type cherryPick struct {
+	commit   *Commit
+	original *Commit
+}
+
+// cherrypickTrailer is the comment line recording where a commit was picked from.
+func cherrypickTrailer(original *Commit) string {
+	return "(cherry picked from " + original.actionStamp() + ")"
+}
+
+// findCherryPicks groups selected single-parent commits by patch ID
+// and reports each commit whose change was already made, earlier, on
+// a different branch.
+func (repo *Repository) findCherryPicks(selection orderedIntSet) []cherryPick {
+	if selection == nil {
+		selection = repo.all()
+	}
+	originals := make(map[string]*Commit)
+	picks := make([]cherryPick, 0)
+	for _, commit := range repo.commits(selection) {
+		parents := commit.parents()
+		if len(parents) != 1 {
+			continue
+		}
+		parent, ok := parents[0].(*Commit)
+		if !ok {
+			continue
+		}
+		id := commit.patchID(parent)
+		if id == "" {
+			continue
+		}
+		if original, ok := originals[id]; !ok {
+			originals[id] = commit
+		} else if original.Branch != commit.Branch {
+			picks = append(picks, cherryPick{commit, original})
+		}
+		control.baton.twirl()
+	}
+	return picks
+}
+
+func (rs *Reposurgeon) HelpCherrypicks() {
+	rs.helpOutput(`
+Find commits that repeat a change first made on another branch, as
+happens when fixes are ported by hand between release branches in
+Subversion or CVS. Takes a selection set (default: all commits) and an
+optional modifier, 'list' or 'annotate'.
+
+Each single-parent commit gets a patch ID computed from the lines it
+adds and removes, per path, against its first parent; line numbers
+and surrounding context do not contribute, so the same fix applied to
+branches that have drifted apart still matches. Merges, root commits
+and commits that change no content are skipped. When two commits on
+different branches share an ID, the earlier one is taken to be the
+original.
+
+With 'list' (the default), report each cherry-pick and its original.
+With 'annotate', append a "(cherry picked from ...)" line naming the
+original by action stamp to each cherry-pick's comment, unless it is
+already there.
+
+The 'list' form supports > redirection.
+`)
+}
+
+// DoCherrypicks reports or annotates commits whose changes duplicate another branch's.
+func (rs *Reposurgeon) DoCherrypicks(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	mode := strings.TrimSpace(parse.line)
+	if mode == "" {
+		mode = "list"
+	}
+	if mode != "list" && mode != "annotate" {
+		croak("unknown cherrypicks modifier %q", mode)
+		return false
+	}
+	annotated := 0
+	for _, pick := range repo.findCherryPicks(rs.selection) {
+		if mode == "list" {
+			fmt.Fprintf(parse.stdout, "%s (%s) picks %s (%s)\n",
+				pick.commit.idMe(), pick.commit.Branch,
+				pick.original.idMe(), pick.original.Branch)
+			continue
+		}
+		trailer := cherrypickTrailer(pick.original)
+		if !strings.Contains(pick.commit.Comment, trailer) {
+			pick.commit.Comment = appendTrailers(pick.commit.Comment, trailer)
+			annotated++
+		}
+	}
+	if mode == "annotate" {
+		respond("%d cherry-picks annotated.", annotated)
+	}
+	return false
+}
+
+func (rs *Reposurgeon) HelpPick() {
+	rs.helpOutput(`
+Copy the selected commits onto another commit, as git cherry-pick does.
+
+    {SELECTION} pick [--force] [--branch=NAME] TARGET
+
+TARGET is a mark, a branch or tag name, a legacy ID, or any other name
+that identifies a single commit. The selected commits are copied in
+event order, the first copy getting TARGET as its parent and each of
+the others the copy before it; the originals are not changed. Merges
+cannot be picked.
+
+Each copy makes the same change its original made to its parent's
+tree: the paths whose content or mode differ between the original
+and its parent are given the original's content in the copy, or
+deleted, and the fileops are recomputed that way. Renames and copies
+therefore come out as modifications and deletions. Comment, committer
+and authors are kept, and a line naming the original by action stamp
+is appended to the comment as for 'cherrypicks annotate'. Legacy IDs
+must stay unique and are not copied.
+
+A path that a picked commit changes and that the tree it is being
+copied onto already has in some third state is a conflict. Conflicts
+are listed, and nothing is changed unless --force is given, in which
+case the picked commit's version of each conflicting path wins. The
+list of conflicts supports > redirection.
+
+The copies go on TARGET's branch, or with --branch on the branch
+NAME; they follow both TARGET and the last selected commit in the
+event sequence.
+
+With the --dry-run option, or while the dryrun flag is set, what
+would be added is reported and nothing is changed.
+`)
+}
+
+// DoPick copies commits onto another commit.
+func (rs *Reposurgeon) DoPick(line string) bool {
+	if rs.dryRun(line, rs.DoPick, true) {
+		return false
+	}
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	args := parse.Tokens()
+	if len(args) != 1 {
+		croak("pick requires a single target commit.")
+		return false
+	}
+	commits, onto, err := repo.replayable(rs.selection, args[0])
+	if err != nil {
+		croak("%v", err)
+		return false
+	}
+	branch := onto.Branch
+	if name, present := parse.OptVal("--branch"); present {
+		if name == "" {
+			croak("--branch requires a branch name.")
+			return false
+		}
+		branch = name
+		if !strings.HasPrefix(branch, "refs/") {
+			branch = "refs/heads/" + branch
+		}
+	}
+	fileops, conflicts := replayOps(commits, onto, parse.options.Contains("--force"))
+	for _, conflict := range conflicts {
+		fmt.Fprintf(parse.stdout, "conflict at %s\n", conflict)
+	}
+	if len(conflicts) > 0 && !parse.options.Contains("--force") {
+		croak("%d conflicts, nothing picked.", len(conflicts))
+		return false
+	}
+	copies := repo.pick(commits, onto, branch, fileops)
+	respond("%d commits picked onto %s.", len(copies), onto.idMe())
+	return false
+}
+
+func (rs *Reposurgeon) HelpRebase() {
+	rs.helpOutput(`
+Move the selected commits onto another commit, as git rebase does.
+
+    {SELECTION} rebase [--force] TARGET
+
+TARGET names a single commit as for 'pick'. The selected commits are
+moved, in event order, so that the first has TARGET as its parent and
+each of the others the one before it. Each keeps its mark, branch,
+legacy ID, comment, committer and authors, and its fileops are
+recomputed to make the same change to its new parent's tree that it
+made to its old one's, as for 'pick'. Merges cannot be rebased, and
+TARGET cannot be a descendant of a selected commit.
+
+A child of a moved commit that was not itself selected keeps its
+parent link and its tree; its fileops are rewritten to produce the
+same tree from the moved commit. Events are reordered as needed so
+that every commit follows its parents.
+
+Conflicts are found and listed as for 'pick', and nothing is changed
+unless --force is given. The list supports > redirection.
+
+With the --dry-run option, or while the dryrun flag is set, what
+would change is reported and nothing is changed.
+`)
+}
+
+// DoRebase moves commits onto another commit.
+func (rs *Reposurgeon) DoRebase(line string) bool {
+	if rs.dryRun(line, rs.DoRebase, true) {
+		return false
+	}
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	args := parse.Tokens()
+	if len(args) != 1 {
+		croak("rebase requires a single target commit.")
+		return false
+	}
+	commits, onto, err := repo.replayable(rs.selection, args[0])
+	if err != nil {
+		croak("%v", err)
+		return false
+	}
+	ancestors := onto.ancestorSet()
+	for _, commit := range commits {
+		if ancestors[commit] {
+			croak("%s is descended from %s, which is selected.", onto.idMe(), commit.idMe())
+			return false
+		}
+	}
+	fileops, conflicts := replayOps(commits, onto, parse.options.Contains("--force"))
+	for _, conflict := range conflicts {
+		fmt.Fprintf(parse.stdout, "conflict at %s\n", conflict)
+	}
+	if len(conflicts) > 0 && !parse.options.Contains("--force") {
+		croak("%d conflicts, nothing rebased.", len(conflicts))
+		return false
+	}
+	repo.rebase(commits, onto, fileops)
+	respond("%d commits rebased onto %s.", len(commits), onto.idMe())
+	return false
+}
+
+func (rs *Reposurgeon) HelpReparent() {
+	rs.helpOutput(`
+Changes the parent list of a commit.  Takes a selection set, zero or
+more option arguments, and an optional policy argument.
+
+Selection set:
+
+    The selection set must resolve to one or more commits.  The
+    selected commit with the highest event number (not necessarily the
+    last one selected) is the commit to modify.  The remainder of the
+    selected commits, if any, become its parents:  the selected commit
+    with the lowest event number (which is not necessarily the first
+    one selected) becomes the first parent, the selected commit with
+    second lowest event number becomes the second parent, and so on.
+    All original parent links are removed.  Examples:
+
+        # this makes 17 the parent of 33
+        17,33 reparent
+
+        # this also makes 17 the parent of 33
+        33,17 reparent
+
+        # this makes 33 a root (parentless) commit
+        33 reparent
+
+        # this makes 33 an octopus merge commit.  its first parent
+        # is commit 15, second parent is 17, and third parent is 22
+        22,33,15,17 reparent
+
+Options:
+
+    --use-order
+
+        Use the selection order to determine which selected commit is
+        the commit to modify and which are the parents (and if there
         are multiple parents, their order).  The last selected commit
         (not necessarily the one with the highest event number) is the
         commit to modify, the first selected commit (not necessarily
@@ -17026,6 +18220,12 @@ Apply or list legacy-reference information. Does not take a
 selection set. The 'read' variant reads from standard input or a
 <-redirected filename; the 'write' variant writes to standard
 output or a >-redirected filename.
+
+The 'git-svn' variant reconstructs Subversion legacy IDs from the
+git-svn-id trailers left in commit comments by git-svn (or by a
+Subversion read with the --git-svn-id option), so that revision
+references can be resolved in a repository converted that way.
+With the --strip option, the trailers are removed afterwards.
 `)
 }
 
@@ -17044,6 +18244,11 @@ func (rs *Reposurgeon) DoLegacy(line string) bool {
 			return false
 		}
 		rs.chosen().writeLegacyMap(parse.stdout)
+	} else if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "git-svn" {
+		line = strings.TrimSpace(line)
+		parse := rs.newLineParse(strings.TrimSpace(line[len("git-svn"):]), nil)
+		defer parse.Closem()
+		rs.chosen().recoverGitSvnIDs(parse.options.Contains("--strip"))
 	} else {
 		if strings.HasPrefix(line, "read") {
 			line = strings.TrimSpace(line[4:])
@@ -17296,8 +18501,29 @@ func (rs *Reposurgeon) DoCheckout(line string) bool {
 
 func (rs *Reposurgeon) HelpDiff() {
 	rs.helpOutput(`
-Display the difference between commits. Takes a selection-set argument which
-must resolve to exactly two commits. Supports > redirection.
+Display the difference between commits. Takes a selection-set argument
+which must resolve to one or two commits; a single commit is compared
+with its first parent, or with the empty tree if it has none. Supports
+> redirection.
+
+Following arguments limit the report to the paths they name. A path
+names a file or everything beneath a directory; an argument surrounded
+by // is a regular expression that paths are matched against.
+
+The report is normally a unified diff of each modified file, with a
+line for each file added, removed, or whose mode changed. Files that
+look binary are reported as differing without their content being
+shown. These options change that:
+
+--stat            show lines changed per file with a histogram, then totals
+--name-status     list changed files with a status letter: A added,
+                  D deleted, M modified, T mode changed, R renamed, C copied
+--find-renames    report an added file at least half like a removed one
+                  as a rename of it
+--find-copies     as --find-renames, and report an added file at least
+                  half like any file of the earlier tree as a copy of it
+
+Renames and copies are shown with a similarity percentage.
 `)
 }
 
@@ -17308,59 +18534,195 @@ func (rs *Reposurgeon) DoDiff(line string) bool {
 		return false
 	}
 	repo := rs.chosen()
-	if len(rs.selection) != 2 {
-		logit(logWARN, "a pair of commits is required.")
-		return false
+	var lower, upper *Commit
+	var ok1, ok2 bool
+	switch len(rs.selection) {
+	case 1:
+		upper, ok2 = repo.events[rs.selection[0]].(*Commit)
+		ok1 = true
+		if ok2 && upper.hasParents() {
+			lower, ok1 = upper.parents()[0].(*Commit)
+		}
+	case 2:
+		lower, ok1 = repo.events[rs.selection[0]].(*Commit)
+		upper, ok2 = repo.events[rs.selection[1]].(*Commit)
 	}
-	lower, ok1 := repo.events[rs.selection[0]].(*Commit)
-	upper, ok2 := repo.events[rs.selection[1]].(*Commit)
 	if !ok1 || !ok2 {
-		logit(logWARN, "a pair of commits is required.")
+		logit(logWARN, "one commit or a pair of commits is required.")
 		return false
 	}
-	dir1 := newOrderedStringSet()
-	lower.manifest().iter(func(name string, _ interface{}) {
-		dir1.Add(name)
-	})
-	dir2 := newOrderedStringSet()
-	upper.manifest().iter(func(name string, _ interface{}) {
-		dir2.Add(name)
-	})
-	allpaths := dir1.Union(dir2)
-	sort.Strings(allpaths)
 	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 	defer parse.Closem()
-	for _, path := range allpaths {
-		if dir1.Contains(path) && dir2.Contains(path) {
-			// FIXME: Can we detect binary files and do something
-			// more useful here?
-			fromtext, _ := lower.blobByName(path)
-			totext, _ := upper.blobByName(path)
-			// Don't list identical files
-			if !bytes.Equal(fromtext, totext) {
-				lines0 := difflib.SplitLines(string(fromtext))
-				lines1 := difflib.SplitLines(string(totext))
-				file0 := path + " (" + lower.mark + ")"
-				file1 := path + " (" + upper.mark + ")"
-				diff := difflib.UnifiedDiff{
-					A:        lines0,
-					B:        lines1,
-					FromFile: file0,
-					ToFile:   file1,
-					Context:  3,
-				}
-				text, _ := difflib.GetUnifiedDiffString(diff)
-				fmt.Fprint(parse.stdout, text)
+	var opts diffOptions
+	opts.copies = parse.options.Contains("--find-copies")
+	opts.renames = opts.copies || parse.options.Contains("--find-renames")
+	for _, token := range parse.Tokens() {
+		if len(token) > 1 && token[0] == '/' && token[len(token)-1] == '/' {
+			re, err := regexp.Compile(token[1 : len(token)-1])
+			if err != nil {
+				croak("bad path regexp %s: %v", token, err)
+				return false
 			}
-		} else if dir1.Contains(path) {
-			fmt.Fprintf(parse.stdout, "%s: removed\n", path)
-		} else if dir2.Contains(path) {
-			fmt.Fprintf(parse.stdout, "%s: added\n", path)
+			opts.regexps = append(opts.regexps, re)
 		} else {
-			logit(logWARN, "internal error - missing path in diff")
+			opts.paths = append(opts.paths, token)
+		}
+	}
+	deltas := treeDelta(lower, upper, opts)
+	switch {
+	case parse.options.Contains("--stat"):
+		writeStat(parse.stdout, deltas)
+	case parse.options.Contains("--name-status"):
+		writeNameStatus(parse.stdout, deltas)
+	default:
+		lowerID := "empty"
+		if lower != nil {
+			lowerID = lower.mark
+		}
+		writeUnified(parse.stdout, deltas, lowerID, upper.mark)
+	}
+	return false
+}
+
+func (rs *Reposurgeon) HelpPatches() {
+	rs.helpOutput(`
+Write commits as a patch series in the form git format-patch produces,
+one mbox message per commit. Takes a selection set, defaulting to all
+commits; merges and commits that change nothing are left out. Supports
+> redirection.
+
+Each message takes its From and Date headers from the commit's first
+author, its subject from the first line of the comment numbered within
+the series, and its body from the rest of the comment. A diffstat and a
+diff against the commit's first parent, or the empty tree for a root,
+follow. Renames are detected. The series can be turned back into commits
+by git am or the apply command.
+`)
+}
+
+// DoPatches writes a selection of commits as an mbox patch series.
+func (rs *Reposurgeon) DoPatches(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	count := writePatches(parse.stdout, repo.commits(selection))
+	if count == 0 {
+		respond("no patches written.")
+	}
+	return false
+}
+
+func (rs *Reposurgeon) HelpRepodiff() {
+	rs.helpOutput(`
+Compare two loaded repositories structurally. With two repository
+names, compare the first with the second; with one, compare the chosen
+repository with it. Supports > redirection.
+
+Commits are paired with their counterparts in the other repository by
+legacy ID, then by action stamp, then by tree content, each method
+being tried on the commits the earlier ones left unpaired. The
+--match option takes a comma-separated list of the methods "legacy",
+"stamp", and "tree" to use instead, in order; matching by tree content
+is slow on large repositories.
+
+The report begins with a count of matched commits by method. Commits
+found only in the first repository are listed with a leading "-",
+those only in the second with "+". A paired commit whose branch,
+committer, authors, comment, or parents differ is listed with "~"
+followed by the differences; parents differ when they are not paired
+with each other. Finally each ref found in only one repository is
+listed, as is each ref whose tips are not paired or whose trees
+differ, with the paths that were added, removed, or modified.
+`)
+}
+
+// DoRepodiff compares two repositories.
+func (rs *Reposurgeon) DoRepodiff(line string) bool {
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	methods := matchMethods
+	if val, present := parse.OptVal("--match"); present {
+		methods = strings.Split(val, ",")
+		for _, method := range methods {
+			if !matchMethods.Contains(method) {
+				croak("unknown match method %q", method)
+				return false
+			}
+		}
+	}
+	names := parse.Tokens()
+	var a, b *Repository
+	switch len(names) {
+	case 1:
+		if rs.chosen() == nil {
+			croak("no repo has been chosen.")
 			return false
 		}
+		a, b = rs.chosen(), rs.repoByName(names[0])
+	case 2:
+		a, b = rs.repoByName(names[0]), rs.repoByName(names[1])
+	default:
+		croak("repodiff requires one or two repository names")
+		return false
+	}
+	compareRepositories(a, b, methods).report(parse.stdout)
+	return false
+}
+
+func (rs *Reposurgeon) HelpBlame() {
+	rs.helpOutput(`
+Show where each line of a file came from. Takes a selection set that
+must resolve to a single commit and the path of a file in that
+commit's tree. Supports > redirection.
+
+Each line of the file is printed with the mark, legacy ID, author, and
+author date of the commit that introduced it, and its line number.
+Lines are traced through every parent of a merge; where a commit
+renames or copies the file with an R or C fileop, its history is
+followed under the old path.
+`)
+}
+
+// DoBlame reports the origin of each line of a file.
+func (rs *Reposurgeon) DoBlame(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	if len(rs.selection) != 1 {
+		croak("blame requires a single commit.")
+		return false
+	}
+	commit, ok := rs.chosen().events[rs.selection[0]].(*Commit)
+	if !ok {
+		croak("blame requires a single commit.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if len(parse.Tokens()) != 1 {
+		croak("blame requires a path.")
+		return false
+	}
+	path := parse.Tokens()[0]
+	text, present := commit.blobByName(path)
+	if !present {
+		croak("%s does not exist at %s.", path, commit.mark)
+		return false
 	}
+	if isBinary(text) {
+		croak("%s is a binary file.", path)
+		return false
+	}
+	writeBlame(parse.stdout, commit, path)
 	return false
 }
 
@@ -17383,6 +18745,15 @@ An asterisk at the end of a path in the set means 'all immediate
 subdirectories of this path, unless they are part of another (longer)
 path in the branchify set'.
 
+A path may be qualified with a revision range by appending @ and the
+range, as in trunk@-5 or project/trunk@6-.  Such an entry applies only
+to revisions within the range; the endpoints are inclusive and either
+may be omitted. Use this when a repository's layout changed partway
+through its history. An @ followed by anything other than digits and
+hyphens is part of the path. Branches declared by such entries that are
+deleted along with a directory containing them are deleted as branches
+rather than file by file.
+
 Note that the branchify set is a property of the reposurgeon interpreter, not
 of any individual repository, and will persist across Subversion
 dumpfile reads. This may lead to unexpected results if you forget
@@ -17401,7 +18772,10 @@ func (rs *Reposurgeon) DoBranchify(line string) bool {
 			croak("malformed branchify command")
 			return false
 		}
-		control.listOptions["svn_branchify"] = fields
+		if err := setBranchify(fields); err != nil {
+			croak("%s", err)
+			return false
+		}
 	}
 	respond("branchify " + strings.Join(control.listOptions["svn_branchify"], " "))
 	return false
@@ -17442,6 +18816,14 @@ While the syntax template above uses slashes, any first character will
 be used as a delimiter (and you will need to use a different one in the
 common case that the paths contain slashes).
 
+A pair may be followed by @ and a revision range, as in
+/regex/branch/@6-, to apply it only to commits from revisions in that
+range. Range syntax is as for branchify.  When a layout change deletes
+a branch directory and, in the same revision, creates another one that
+maps to the same branch name, and either directory is declared by a
+scoped branchify entry, the branch history is continued across the move
+rather than being treated as a deletion.
+
 You must give this command *before* the Subversion repository read it
 is supposed to affect! It does not affect any other repository type.
 
@@ -17464,12 +18846,27 @@ func (rs *Reposurgeon) DoBranchmap(line string) bool {
 	} else if line != "" {
 		control.branchMappings = make([]branchMapping, 0)
 		for _, regex := range strings.Fields(line) {
+			var scope revisionScope
 			separator := regex[0]
 			if separator != regex[len(regex)-1] {
-				croak("Regex '%s' did not end with separator character", regex)
-				return false
+				// Maybe there's a revision-range qualifier
+				at := strings.LastIndex(regex, "@")
+				if at <= 0 || regex[at-1] != separator {
+					croak("Regex '%s' did not end with separator character", regex)
+					return false
+				}
+				var err error
+				if scope, err = parseRevisionScope(regex[at+1:]); err != nil {
+					croak("Regex '%s': %s", regex, err)
+					return false
+				}
+				regex = regex[:at]
 			}
 			stuff := strings.SplitN(regex[1:len(regex)-1], string(separator), 2)
+			if len(stuff) < 2 {
+				croak("Regex '%s' has no replace part", regex)
+				return false
+			}
 			match, replace := stuff[0], stuff[1]
 			if replace == "" || match == "" {
 				croak("Regex '%s' has an empty search or replace part", regex)
@@ -17480,13 +18877,13 @@ func (rs *Reposurgeon) DoBranchmap(line string) bool {
 				croak("Regex '%s' is ill-formed", regex)
 				return false
 			}
-			control.branchMappings = append(control.branchMappings, branchMapping{re, replace})
+			control.branchMappings = append(control.branchMappings, branchMapping{re, replace, scope})
 		}
 	}
 	if len(control.branchMappings) != 0 {
 		respond("branchmap, regex -> branch name:")
 		for _, pair := range control.branchMappings {
-			respond("\t" + pair.match.String() + " -> " + pair.replace)
+			respond("\t" + pair.match.String() + " -> " + pair.replace + pair.scope.String())
 		}
 	} else {
 		croak("branchmap is empty.")
@@ -17494,6 +18891,54 @@ func (rs *Reposurgeon) DoBranchmap(line string) bool {
 	return false
 }
 
+//
+// Analyzing Subversion layouts
+//
+
+func (rs *Reposurgeon) HelpLayout() {
+	rs.helpOutput(`
+Analyze the directory layout of a Subversion dump without building a
+repository from it. The dump must be supplied with < redirection.
+
+Reports the directories that behave like branch and tag roots, with the
+revision span over which each was live and the number of revisions
+that changed content under it; the namespace directories holding those
+roots; the copy-from relationships between roots; layout changes such
+as trunk or whole branch namespaces being moved; and branch copies
+that look misplaced, either because they were nested inside another
+branch or landed outside any namespace.
+
+The report ends with suggested branchify and branchmap commands that
+reproduce the analyzed layout. These are not applied; paste them into
+your lift script ahead of the read, after checking them.
+
+Supports > redirection.
+`)
+}
+
+// DoLayout analyzes the branch structure of a Subversion dump.
+func (rs *Reposurgeon) DoLayout(line string) bool {
+	if rs.selection != nil {
+		croak("layout does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	if parse.infile == "" {
+		croak("layout requires < redirection from a Subversion dump")
+		return false
+	}
+	repo := newRepository("layout")
+	defer repo.cleanup()
+	defer func() {
+		if e := catch("parse", recover()); e != nil {
+			croak(e.message)
+		}
+	}()
+	newStreamParser(repo).analyzeLayout(context.TODO(), parse.stdin).report(parse.stdout)
+	return false
+}
+
 //
 // Setting options
 //
@@ -17712,9 +19157,16 @@ func (rs *Reposurgeon) DoDo(ctx context.Context, line string) bool {
 		replacements = append(replacements, fmt.Sprintf("{%d}", i), arg)
 	}
 	body := strings.NewReplacer(replacements...).Replace(strings.Join(macro, "\n"))
+	body = rs.expandVariables(body)
 	doSelection := rs.selection
+	rs.debug.push(name, args, true)
+	defer rs.debug.pop()
 
-	for _, defline := range strings.Split(body, "\n") {
+	for i, defline := range strings.Split(body, "\n") {
+		if rs.debugStop(ctx, i+1, defline) {
+			croak("macro abandoned from the debugger")
+			break
+		}
 		// If a leading portion of the expansion body is a selection
 		// expression, use it.  Otherwise we'll restore whatever
 		// selection set came before the do keyword.
@@ -17730,6 +19182,137 @@ func (rs *Reposurgeon) DoDo(ctx context.Context, line string) bool {
 	return false
 }
 
+func (rs *Reposurgeon) HelpLet() {
+	rs.helpOutput(`
+Set a script variable. The first token is the variable's name, which
+must be letters, digits and underscores, not starting with a digit.
+The remainder of the line, trimmed, is the value. With a selection set
+and no value, the variable is set to the selected event numbers joined
+by commas, which is itself a valid selection; an empty selection gives
+an empty value.
+
+A reference of the form ${name} anywhere in a script line or macro
+body is replaced by the variable's value before the line is executed.
+A reference to an unset variable is left as it is, so text meant for
+a shell passes through; write $${ for a literal ${ before a set name.
+
+Each script invocation has its own variables. A script can read those
+of the scripts that called it, but let always sets the variable in the
+innermost one, so nothing leaks back to a caller when a script ends.
+
+With no arguments, list the variables visible at this point.
+Supports > redirection.
+`)
+}
+
+// DoLet sets a script variable.
+func (rs *Reposurgeon) DoLet(line string) bool {
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	fields := strings.Fields(parse.line)
+	if len(fields) == 0 {
+		if rs.selection != nil {
+			croak("let needs a variable name")
+			return false
+		}
+		visible := make(map[string]string)
+		for _, scope := range rs.scopes {
+			for name, value := range scope {
+				visible[name] = value
+			}
+		}
+		names := make([]string, 0, len(visible))
+		for name := range visible {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(parse.stdout, "%s = %s\n", name, visible[name])
+		}
+		return false
+	}
+	name := fields[0]
+	if !variableNameRE.MatchString(name) {
+		croak("%q is not a valid variable name", name)
+		return false
+	}
+	value := strings.TrimSpace(strings.TrimSpace(parse.line)[len(name):])
+	if rs.selection != nil {
+		if value != "" {
+			croak("let takes either a selection set or a value, not both")
+			return false
+		}
+		members := make([]string, len(rs.selection))
+		for i, ei := range rs.selection {
+			members[i] = strconv.Itoa(ei + 1)
+		}
+		value = strings.Join(members, ",")
+	}
+	rs.setVariable(name, value)
+	return false
+}
+
+func (rs *Reposurgeon) HelpAssert() {
+	rs.helpOutput(`
+Check a property of the chosen repository and fail if it does not
+hold. The failure is reported as an error naming what was expected
+and what was found, and it ends the script running the check unless
+the relax flag is set. Use this to give a lift script its own
+acceptance tests. The checks are:
+
+[SELECTION] assert count [OP] N
+    The selection, defaulting to all events, has N members. OP may
+    be ==, !=, <, <=, > or >=; the default is ==.
+
+assert branch NAME
+assert tag NAME
+    A branch or tag of that name exists. NAME may be a full ref.
+
+[SELECTION] assert path PATH...
+    Every listed path is present in the tree of each selected commit.
+
+[SELECTION] assert manifest PATH...
+    The tree of each selected commit holds exactly the listed paths.
+
+[SELECTION] assert author FIELD VALUE
+[SELECTION] assert committer FIELD VALUE
+    The first author (or the committer, for commits without an
+    author) or the committer of each selected commit has the given
+    name, email or date. Dates may be in any form the interpreter
+    accepts and are compared as points in time.
+
+[SELECTION] assert treehash HASH
+    The tree of each selected commit hashes, as git would compute it,
+    to HASH or to a hash beginning with it.
+
+Any check except count may be preceded by "not" to invert it. Values
+containing whitespace must be quoted. Commit checks apply to every
+commit in the selection, which defaults to all events.
+`)
+}
+
+// DoAssert checks a property of the repository, croaking if it fails.
+func (rs *Reposurgeon) DoAssert(line string) bool {
+	rs.assertion("assert", line)
+	return false
+}
+
+func (rs *Reposurgeon) HelpExpect() {
+	rs.helpOutput(`
+Check a property of the chosen repository as assert does, but report
+a failure without stopping. The script running the check goes on to
+the end, so that every failed expectation in it is reported, and then
+fails with a count of them. See "help assert" for the checks.
+`)
+}
+
+// DoExpect checks a property of the repository, reporting a failure
+// without ending the script.
+func (rs *Reposurgeon) DoExpect(line string) bool {
+	rs.assertion("expect", line)
+	return false
+}
+
 func (rs *Reposurgeon) HelpUndefine() {
 	rs.helpOutput(`
 Undefine the macro named in this command's first argument.
@@ -18266,6 +19849,116 @@ func (rs *Reposurgeon) DoChangelogs(line string) bool {
 	return false
 }
 
+func (rs *Reposurgeon) HelpMkchangelog() {
+	rs.helpOutput(`
+Generate a changelog from commit comments. Takes a selection set,
+defaulting to all commits; merges are left out. Supports > redirection.
+
+--format=fsf       FSF ChangeLog entries, newest first, each headed by
+                   the date and author and with the comment indented
+                   by a tab; this is the default
+--format=debian    debian/changelog entries, one per release, with a
+                   line for each commit
+--format=markdown  a NEWS file with a section per release and an item
+                   for each commit
+
+Releases end at tagged commits and take the tag's name, without any
+leading v before a digit. The commits after the last tag form an
+unreleased entry, whose version --version=V sets. For Debian it
+defaults to the last release's followed by +git, as in 1.0+git, and
+must be given if no commit is tagged. --package=NAME gives the Debian
+package name, which defaults to the repository's name.
+
+With --commit=REF the changelog is put into the tree of the commit REF
+names, and so of the commits after it, instead of being written out.
+The selection then defaults to REF and its ancestors.
+It goes at the path --path=PATH names, defaulting to ChangeLog,
+debian/changelog, or NEWS.md according to the format.
+`)
+}
+
+// DoMkchangelog generates a changelog from the selected commits.
+func (rs *Reposurgeon) DoMkchangelog(line string) bool {
+	if rs.dryRun(line, rs.DoMkchangelog, true) {
+		return false
+	}
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	format, pkg, version, ref, path := "fsf", repo.name, "", "", ""
+	for _, option := range parse.options {
+		switch {
+		case strings.HasPrefix(option, "--format="):
+			format = option[len("--format="):]
+		case strings.HasPrefix(option, "--package="):
+			pkg = option[len("--package="):]
+		case strings.HasPrefix(option, "--version="):
+			version = option[len("--version="):]
+		case strings.HasPrefix(option, "--commit="):
+			ref = option[len("--commit="):]
+		case strings.HasPrefix(option, "--path="):
+			path = option[len("--path="):]
+		}
+	}
+	if _, ok := changelogPaths[format]; !ok {
+		croak("unknown changelog format %q.", format)
+		return false
+	}
+	var target *Commit
+	if ref != "" {
+		if target = repo.commitByRef(ref); target == nil {
+			croak("%s does not name a commit.", ref)
+			return false
+		}
+		if path == "" {
+			path = changelogPaths[format]
+		}
+	}
+	selection := rs.selection
+	if selection == nil && target != nil {
+		// Only the history the changelog's tree has.
+		ancestors := target.ancestorSet()
+		for i, event := range repo.events {
+			if commit, ok := event.(*Commit); ok && ancestors[commit] {
+				selection = append(selection, i)
+			}
+		}
+	} else if selection == nil {
+		selection = repo.all()
+	}
+	commits := changelogCommits(repo.commits(selection))
+	if len(commits) == 0 {
+		croak("no commits selected.")
+		return false
+	}
+	var out bytes.Buffer
+	switch format {
+	case "fsf":
+		writeFSFChangelog(&out, commits)
+	case "debian":
+		releases := changelogReleases(commits)
+		version = debianUnreleased(releases, version)
+		if version == "" && releases[len(releases)-1].version == "" {
+			croak("no tag to derive a version from; give --version.")
+			return false
+		}
+		writeDebianChangelog(&out, releases, pkg, version)
+	case "markdown":
+		writeMarkdownChangelog(&out, changelogReleases(commits), version)
+	}
+	if target != nil {
+		repo.commitChangelog(target, path, out.Bytes())
+		respond("%s added to %s.", path, target.idMe())
+	} else {
+		parse.stdout.Write(out.Bytes())
+	}
+	return false
+}
+
 //
 // Tarball incorporation
 //
@@ -18531,6 +20224,129 @@ func (rs *Reposurgeon) DoIncorporate(line string) bool {
 	return false
 }
 
+func (rs *Reposurgeon) HelpApply() {
+	rs.helpOutput(`
+Turn patches that were never committed into commits.
+
+    {SELECTION} apply [--strip=N] [--branch=NAME] [FILE...] [<FILE]
+
+The patches are read from the files named as arguments, in order, and
+then from standard input if it is redirected. Each input is either an
+mbox, such as a mailing-list archive or the output of git format-patch,
+or a bare unified diff from diff -u, git diff, or a Subversion or CVS
+diff. Takes a singleton selection set, the commit the first patch
+applies to; each later one applies to the commit made from the one
+before.
+
+Each message in an mbox becomes one commit. Its From and Date headers
+give the author and committer, and the subject, less any leading tags
+like "[PATCH 2/5]", together with the text before the diff, up to a
+"---" line, gives the comment. A bare diff is committed by the invoking
+user, at the latest time in its file headers, or failing that the
+parent's date, with the text before the diff as comment.
+
+Hunks are applied to the parent's version of each file, allowing for
+lines added or removed above them but not for changed context. git's
+headers for new and deleted files, mode changes, renames and copies are
+honored; binary patches are not supported. Leading path components are
+stripped from the paths in the diff as by patch -p; --strip sets how
+many, defaulting to 1. Outside git diffs, differing old and new names
+are taken to be a backup copy and the file patched.
+
+The commits go on the branch of the selected commit, or with --branch
+on the branch NAME, directly after it in the event sequence. If any
+patch fails to apply, nothing is added and the failure is reported.
+
+With the --dry-run option, or while the dryrun flag is set, what
+would be added is reported and nothing is changed.
+`)
+}
+
+// DoApply makes commits from patches.
+func (rs *Reposurgeon) DoApply(line string) bool {
+	if rs.dryRun(line, rs.DoApply, true) {
+		return false
+	}
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	if len(rs.selection) != 1 {
+		croak("a singleton selection set is required.")
+		return false
+	}
+	parent, ok := repo.events[rs.selection[0]].(*Commit)
+	if !ok {
+		croak("selection is not a commit.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdin"})
+	defer parse.Closem()
+	strip := 1
+	branch := parent.Branch
+	for _, option := range parse.options {
+		switch {
+		case strings.HasPrefix(option, "--strip="):
+			n, err := strconv.Atoi(option[len("--strip="):])
+			if err != nil || n < 0 {
+				croak("--strip requires a non-negative integer.")
+				return false
+			}
+			strip = n
+		case strings.HasPrefix(option, "--branch="):
+			branch = option[len("--branch="):]
+			if !strings.HasPrefix(branch, "refs/") {
+				branch = "refs/heads/" + branch
+			}
+		}
+	}
+	var patches []*patch
+	read := func(source string, data []byte) bool {
+		found, err := readPatches(data, strip)
+		if err != nil {
+			croak("%s: %v", source, err)
+			return false
+		}
+		patches = append(patches, found...)
+		return true
+	}
+	for _, name := range parse.Tokens() {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			croak("while reading patches: %v", err)
+			return false
+		}
+		if !read(name, data) {
+			return false
+		}
+	}
+	if parse.redirected {
+		data, err := ioutil.ReadAll(parse.stdin)
+		if err != nil {
+			croak("while reading patches: %v", err)
+			return false
+		}
+		if !read("standard input", data) {
+			return false
+		}
+	}
+	if len(patches) == 0 {
+		croak("no patches given.")
+		return false
+	}
+	user, _ := newAttribution("")
+	user.fullname, user.email = whoami()
+	user.date = parent.committer.date.clone()
+	commits, err := repo.applyPatches(patches, parent, branch, user)
+	if err != nil {
+		croak("%v", err)
+		return false
+	}
+	respond("%d patches applied onto %s.", len(commits), parent.idMe())
+	return false
+}
+
 //
 // Version binding
 //
@@ -18863,8 +20679,189 @@ func (rs *Reposurgeon) DoPrint(lineIn string) bool {
 	return false
 }
 
+func (rs *Reposurgeon) HelpServer() {
+	rs.helpOutput(`
+Hand control of the session to another program speaking JSON-RPC 2.0.
+With no argument, requests are read from standard input and responses
+written to standard output; with a path argument, a Unix-domain socket
+is created there and clients are served one at a time. Start a
+dedicated process with 'reposurgeon --server'.
+
+Each message is one JSON object on one line. Methods:
+
+    command       params {"line": "..."}; run an interpreter command.
+                  The result has "output", holding what the command
+                  would have printed, and "stop", true if the command
+                  ends the session.
+
+    select        params {"expression": "..."}; evaluate a selection
+                  expression against the chosen repository. The result
+                  has "events", a list of 1-origin event numbers.
+
+    repositories  no params; the result has "chosen" and "names".
+
+    shutdown      no params; end the server.
+
+A failed command gets an error object whose code reflects the kind of
+failure: -32001 for command errors, -32002 for stream parse errors,
+-32003 for extractor errors, -32004 for mailbox errors. The error's
+data member carries the exception class and any captured output. A
+line naming no command is a command error.
+
+While a command runs, progress reports are sent as "progress"
+notifications with a "message" param. When serving over standard
+output, anything else written there, such as the output of
+subprocesses, goes to standard error instead.
+
+The server ends at end of input on standard input, or when a client
+sends shutdown; the interpreter then carries on with any further
+command-line arguments.
+`)
+}
+
+// DoServer runs a JSON-RPC session over stdio or a Unix socket.
+func (rs *Reposurgeon) DoServer(ctx context.Context, line string) bool {
+	if rs.selection != nil {
+		croak("server does not take a selection set")
+		return false
+	}
+	path := strings.TrimSpace(line)
+	if path == "" {
+		// Anything written straight to standard output, as by
+		// subprocesses, would corrupt the protocol stream; send it
+		// to standard error instead.
+		protocol := os.Stdout
+		os.Stdout = os.Stderr
+		defer func() { os.Stdout = protocol }()
+		rs.serve(ctx, os.Stdin, protocol)
+		return false
+	}
+	if err := rs.listen(ctx, path); err != nil {
+		croak("server failed: %v", err)
+	}
+	return false
+}
+
+func (rs *Reposurgeon) HelpBreak() {
+	rs.helpOutput(`
+Set a breakpoint in scripts and macros. Execution stops before a
+command at a breakpoint runs. A breakpoint may be
+
+    N          line N of any script
+    FILE:N     line N of the named script
+    MACRO:N    line N of the body of the named macro
+    COMMAND    any command with that name, e.g. "squash"
+
+Control-flow lines are not commands and never stop. With no argument,
+list the breakpoints that are set.
+
+At a stop, the position and the stack of active scripts and macros,
+innermost first, are shown, and commands are read from reposurgeon's
+own input, the terminal or the commands piped in after the one that
+started the script:
+
+    continue, c   resume until the next breakpoint
+    step, s       run the waiting command and stop before the next,
+                  going into macros and nested scripts
+    next, n       like step, but do not stop inside macros or nested
+                  scripts the waiting command calls
+    where, w      show the stack again
+    abort         abandon the script as though the command had failed
+
+Anything else is run as an ordinary command. Without a selection set
+of its own, it gets the selection of the command waiting to run.
+Errors in commands typed at a stop do not abort the script.
+
+If this command's input is redirected, debugger commands are read from
+there instead, so a session can be replayed; end of input continues
+the script.
+`)
+}
+
+// DoBreak sets or lists breakpoints.
+func (rs *Reposurgeon) DoBreak(line string) bool {
+	if rs.selection != nil {
+		croak("break does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	if parse.redirected && parse.infile != "" {
+		content, err := ioutil.ReadAll(parse.stdin)
+		if err != nil {
+			croak("break: %v", err)
+			return false
+		}
+		rs.debug.input = bytes.NewReader(content)
+	}
+	if len(parse.Tokens()) == 0 {
+		if !parse.redirected || parse.outfile != "" {
+			for _, breakpoint := range rs.debug.breakpoints {
+				fmt.Fprintln(parse.stdout, breakpoint)
+			}
+		}
+		return false
+	}
+	for _, breakpoint := range parse.Tokens() {
+		rs.debug.breakpoints.Add(breakpoint)
+	}
+	return false
+}
+
+func (rs *Reposurgeon) HelpUnbreak() {
+	rs.helpOutput(`
+Remove the named breakpoints, or all of them if none are named.
+`)
+}
+
+// DoUnbreak removes breakpoints.
+func (rs *Reposurgeon) DoUnbreak(line string) bool {
+	if len(strings.Fields(line)) == 0 {
+		rs.debug.breakpoints = newOrderedStringSet()
+		return false
+	}
+	for _, breakpoint := range strings.Fields(line) {
+		if !rs.debug.breakpoints.Contains(breakpoint) {
+			croak("no breakpoint %s is set", breakpoint)
+			return false
+		}
+		rs.debug.breakpoints.Remove(breakpoint)
+	}
+	return false
+}
+
 func (rs *Reposurgeon) HelpScript() {
-	rs.helpOutput("Read and execute commands from a named file.\n")
+	rs.helpOutput(`
+Read and execute commands from a named file. Following arguments
+replace $1, $2... in the script text; $0 is the script name and $$
+the process ID. A line ending in backslash continues on the next
+line, and "<<TERM" in place of an input filename reads a
+here-document up to a line consisting of TERM.
+
+Scripts have control flow:
+
+    if CONDITION
+    ...
+    else
+    ...
+    end
+
+    for NAME in WORD...
+    for NAME over SELECTION
+    for NAME branches
+    for NAME tags
+    ...
+    end
+
+A CONDITION is a selection set, true if it selects anything, or two
+words compared with == or !=. Either may be preceded by "not". The
+loop forms iterate over the given words, the selected event numbers,
+or the branch and tag names of the chosen repository; each pass sets
+the variable NAME, which ${NAME} expands to. See "help let" for
+variables. Mismatched if/else/for/end lines are reported before any
+of the script runs. A line that only starts with one of those words,
+like "end" with more after it, is a command.
+`)
 }
 
 func (rs *Reposurgeon) DoScript(ctx context.Context, lineIn string) bool {
@@ -18877,117 +20874,98 @@ func (rs *Reposurgeon) DoScript(ctx context.Context, lineIn string) bool {
 		control.setAbort(false)
 	}
 	words := strings.Split(lineIn, " ")
-	rs.callstack = append(rs.callstack, words)
 	fname := words[0]
 	scriptfp, err := os.Open(fname)
 	if err != nil {
 		croak("script failure on '%s': %s", fname, err)
 		return false
 	}
-	defer scriptfp.Close()
-	script := bufio.NewReader(scriptfp)
+	stmts, err := parseScript(scriptfp)
+	scriptfp.Close()
+	if err != nil {
+		croak("script failure on '%s': %s", fname, err)
+		return false
+	}
+	rs.callstack = append(rs.callstack, words)
+	rs.scopes = append(rs.scopes, make(map[string]string))
+	rs.debug.push(fname, words[1:], false)
 
 	existingInputIsStdin := rs.inputIsStdin
 	rs.inputIsStdin = false
 
+	outerFailures := rs.expectFails
+	rs.expectFails = 0
 	interpreter.PreLoop(ctx)
-	lineno := 0
-	for {
-		scriptline, err := script.ReadString('\n')
-		lineno++
-		if err == io.EOF && scriptline == "" {
-			break
-		}
-		// Handle multiline commands
-		for strings.HasSuffix(scriptline, "\\\n") {
-			nexterline, err := script.ReadString('\n')
-			if err == io.EOF && nexterline == "" {
-				break
-			}
-			lineno++
-			scriptline = scriptline[:len(scriptline)-2] + nexterline
-		}
-
-		scriptline = strings.TrimSpace(scriptline)
-
-		// Simulate shell here-document processing
-		if strings.Contains(scriptline, "<<") {
-			heredoc, err := ioutil.TempFile("", "reposurgeon-")
-			if err != nil {
-				croak("script failure on '%s': %s", fname, err)
-				return false
-			}
-			defer os.Remove(heredoc.Name())
-
-			stuff := strings.Split(scriptline, "<<")
-			scriptline = stuff[0]
-			terminator := stuff[1] + "\n"
-			for true {
-				nextline, err := script.ReadString('\n')
-				if err == io.EOF && nextline == "" {
-					break
-				} else if nextline == terminator {
-					break
-				} else {
-					_, err := fmt.Fprint(heredoc, nextline)
-					if err != nil {
-						croak("script failure on '%s': %s", fname, err)
-						return false
-					}
-				}
-				lineno++
-			}
-
-			heredoc.Close()
-			// Note: the command must accept < redirection!
-			scriptline += "<" + heredoc.Name()
-		}
-		// End of heredoc simulation
-
-		// Positional variables
-		for i, v := range rs.callstack[len(rs.callstack)-1] {
-			ref := "$" + strconv.FormatInt(int64(i), 10)
-			scriptline = strings.Replace(scriptline, ref, v, -1)
-		}
-		scriptline = strings.Replace(scriptline, "$$", strconv.FormatInt(int64(os.Getpid()), 10), -1)
+	rs.runStatements(ctx, &scriptRun{fname: fname, stmts: stmts}, 0, len(stmts))
+	interpreter.PostLoop(ctx)
+	if rs.expectFails > 0 {
+		croak("%d expectation(s) failed in %s", rs.expectFails, fname)
+	}
+	rs.expectFails = outerFailures
 
-		// if the script wants to define a macro, the input
-		// for the macro has to come from the script file
-		existingStdin := rs.cmd.GetStdin()
-		if strings.HasPrefix(scriptline, "define") && strings.HasSuffix(scriptline, "{") {
-			rs.cmd.SetStdin(ioutil.NopCloser(script))
-		}
+	rs.inputIsStdin = existingInputIsStdin
 
-		// finally we execute the command, plus the before/after steps
-		originalline := scriptline
-		scriptline = interpreter.PreCmd(ctx, scriptline)
-		stop := interpreter.OneCmd(ctx, scriptline)
-		stop = interpreter.PostCmd(ctx, stop, scriptline)
+	rs.debug.pop()
+	rs.scopes = rs.scopes[:len(rs.scopes)-1]
+	rs.callstack = rs.callstack[:len(rs.callstack)-1]
+	return false
+}
 
-		// and then we have to put the stdin back where it
-		// was, in case we changed it
-		rs.cmd.SetStdin(existingStdin)
+func (rs *Reposurgeon) HelpCheck() {
+	rs.helpOutput(`
+Check one or more scripts for errors without running them and without
+loading any repository. Every problem found is reported, each with
+the script name and line number:
+
+    * if, else, for and end lines that do not match up;
+    * malformed if conditions and for loops;
+    * unknown commands;
+    * options a command does not accept;
+    * selection expressions that do not compile;
+    * macro calls naming a macro not defined earlier in the script,
+      or passing a different number of arguments than the definition
+      uses. The commands in macro bodies are checked too.
+
+Script arguments and variable references cannot be known in advance
+and are assumed to be valid wherever they appear. A selection that
+begins with a bare branch or tag name cannot be recognized without a
+repository, so an unknown first word is accepted when a command
+follows it.
+
+The check fails if there are any problems. From the shell, use
+"reposurgeon --check script.lift". Supports > redirection.
+`)
+}
 
-		// Abort flag is set by croak() and signals.
-		// When it is set, we abort out of every nested
-		// script call.
-		if control.getAbort() {
-			if originalline != "" {
-				logit(logSHOUT, "script abort on line %d %q", lineno, originalline)
-			} else {
-				logit(logSHOUT, "script abort on line %d", lineno)
-			}
-			break
+// DoCheck statically checks scripts.
+func (rs *Reposurgeon) DoCheck(line string) bool {
+	if rs.selection != nil {
+		croak("check does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if len(parse.Tokens()) == 0 {
+		croak("check requires a script name")
+		return false
+	}
+	count := 0
+	for _, fname := range parse.Tokens() {
+		scriptfp, err := os.Open(fname)
+		if err != nil {
+			croak("script failure on '%s': %s", fname, err)
+			return false
 		}
-		if stop {
-			break
+		problems := newScriptChecker(rs).check(scriptfp)
+		scriptfp.Close()
+		for _, problem := range problems {
+			fmt.Fprintf(parse.stdout, "%s: %s\n", fname, problem)
 		}
+		count += len(problems)
+	}
+	if count > 0 {
+		croak("%d problem(s) found", count)
 	}
-	interpreter.PostLoop(ctx)
-
-	rs.inputIsStdin = existingInputIsStdin
-
-	rs.callstack = rs.callstack[:len(rs.callstack)-1]
 	return false
 }
 
@@ -19032,13 +21010,15 @@ func (rs *Reposurgeon) DoSizeof(lineIn string) bool {
 	return false
 }
 
-func main() {
+// Main runs the reposurgeon interpreter over the command-line arguments.
+func Main() {
 	ctx := context.Background()
 	// need to have at least one task for the trace viewer to show any logs/regions
 	ctx, task := trace.NewTask(ctx, "awesomeTask")
 	defer task.End()
 	defer trace.StartRegion(ctx, "main").End()
 	control.init()
+	control.catchSignals()
 	rs := newReposurgeon()
 	interpreter := kommandant.NewKommandant(rs)
 	interpreter.EnableReadline(true)
@@ -19072,7 +21052,14 @@ func main() {
 	r := trace.StartRegion(ctx, "process-args")
 	interpreter.PreLoop(ctx)
 	stop := false
-	for _, arg := range os.Args[1:] {
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// An option that names a file takes the next argument.
+		if arg == "--check" && i+1 < len(args) {
+			i++
+			arg += " " + args[i]
+		}
 		for _, acmd := range strings.Split(arg, ";") {
 			if acmd == "-" {
 				control.flagOptions["interactive"] = terminal.IsTerminal(0)
@@ -1,9 +1,14 @@
-package main
+package surgeon
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io"
 	"log"
 	"os"
@@ -1868,8 +1873,8 @@ func TestDeclaredBranch(t *testing.T) {
 			for idx, test := range testcases[idx] {
 				test := test
 				t.Run(fmt.Sprint(idx), func(t *testing.T) {
-					control.listOptions["svn_branchify"] = branchset
-					assertBool(t, isDeclaredBranch(test.path), test.isDeclaredBranch)
+					setBranchify(branchset)
+					assertBool(t, isDeclaredBranch(test.path, 1), test.isDeclaredBranch)
 				})
 			}
 		})
@@ -1878,7 +1883,7 @@ func TestDeclaredBranch(t *testing.T) {
 
 func TestBranchSplit(t *testing.T) {
 	control.listOptions = make(map[string]orderedStringSet)
-	control.listOptions["svn_branchify"] = orderedStringSet{"trunk", "tags/*", "branches/*", "*"}
+	setBranchify(orderedStringSet{"trunk", "tags/*", "branches/*", "*"})
 	type splitTestEntry struct {
 		raw    string
 		branch string
@@ -1894,12 +1899,89 @@ func TestBranchSplit(t *testing.T) {
 		{"branches/foo/bar/baz", "branches/foo", "bar/baz"},
 	}
 	for _, tst := range splitTestTable {
-		b, p := splitSVNBranchPath(tst.raw)
+		b, p := splitSVNBranchPath(tst.raw, 1)
 		assertEqual(t, b, tst.branch)
 		assertEqual(t, p, tst.path)
 	}
 }
 
+func TestScopedBranchify(t *testing.T) {
+	control.listOptions = make(map[string]orderedStringSet)
+	setBranchify(orderedStringSet{
+		"trunk@-5", "branches/*@-5", "project/trunk@6-", "project/branches/*@6-"})
+	type scopedTestEntry struct {
+		raw    string
+		rev    revidx
+		branch string
+	}
+	var scopedTestTable = []scopedTestEntry{
+		{"trunk/README", 3, "trunk"},
+		{"trunk/README", 6, ""},
+		{"branches/foo/README", 5, "branches/foo"},
+		{"project/trunk/README", 5, ""},
+		{"project/trunk/README", 6, "project/trunk"},
+		{"project/branches/foo/README", 9, "project/branches/foo"},
+	}
+	for _, tst := range scopedTestTable {
+		b, _ := splitSVNBranchPath(tst.raw, tst.rev)
+		assertEqual(t, b, tst.branch)
+	}
+
+	for _, spec := range []string{"1-", "-7", "3-7", "4"} {
+		scope, err := parseRevisionScope(spec)
+		assertBool(t, err == nil, true)
+		assertEqual(t, scope.String(), "@"+spec)
+	}
+	// Bounds too big for a revision are refused rather than wrapped.
+	for _, spec := range []string{"-", "", "7-3", "x-4", "99999999999999999999", "4294967296", "5-4294967296"} {
+		_, err := parseRevisionScope(spec)
+		assertBool(t, err != nil, true)
+	}
+
+	// An @ followed by anything but a range belongs to the path.
+	path, scope, err := splitBranchifyEntry("vendor/foo@bar/*")
+	assertBool(t, err == nil, true)
+	assertEqual(t, path, "vendor/foo@bar/*")
+	assertEqual(t, scope.String(), "")
+	path, scope, _ = splitBranchifyEntry("vendor/foo@bar@6-")
+	assertEqual(t, path, "vendor/foo@bar")
+	assertEqual(t, scope.String(), "@6-")
+	_, _, err = splitBranchifyEntry("trunk@7-3")
+	assertBool(t, err != nil, true)
+	assertBool(t, isScopedBranch("trunk", 3), true)
+	// A bad entry is refused when the list is set, leaving it as it was.
+	assertBool(t, setBranchify(orderedStringSet{"trunk", "trunk@7-3"}) != nil, true)
+	assertBool(t, isScopedBranch("trunk", 3), true)
+	setBranchify(orderedStringSet{"trunk"})
+	assertBool(t, isScopedBranch("trunk", 3), false)
+}
+
+func TestAppendTrailers(t *testing.T) {
+	assertEqual(t, appendTrailers("Fix a bug.\n", "Bug: 17"),
+		"Fix a bug.\n\nBug: 17\n")
+	assertEqual(t, appendTrailers("Fix a bug.\n\nSigned-off-by: esr\n", "Bug: 17"),
+		"Fix a bug.\n\nSigned-off-by: esr\nBug: 17\n")
+	assertEqual(t, appendTrailers("", "Bug: 17", "Review: 3"),
+		"Bug: 17\nReview: 3\n")
+	assertEqual(t, appendTrailers("Unchanged.\n"), "Unchanged.\n")
+	assertEqual(t, trailerName("bugtraq:number"), "Bugtraq-Number")
+	assertEqual(t, trailerName("svn:sync-last-merged-rev"), "Svn-Sync-Last-Merged-Rev")
+}
+
+func TestRevpropRules(t *testing.T) {
+	rules, err := readRevpropRules(strings.NewReader(
+		"# comment\n\nbugtraq:* trailer Bug\nsvk:merge drop\n"))
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, len(rules), 2)
+	assertEqual(t, rules[0].pattern, "bugtraq:*")
+	assertEqual(t, rules[0].name, "Bug")
+	assertEqual(t, rules[1].disposition, "drop")
+	for _, bad := range []string{"foo\n", "foo bar\n", "foo trailer not:valid\n", "[ note\n"} {
+		_, err := readRevpropRules(strings.NewReader(bad))
+		assertBool(t, err != nil, true)
+	}
+}
+
 func TestContainingDir(t *testing.T) {
 	type testcase struct {
 		path string
@@ -1975,3 +2057,672 @@ func TestWalkManifests(t *testing.T) {
 	}
 	assertTrue(t, num == 0)
 }
+
+func TestLibraryAPI(t *testing.T) {
+	fp, err := os.Open("../test/min.fi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	repo, err := ReadStream(fp, "min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	commits := repo.Commits()
+	assertIntEqual(t, len(commits), 2)
+	assertEqual(t, commits[1].Mark(), ":4")
+	assertEqual(t, commits[1].Parents()[0].Mark(), ":2")
+	content, ok := commits[0].Content("README")
+	assertTrue(t, ok)
+	assertEqual(t, string(content), "1234567890123456789\n")
+
+	session := NewSession()
+	session.Adopt(repo)
+	selection, err := session.Select("=C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIntEqual(t, len(selection), 2)
+	if _, err := session.Select("=Q"); err == nil {
+		t.Error("bad selection was accepted")
+	}
+	if err := session.Do("1 squash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Do("choose nosuchrepo"); err == nil {
+		t.Error("failing command reported success")
+	}
+	if err := session.Do("frobnicate"); err == nil {
+		t.Error("unknown command reported success")
+	}
+	if bad, err := ReadStream(strings.NewReader("commit refs/heads/master\nbogus\n"), "bad"); err == nil || bad != nil {
+		t.Error("unreadable stream gave a repository")
+	}
+	commits[1].Comment = "Edited.\n"
+	var out strings.Builder
+	if err := session.Repository().WriteStream(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertTrue(t, strings.Contains(out.String(), "data 8\nEdited.\n"))
+}
+
+func TestServer(t *testing.T) {
+	session := NewSession()
+	requests := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"method":"command","params":{"line":"read <../test/min.fi"}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"command","params":{"line":"=C count"}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"select","params":{"expression":"=C"}}`,
+		`{"jsonrpc":"2.0","id":4,"method":"command","params":{"line":"choose nosuch"}}`,
+		`{"jsonrpc":"2.0","method":"command","params":{"line":"=C count"}}`,
+		`not json`,
+		`{"jsonrpc":"2.0","id":5,"method":"frob"}`,
+		`{"jsonrpc":"2.0","id":8,"method":"command","params":{"line":"bogus"}}`,
+		`{"jsonrpc":"2.0","id":6,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","id":7,"method":"repositories"}`,
+	}, "\n")
+	var out bytes.Buffer
+	stop := session.rs.serve(context.TODO(), strings.NewReader(requests), &out)
+	assertTrue(t, stop)
+	responses := make(map[string]rpcResponse)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var response struct {
+			rpcResponse
+			Method string `json:"method"`
+		}
+		if err := json.Unmarshal([]byte(line), &response); err != nil {
+			t.Fatalf("bad response %q: %v", line, err)
+		}
+		if response.Method == "" {
+			responses[string(response.ID)] = response.rpcResponse
+		}
+	}
+	assertIntEqual(t, len(responses), 8)
+	assertTrue(t, responses["1"].Error == nil)
+	assertEqual(t, responses["2"].Result.(map[string]interface{})["output"].(string), "2\n")
+	assertEqual(t, fmt.Sprint(responses["3"].Result.(map[string]interface{})["events"]), "[2 4]")
+	assertIntEqual(t, responses["4"].Error.Code, -32001)
+	assertIntEqual(t, responses["null"].Error.Code, rpcParseError)
+	assertIntEqual(t, responses["5"].Error.Code, rpcMethodNotFound)
+	// Output of an unknown command goes with its error, not to the stream.
+	assertIntEqual(t, responses["8"].Error.Code, -32001)
+	assertTrue(t, strings.Contains(fmt.Sprint(responses["8"].Error.Data), "Unknown syntax: bogus"))
+	assertTrue(t, responses["6"].Error == nil)
+}
+
+func TestParseScript(t *testing.T) {
+	stmts, err := parseScript(strings.NewReader(
+		"for x in a b\nif ${x} == a\nprint \\\nyes\nelse\nblob <<EOF\nend\nEOF\nend\nend\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIntEqual(t, len(stmts), 7)
+	assertIntEqual(t, stmts[0].endIdx, 6)
+	assertIntEqual(t, stmts[1].elseIdx, 3)
+	assertIntEqual(t, stmts[1].endIdx, 5)
+	assertEqual(t, stmts[2].text, "print yes")
+	assertIntEqual(t, stmts[2].lineno, 4)
+	assertEqual(t, strings.Join(stmts[4].heredoc, ""), "end\n")
+	// Lines that only begin with a keyword are commands.
+	stmts, err = parseScript(strings.NewReader("end of it\nfor x\nif\nelse if\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range stmts {
+		assertEqual(t, stmt.keyword, "")
+	}
+	for _, test := range []struct {
+		script string
+		err    string
+	}{
+		{"print\nend\n", "line 2: end without matching if or for"},
+		{"if =C\nelse\nelse\nend\n", "line 3: else without matching if"},
+		{"for x in a\nif =C\nend\n", "line 1: for without matching end"},
+	} {
+		_, err := parseScript(strings.NewReader(test.script))
+		if err == nil {
+			t.Errorf("%q parsed without error", test.script)
+		} else {
+			assertEqual(t, err.Error(), test.err)
+		}
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	fp, err := os.Open("../test/sample1.fi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	repo, err := ReadStream(fp, "sample1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	// Expected values are from git fast-import of the same stream.
+	expected := map[string]string{
+		"Second commit on the main branch.": "ad164eca68479c0774052811887b0ef6f59fcfbf",
+		"Attempt to generate a copy.":       "aac094259ca7a09a341fd6cb567d1f3cb231c7ca",
+		"Merge branch 'alternate'":          "e722433aed373037ae8cb85ae5783f17bec12c30",
+	}
+	found := 0
+	for _, commit := range repo.commits(nil) {
+		if hash, ok := expected[strings.Split(commit.Comment, "\n")[0]]; ok {
+			assertEqual(t, commit.treeHash(), hash)
+			found++
+		}
+	}
+	assertIntEqual(t, found, len(expected))
+}
+
+func TestCommandOptions(t *testing.T) {
+	sc := newScriptChecker(NewSession().rs)
+	for name := range commandOptions {
+		if !sc.commands[name] {
+			t.Errorf("option table names nonexistent command %q", name)
+		}
+	}
+	for _, name := range freeformCommands {
+		if !sc.commands[name] {
+			t.Errorf("freeform list names nonexistent command %q", name)
+		}
+	}
+	// Every option a command's Do method looks for must be in the table.
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range pkgs["surgeon"].Files {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || !strings.HasPrefix(fn.Name.Name, "Do") {
+				continue
+			}
+			name := strings.ToLower(fn.Name.Name[len("Do"):])
+			if freeformCommands.Contains(name) {
+				continue
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				lit, ok := n.(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					return true
+				}
+				option, err := strconv.Unquote(lit.Value)
+				if err != nil || !optionLiteralRE.MatchString(option) {
+					return true
+				}
+				option = strings.TrimSuffix(option, "=")
+				if !commandOptions[name].Contains(option) {
+					t.Errorf("%s: %s uses %s, which is not in the option table",
+						fset.Position(lit.Pos()), name, option)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// optionLiteralRE matches a string literal that is exactly an option
+// name, or one followed by = as matched against a prefix.
+var optionLiteralRE = regexp.MustCompile(`^--[a-z][a-z-]*=?$`)
+
+func TestBreakpointMatch(t *testing.T) {
+	dbg := newDebugger()
+	script := &debugFrame{name: "lifts/project.lift", lineno: 12}
+	macro := &debugFrame{name: "fixup", macro: true, lineno: 12}
+	for _, test := range []struct {
+		breakpoint string
+		frame      *debugFrame
+		command    string
+		expect     bool
+	}{
+		{"12", script, "squash", true},
+		{"12", macro, "squash", false},
+		{"13", script, "squash", false},
+		{"project.lift:12", script, "squash", true},
+		{"lifts/project.lift:12", script, "squash", true},
+		{"other.lift:12", script, "squash", false},
+		{"fixup:12", macro, "squash", true},
+		{"fixup:12", script, "squash", false},
+		{"squash", macro, "squash", true},
+		{"squash", script, "delete", false},
+	} {
+		if dbg.matches(test.breakpoint, test.frame, test.command) != test.expect {
+			t.Errorf("breakpoint %q at %s:%d running %s: expected %v",
+				test.breakpoint, test.frame.name, test.frame.lineno, test.command, test.expect)
+		}
+	}
+}
+
+func TestScratchCopy(t *testing.T) {
+	fp, err := os.Open("../test/sample1.fi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	repo, err := ReadStream(fp, "sample1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	properties := newOrderedMap()
+	properties.set("svn:log", "original")
+	repo.markToEvent(":2").(*Commit).properties = &properties
+	var before strings.Builder
+	repo.WriteStream(&before, nil)
+
+	sandbox, origins := repo.scratchCopy()
+	defer nuke(sandbox.basedir, "")
+	for _, commit := range sandbox.commits(nil) {
+		if origins[commit] == nil {
+			t.Errorf("%s has no original", commit.idMe())
+		}
+		for _, parent := range commit.parents() {
+			if p, ok := parent.(*Commit); ok && p.repo != sandbox {
+				t.Errorf("%s has a parent outside the copy", commit.idMe())
+			}
+		}
+	}
+	var copied strings.Builder
+	sandbox.WriteStream(&copied, nil)
+	assertEqual(t, copied.String(), before.String())
+
+	// Alter the copy; the original must not change.
+	commit := sandbox.markToEvent(":2").(*Commit)
+	commit.fileops[0].Path = "READ.ME"
+	commit.properties.set("svn:log", "altered")
+	child := sandbox.markToEvent(":4").(*Commit)
+	child.setParents(nil)
+	sandbox.events = sandbox.events[1:]
+	var after strings.Builder
+	repo.WriteStream(&after, nil)
+	assertEqual(t, after.String(), before.String())
+	assertEqual(t, properties.get("svn:log"), "original")
+
+	var report strings.Builder
+	reportChanges(&report, repo, sandbox, origins)
+	for _, expect := range []string{
+		"event 1 blob@:1: deleted\n",
+		"  - M 100644 :1 README\n",
+		"  + M 100644 :1 READ.ME\n",
+		"  parents [:2] -> []\n",
+	} {
+		if !strings.Contains(report.String(), expect) {
+			t.Errorf("report lacks %q:\n%s", expect, report.String())
+		}
+	}
+}
+
+func TestCompareRepositories(t *testing.T) {
+	// The streams stay open; blob content is read from them.
+	read := func(name string) *Repository {
+		fp, err := os.Open("../test/sample1.fi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { fp.Close() })
+		repo, err := ReadStream(fp, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	}
+	a, b := read("a"), read("b")
+	defer a.Close()
+	defer b.Close()
+
+	rc := compareRepositories(a, b, matchMethods)
+	assertIntEqual(t, len(rc.matched), len(a.commits(nil)))
+	var report strings.Builder
+	rc.report(&report)
+	assertEqual(t, report.String(), "18 commits matched (18 by action stamp), 0 only in a, 0 only in b\n")
+
+	// Tree matching pairs commits whatever their metadata.
+	b.markToEvent(":2").(*Commit).committer.email = "someone@example.com"
+	rc = compareRepositories(a, b, []string{"tree"})
+	if rc.matched[a.markToEvent(":2").(*Commit)] != b.markToEvent(":2").(*Commit) {
+		t.Error("root commits not paired by tree")
+	}
+	if changes := rc.commitChanges(a.markToEvent(":2").(*Commit), b.markToEvent(":2").(*Commit)); len(changes) != 1 || !strings.HasPrefix(changes[0], "committer:") {
+		t.Errorf("unexpected changes %v", changes)
+	}
+}
+
+func TestDiffSimilarity(t *testing.T) {
+	text := []byte("one\ntwo\nthree\nfour\n")
+	assertIntEqual(t, len(contentLines(text)), 4)
+	assertIntEqual(t, len(contentLines([]byte("no newline"))), 1)
+	assertIntEqual(t, similarity(text, text), 100)
+	assertIntEqual(t, similarity(text, []byte("one\ntwo\nthree\nfive\n")), 75)
+	assertIntEqual(t, similarity(text, []byte("something\nelse\nentirely\n")), 0)
+	// Binary files are alike only when identical.
+	assertIntEqual(t, similarity([]byte("a\x00b\n"), []byte("a\x00c\n")), 0)
+
+	d := &fileDelta{fromText: text, toText: []byte("one\n2\nthree\nfour\nfive\n")}
+	insertions, deletions := d.lineCounts()
+	assertIntEqual(t, insertions, 2)
+	assertIntEqual(t, deletions, 1)
+}
+
+func TestSourcePath(t *testing.T) {
+	repo := newRepository("test")
+	commit := newCommit(repo)
+	op := func(text string) *FileOp {
+		fileop := newFileOp(repo)
+		fileop.parse(text)
+		return fileop
+	}
+	commit.setOperations([]*FileOp{op("R a b"), op("M 100644 :1 c"), op("R b d")})
+	assertEqual(t, sourcePath(commit, "d"), "a")
+	assertEqual(t, sourcePath(commit, "c"), "c")
+	// A file deleted and recreated has no earlier name.
+	commit.setOperations([]*FileOp{op("R a b"), op("D b"), op("C x b")})
+	assertEqual(t, sourcePath(commit, "b"), "x")
+	commit.setOperations([]*FileOp{op("R a b"), op("deleteall"), op("M 100644 :1 b")})
+	assertEqual(t, sourcePath(commit, "b"), "b")
+}
+
+func TestPathHistory(t *testing.T) {
+	fp, err := os.Open("../test/pathhistory.fi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fp.Close() })
+	repo, err := ReadStream(fp, "pathhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	marks := func(path string) string {
+		hits, _ := repo.pathHistory(path)
+		var out []string
+		for _, i := range hits {
+			out = append(out, repo.events[i].getMark())
+		}
+		return strings.Join(out, " ")
+	}
+	// Through the rename to the copy, and through the copy to the original.
+	assertEqual(t, marks("guide.txt"), ":3 :5 :6 :10 :12 :15")
+	assertEqual(t, marks("notes.txt"), ":3 :5 :8 :9")
+	assertEqual(t, marks("nosuch.txt"), "")
+	// A file that already existed is not a copy, whatever its blob.
+	commit := repo.markToEvent(":5").(*Commit)
+	assertIntEqual(t, len(commit.copySources(commit.fileops[0])), 0)
+}
+
+func TestCopySources(t *testing.T) {
+	stream := `blob
+mark :1
+data 0
+
+blob
+mark :2
+data 7
+shared
+
+commit refs/heads/master
+mark :3
+committer Ann Arbor <ann@example.com> 1600000000 +0000
+data 6
+Start.
+M 100644 :1 a/empty
+M 100644 :2 a/x.txt
+M 100644 :2 b/y.txt
+
+commit refs/heads/master
+mark :4
+committer Ann Arbor <ann@example.com> 1600000100 +0000
+data 7
+Copies.
+from :3
+M 100644 :1 c/empty
+M 100644 :2 c/y.txt
+C a/x.txt e/x.txt
+M 100644 :2 e/x.txt
+
+`
+	repo, err := ReadStream(strings.NewReader(stream), "copies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	commit := repo.markToEvent(":4").(*Commit)
+	sources := func(path string) string {
+		for _, op := range commit.operations() {
+			if op.op == opM && op.Path == path {
+				return strings.Join(commit.copySources(op), " ")
+			}
+		}
+		t.Fatalf("no modify op for %s", path)
+		return ""
+	}
+	// An empty blob matches nothing.
+	assertEqual(t, sources("c/empty"), "")
+	// Of two paths with the blob, the one with the same basename wins.
+	assertEqual(t, sources("c/y.txt"), "b/y.txt")
+	// A copy op names the source; content is not consulted.
+	assertEqual(t, sources("e/x.txt"), "")
+}
+
+func TestInferRenames(t *testing.T) {
+	fp, err := os.Open("../test/renames.fi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fp.Close() })
+	repo, err := ReadStream(fp, "renames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	commit := repo.markToEvent(":10").(*Commit)
+	assertIntEqual(t, len(commit.inferRenames(100, false)), 1)
+	found := commit.inferRenames(80, true)
+	assertIntEqual(t, len(found), 4)
+	// Rewriting the fileops must leave the tree as it was.
+	before := commit.treeHash()
+	commit.applyInferences(found)
+	assertEqual(t, commit.treeHash(), before)
+	assertIntEqual(t, len(commit.inferRenames(80, true)), 0)
+	// Commits with a deleteall are left alone.
+	assertIntEqual(t, len(repo.markToEvent(":14").(*Commit).inferRenames(1, true)), 0)
+}
+
+func TestCarveOps(t *testing.T) {
+	repo := newRepository("test")
+	commit := newCommit(repo)
+	op := func(text string) *FileOp {
+		fileop := newFileOp(repo)
+		fileop.parse(text)
+		return fileop
+	}
+	dump := func(ops []*FileOp) string {
+		var out []string
+		for _, op := range ops {
+			out = append(out, strings.TrimSuffix(op.String(), "\n"))
+		}
+		return strings.Join(out, "|")
+	}
+	commit.setOperations([]*FileOp{op("M 100644 :1 lib/a"), op("M 100644 :2 app/b"),
+		op("D lib/c"), op("R lib/d lib/e"), op("R lib/f app/f"), op("C lib/g app/g")})
+	assertEqual(t, dump(carveOps(commit, commit, "lib/")), `M 100644 :1 a|D c|R "d" "e"|D f`)
+	// Removing the subdirectory, or a directory above it, empties the tree.
+	commit.setOperations([]*FileOp{op("D src"), op("D srclib/x")})
+	assertEqual(t, dump(carveOps(commit, commit, "src/lib/")), "deleteall")
+}
+
+func TestNamespaceRef(t *testing.T) {
+	assertEqual(t, namespaceRef("refs/heads/topic", "lib"), "refs/heads/lib/topic")
+	assertEqual(t, namespaceRef("refs/tags/v1.0", "lib"), "refs/tags/lib/v1.0")
+	assertEqual(t, namespaceRef("refs/heads/feature/x", "lib"), "refs/heads/lib/feature/x")
+	assertEqual(t, namespaceRef("HEAD", "lib"), "HEAD")
+}
+
+func TestDropDirOps(t *testing.T) {
+	repo := newRepository("test")
+	commit := newCommit(repo)
+	op := func(text string) *FileOp {
+		fileop := newFileOp(repo)
+		fileop.parse(text)
+		return fileop
+	}
+	dump := func(ops []*FileOp) string {
+		var out []string
+		for _, op := range ops {
+			out = append(out, strings.TrimSuffix(op.String(), "\n"))
+		}
+		return strings.Join(out, "|")
+	}
+	commit.setOperations([]*FileOp{op("M 100644 :1 lib/a"), op("M 100644 :2 app/b"),
+		op("D lib"), op("R lib/d lib/e"), op("R app/f lib/f"), op("C app/g lib/g"), op("D libx/h")})
+	assertEqual(t, dump(dropDirOps(commit, "lib/")), "M 100644 :2 app/b|D app/f|D libx/h")
+}
+
+func TestReplayOps(t *testing.T) {
+	fp, err := os.Open("../test/replay.fi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fp.Close() })
+	repo, err := ReadStream(fp, "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	commit := func(mark string) *Commit {
+		return repo.markToEvent(mark).(*Commit)
+	}
+	dump := func(ops []*FileOp) string {
+		var out []string
+		for _, op := range ops {
+			out = append(out, strings.TrimSuffix(op.String(), "\n"))
+		}
+		return strings.Join(out, "|")
+	}
+	// A rename comes out as a deletion and an addition.
+	onto := repo.commitByRef("master")
+	fileops, conflicts := replayOps([]*Commit{commit(":7"), commit(":9")}, onto, false)
+	assertIntEqual(t, len(conflicts), 0)
+	assertEqual(t, dump(fileops[commit(":7")]), "M 100644 :6 b")
+	assertEqual(t, dump(fileops[commit(":9")]), "D b|M 100644 :8 c|M 100644 :6 d")
+	// Both sides changed alpha.
+	fileops, conflicts = replayOps([]*Commit{commit(":11")}, onto, false)
+	assertIntEqual(t, len(conflicts), 1)
+	assertEqual(t, conflicts[0].path, "a")
+	assertEqual(t, dump(fileops[commit(":11")]), "")
+	_, conflicts = replayOps([]*Commit{commit(":11")}, commit(":9"), false)
+	assertIntEqual(t, len(conflicts), 0)
+	if repo.commitByRef(":1") != nil || repo.commitByRef("nosuch") != nil {
+		t.Error("commitByRef resolved something that is not a commit")
+	}
+}
+
+func TestApplyHunks(t *testing.T) {
+	diff := "Fix it.\n\n--- a/f.txt\n+++ b/f.txt\n@@ -2,2 +2,2 @@\n b\n-c\n+C\n@@ -5 +5,2 @@\n e\n+f\n\\ No newline at end of file\n"
+	preamble, files, err := parseDiff(diff, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, preamble, "Fix it.\n\n")
+	assertIntEqual(t, len(files), 1)
+	assertEqual(t, files[0].oldPath, "f.txt")
+	assertIntEqual(t, len(files[0].hunks), 2)
+	// Both hunks apply one line lower than they say.
+	out, err := applyHunks([]byte("top\na\nb\nc\nd\ne\n"), files[0].hunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(out), "top\na\nb\nC\nd\ne\nf")
+	if _, err := applyHunks([]byte("a\nb\nx\n"), files[0].hunks); err == nil {
+		t.Error("hunk applied to text it does not match")
+	}
+	// Lines of a message body that began with From are unquoted.
+	messages := splitMbox([]byte("From x\nSubject: a\n\n>From here\n\nFrom y\nSubject: b\n\nbody\n"))
+	assertIntEqual(t, len(messages), 2)
+	assertEqual(t, string(messages[0]), "Subject: a\n\nFrom here\n\n")
+}
+
+func TestWriteHunks(t *testing.T) {
+	before := []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n")
+	after := []byte("a\nB\nc\nd\ne\nf\ng\nh\ni\nj")
+	var buf bytes.Buffer
+	writeHunks(&buf, before, after)
+	assertEqual(t, buf.String(), "@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n@@ -7,4 +7,4 @@\n g\n h\n i\n-j\n+j\n\\ No newline at end of file\n")
+	// What is written applies back to give the new text.
+	_, files, err := parseDiff("--- a/f\n+++ b/f\n"+buf.String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := applyHunks(before, files[0].hunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(out), string(after))
+	assertEqual(t, mboxQuote("From here\n>From there\nFrom\n"), ">From here\n>>From there\nFrom\n")
+}
+
+func TestChangelogReleases(t *testing.T) {
+	fp, err := os.Open("../test/mkchangelog.fi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fp.Close() })
+	repo, err := ReadStream(fp, "mkchangelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	releases := changelogReleases(repo.commits(repo.all()))
+	assertIntEqual(t, len(releases), 2)
+	// The tag's leading v is dropped.
+	assertEqual(t, releases[0].version, "1.0")
+	assertIntEqual(t, len(releases[0].commits), 2)
+	assertEqual(t, releases[1].version, "")
+	assertIntEqual(t, len(releases[1].commits), 2)
+	var buf bytes.Buffer
+	writeMarkdownChangelog(&buf, releases[:1], "")
+	assertEqual(t, buf.String(), "## 1.0 (2020-09-13)\n\n- Start. (Ann Arbor)\n- Change alpha. (Ann Arbor)\n\n")
+	// An unreleased Debian entry follows on from the last release.
+	assertEqual(t, debianUnreleased(releases, ""), "1.0+git")
+	assertEqual(t, debianUnreleased(releases, "1.1~rc1"), "1.1~rc1")
+	assertEqual(t, debianUnreleased(releases[1:], ""), "")
+}
+
+func TestRecoverGitSvnIDs(t *testing.T) {
+	stream := `blob
+mark :1
+data 6
+hello
+
+commit refs/heads/master
+#legacy-id 7
+mark :2
+committer Ann Arbor <ann@example.com> 1600000000 +0000
+data 52
+Start.
+
+git-svn-id: https://svn.example.org/trunk@2
+M 100644 :1 README
+
+`
+	repo, err := ReadStream(strings.NewReader(stream), "gitsvn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	commit := repo.markToEvent(":2").(*Commit)
+	assertIntEqual(t, len(repo.legacyMap), 1)
+	repo.recoverGitSvnIDs(false)
+	// A trailer without a UUID is recognized, and the legacy ID it
+	// replaces no longer leads to the commit.
+	assertEqual(t, commit.legacyID, "2")
+	assertIntEqual(t, len(repo.legacyMap), 1)
+	assertBool(t, repo.legacyMap["SVN:2"] == commit, true)
+}
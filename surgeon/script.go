@@ -0,0 +1,693 @@
+/*
+ * Script interpretation
+ *
+ * A script is read in full and split into statements before anything
+ * runs, so that control-flow constructs can be matched up front and
+ * loop bodies re-executed. A statement is one logical line, with any
+ * backslash continuations joined, plus the body of a here-document or
+ * of a multi-line macro definition when it introduces one.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	shlex "github.com/anmitsu/go-shlex"
+)
+
+// scriptStatement is one logical line of a script.
+type scriptStatement struct {
+	lineno     int      // Physical line the statement ends on
+	text       string   // Command text, trimmed
+	heredoc    []string // Here-document body, if any, newlines included
+	hasHeredoc bool
+	block      []string // Body of a multi-line define, if any
+	hasBlock   bool
+	keyword    string // if, else, end, or for; empty for commands
+	elseIdx    int    // For if: index of matching else, or -1
+	endIdx     int    // For if, else, for: index of matching end
+}
+
+// scriptKeywords are the control-flow words recognized in scripts.
+var scriptKeywords = map[string]bool{"if": true, "else": true, "end": true, "for": true}
+
+// scriptKeyword returns the control-flow word a line begins with, or ""
+// if it is a command. Only lines of the right shape count - else and
+// end alone, if with a condition, for with a variable and a source -
+// so that others beginning with those words are left to be commands.
+func scriptKeyword(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !scriptKeywords[fields[0]] {
+		return ""
+	}
+	switch fields[0] {
+	case "else", "end":
+		if len(fields) > 1 {
+			return ""
+		}
+	case "if":
+		if len(fields) < 2 {
+			return ""
+		}
+	case "for":
+		if len(fields) < 3 {
+			return ""
+		}
+	}
+	return fields[0]
+}
+
+// scriptError is a problem found at a particular line of a script.
+type scriptError struct {
+	lineno  int
+	message string
+}
+
+func (e *scriptError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.lineno, e.message)
+}
+
+// parseScript splits script text into statements and matches up
+// control-flow constructs. Errors carry the offending line number.
+func parseScript(r io.Reader) ([]scriptStatement, error) {
+	stmts := splitScript(r)
+	if errs := matchBlocks(stmts); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return stmts, nil
+}
+
+// splitScript splits script text into statements.
+func splitScript(r io.Reader) []scriptStatement {
+	script := bufio.NewReader(r)
+	stmts := make([]scriptStatement, 0)
+	lineno := 0
+	for {
+		scriptline, err := script.ReadString('\n')
+		lineno++
+		if err == io.EOF && scriptline == "" {
+			break
+		}
+		// Handle multiline commands
+		for strings.HasSuffix(scriptline, "\\\n") {
+			nexterline, err := script.ReadString('\n')
+			if err == io.EOF && nexterline == "" {
+				break
+			}
+			lineno++
+			scriptline = scriptline[:len(scriptline)-2] + nexterline
+		}
+		stmt := scriptStatement{text: strings.TrimSpace(scriptline), elseIdx: -1, endIdx: -1}
+
+		// Simulate shell here-document processing
+		if strings.Contains(stmt.text, "<<") {
+			stmt.hasHeredoc = true
+			terminator := strings.Split(stmt.text, "<<")[1] + "\n"
+			for {
+				nextline, err := script.ReadString('\n')
+				if (err == io.EOF && nextline == "") || nextline == terminator {
+					break
+				}
+				stmt.heredoc = append(stmt.heredoc, nextline)
+				lineno++
+			}
+		} else if strings.HasPrefix(stmt.text, "define") && strings.HasSuffix(stmt.text, "{") {
+			// Collect the macro body the same way define would
+			// read it, so it is not mistaken for script text.
+			stmt.hasBlock = true
+			depth := 0
+			for {
+				nextline, err := script.ReadString('\n')
+				if err == io.EOF && nextline == "" {
+					break
+				}
+				lineno++
+				line := strings.TrimSpace(nextline)
+				if depth == 0 && strings.HasPrefix(line, "}") {
+					break
+				} else if strings.HasPrefix(line, "define") && strings.HasSuffix(line, "{") {
+					depth++
+				} else if strings.HasPrefix(line, "}") && depth > 0 {
+					depth--
+				}
+				stmt.block = append(stmt.block, line)
+			}
+		}
+		stmt.keyword = scriptKeyword(stmt.text)
+		stmt.lineno = lineno
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// matchBlocks matches up control-flow constructs, returning an error
+// for each that does not match.
+func matchBlocks(stmts []scriptStatement) []*scriptError {
+	errs := make([]*scriptError, 0)
+	stack := make([]int, 0)
+	for i := range stmts {
+		switch stmts[i].keyword {
+		case "if", "for":
+			stack = append(stack, i)
+		case "else":
+			if len(stack) == 0 || stmts[stack[len(stack)-1]].keyword != "if" ||
+				stmts[stack[len(stack)-1]].elseIdx != -1 {
+				errs = append(errs, &scriptError{stmts[i].lineno, "else without matching if"})
+				continue
+			}
+			stmts[stack[len(stack)-1]].elseIdx = i
+		case "end":
+			if len(stack) == 0 {
+				errs = append(errs, &scriptError{stmts[i].lineno, "end without matching if or for"})
+				continue
+			}
+			opener := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			stmts[opener].endIdx = i
+			if e := stmts[opener].elseIdx; e != -1 {
+				stmts[e].endIdx = i
+			}
+		}
+	}
+	for _, i := range stack {
+		errs = append(errs, &scriptError{stmts[i].lineno, stmts[i].keyword + " without matching end"})
+	}
+	return errs
+}
+
+//
+// Script variables
+//
+
+var variableNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var variableRefRE = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// pidRefRE matches $$, and $${ so that it can be left alone.
+var pidRefRE = regexp.MustCompile(`\$\$\{?`)
+
+// lookupVariable finds a variable, searching from the innermost script outward.
+func (rs *Reposurgeon) lookupVariable(name string) (string, bool) {
+	for i := len(rs.scopes) - 1; i >= 0; i-- {
+		if value, ok := rs.scopes[i][name]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// setVariable binds a variable in the innermost scope.
+func (rs *Reposurgeon) setVariable(name string, value string) {
+	rs.scopes[len(rs.scopes)-1][name] = value
+}
+
+// expandVariables replaces ${name} references with variable values.
+// A reference to an unset variable is left as it is, so that text for
+// a shell or a message passes through; $${ stands for a literal ${.
+func (rs *Reposurgeon) expandVariables(line string) string {
+	return variableRefRE.ReplaceAllStringFunc(line, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		if value, ok := rs.lookupVariable(ref[2 : len(ref)-1]); ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// selectionMembers evaluates a selection expression against the
+// chosen repository, returning 1-origin event numbers.
+func (rs *Reposurgeon) selectionMembers(expr string) []string {
+	repo := rs.chosen()
+	if repo == nil {
+		panic(throw("command", "no repo has been chosen"))
+	}
+	members := make([]string, 0)
+	if strings.TrimSpace(expr) == "" {
+		return members
+	}
+	machine, rest := rs.parseSelectionSet(expr + " ")
+	if strings.TrimSpace(rest) != "" {
+		panic(throw("command", "junk after selection expression: %s", strings.TrimSpace(rest)))
+	}
+	for _, ei := range rs.evalSelectionSet(machine, repo) {
+		members = append(members, strconv.Itoa(ei+1))
+	}
+	return members
+}
+
+// evalCondition decides an if statement's condition: either a string
+// comparison with == or !=, or a selection expression that is true
+// when nonempty. A leading "not" inverts either form.
+func (rs *Reposurgeon) evalCondition(cond string) bool {
+	negate := false
+	cond = strings.TrimSpace(cond)
+	if strings.HasPrefix(cond, "not ") {
+		negate = true
+		cond = strings.TrimSpace(cond[4:])
+	}
+	var result bool
+	words, err := shlex.Split(cond, true)
+	if err == nil && len(words) == 3 && (words[1] == "==" || words[1] == "!=") {
+		result = (words[0] == words[2]) == (words[1] == "==")
+	} else {
+		result = len(rs.selectionMembers(cond)) > 0
+	}
+	return result != negate
+}
+
+// loopValues computes the values a for statement iterates over. The
+// forms are "NAME in WORD...", "NAME over SELECTION", "NAME branches"
+// and "NAME tags".
+func (rs *Reposurgeon) loopValues(header string) (string, []string) {
+	fields := strings.Fields(header)
+	if len(fields) < 2 || !variableNameRE.MatchString(fields[0]) {
+		panic(throw("command", "for requires a variable name and a source"))
+	}
+	name := fields[0]
+	rest := strings.TrimSpace(strings.TrimSpace(header)[len(name):])
+	rest = strings.TrimSpace(rest[len(fields[1]):])
+	switch fields[1] {
+	case "in":
+		words, err := shlex.Split(rest, true)
+		if err != nil {
+			panic(throw("command", "for word list parse failed, %s", err))
+		}
+		return name, words
+	case "over":
+		return name, rs.selectionMembers(rest)
+	case "branches", "tags":
+		repo := rs.chosen()
+		if repo == nil {
+			panic(throw("command", "no repo has been chosen"))
+		}
+		values := make([]string, 0)
+		if fields[1] == "branches" {
+			for _, branch := range repo.branchset() {
+				if strings.HasPrefix(branch, "refs/heads/") {
+					values = append(values, branch[len("refs/heads/"):])
+				}
+			}
+		} else {
+			for _, event := range repo.events {
+				if tag, ok := event.(*Tag); ok {
+					values = append(values, strings.TrimPrefix(tag.name, "refs/tags/"))
+				}
+			}
+		}
+		sort.Strings(values)
+		return name, values
+	}
+	panic(throw("command", "unknown for form %q", fields[1]))
+}
+
+//
+// Script execution
+//
+
+// scriptRun is the state of one script invocation.
+type scriptRun struct {
+	fname string
+	stmts []scriptStatement
+}
+
+// substitute applies positional, process-ID and variable substitution.
+func (rs *Reposurgeon) substitute(line string) string {
+	for i, v := range rs.callstack[len(rs.callstack)-1] {
+		ref := "$" + strconv.FormatInt(int64(i), 10)
+		line = strings.Replace(line, ref, v, -1)
+	}
+	pid := strconv.FormatInt(int64(os.Getpid()), 10)
+	line = pidRefRE.ReplaceAllStringFunc(line, func(ref string) string {
+		if ref == "$$" {
+			return pid
+		}
+		return ref
+	})
+	return rs.expandVariables(line)
+}
+
+// runStatements executes statements lo through hi-1, returning true
+// if the session should stop. An abort unwinds every level.
+func (rs *Reposurgeon) runStatements(ctx context.Context, run *scriptRun, lo int, hi int) (stop bool) {
+	for pc := lo; pc < hi; {
+		stmt := run.stmts[pc]
+		next := pc + 1
+		switch stmt.keyword {
+		case "if":
+			var cond bool
+			if rs.guard(stmt, func() { cond = rs.evalCondition(rs.substitute(stmt.text[2:])) }) {
+				return false
+			}
+			if cond {
+				end := stmt.endIdx
+				if stmt.elseIdx != -1 {
+					end = stmt.elseIdx
+				}
+				stop = rs.runStatements(ctx, run, pc+1, end)
+			} else if stmt.elseIdx != -1 {
+				stop = rs.runStatements(ctx, run, stmt.elseIdx+1, stmt.endIdx)
+			}
+			next = stmt.endIdx + 1
+		case "else":
+			// Only reached by falling off the end of a true branch.
+			next = stmt.endIdx + 1
+		case "end":
+		case "for":
+			var name string
+			var values []string
+			if rs.guard(stmt, func() { name, values = rs.loopValues(rs.substitute(stmt.text[3:])) }) {
+				return false
+			}
+			old, bound := rs.scopes[len(rs.scopes)-1][name]
+			for _, value := range values {
+				rs.setVariable(name, value)
+				if stop = rs.runStatements(ctx, run, pc+1, stmt.endIdx); stop || control.getAbort() {
+					break
+				}
+			}
+			if bound {
+				rs.setVariable(name, old)
+			} else {
+				delete(rs.scopes[len(rs.scopes)-1], name)
+			}
+			next = stmt.endIdx + 1
+		default:
+			stop = rs.runCommand(ctx, run, stmt)
+		}
+		if control.getAbort() || stop {
+			return stop
+		}
+		pc = next
+	}
+	return false
+}
+
+// guard runs a control-statement action, turning a thrown error into
+// a script abort reported against the statement's line.
+func (rs *Reposurgeon) guard(stmt scriptStatement, action func()) (aborted bool) {
+	defer func() {
+		if e := catch("command", recover()); e != nil {
+			croak(e.message)
+			rs.reportAbort(stmt.lineno, stmt.text)
+			aborted = true
+		}
+	}()
+	action()
+	return false
+}
+
+// reportAbort says where a script stopped.
+func (rs *Reposurgeon) reportAbort(lineno int, line string) {
+	if line != "" {
+		logit(logSHOUT, "script abort on line %d %q", lineno, line)
+	} else {
+		logit(logSHOUT, "script abort on line %d", lineno)
+	}
+}
+
+// runCommand executes one ordinary script statement.
+func (rs *Reposurgeon) runCommand(ctx context.Context, run *scriptRun, stmt scriptStatement) (stop bool) {
+	interpreter := rs.cmd
+	scriptline := stmt.text
+	if rs.guard(stmt, func() { scriptline = rs.substitute(scriptline) }) {
+		return false
+	}
+	if rs.debugStop(ctx, stmt.lineno, scriptline) {
+		croak("script abandoned from the debugger")
+		rs.reportAbort(stmt.lineno, scriptline)
+		return false
+	}
+	if stmt.hasHeredoc {
+		heredoc, err := ioutil.TempFile("", "reposurgeon-")
+		if err != nil {
+			croak("script failure on '%s': %s", run.fname, err)
+			return false
+		}
+		defer os.Remove(heredoc.Name())
+		for _, line := range stmt.heredoc {
+			if _, err := fmt.Fprint(heredoc, line); err != nil {
+				croak("script failure on '%s': %s", run.fname, err)
+				return false
+			}
+		}
+		heredoc.Close()
+		// Note: the command must accept < redirection!
+		scriptline = strings.Split(scriptline, "<<")[0] + "<" + heredoc.Name()
+	}
+
+	// if the script wants to define a macro, the input
+	// for the macro has to come from the script file
+	existingStdin := rs.cmd.GetStdin()
+	if stmt.hasBlock {
+		body := strings.Join(append(stmt.block, "}"), "\n") + "\n"
+		rs.cmd.SetStdin(ioutil.NopCloser(strings.NewReader(body)))
+	}
+
+	// finally we execute the command, plus the before/after steps
+	originalline := scriptline
+	scriptline = interpreter.PreCmd(ctx, scriptline)
+	stop = interpreter.OneCmd(ctx, scriptline)
+	stop = interpreter.PostCmd(ctx, stop, scriptline)
+
+	// and then we have to put the stdin back where it
+	// was, in case we changed it
+	rs.cmd.SetStdin(existingStdin)
+
+	// Abort flag is set by croak() and signals.
+	// When it is set, we abort out of every nested
+	// script call.
+	if control.getAbort() {
+		rs.reportAbort(stmt.lineno, originalline)
+	}
+	return stop
+}
+
+//
+// Assertions
+//
+
+// countComparisons are the relations a count check accepts.
+var countComparisons = map[string]func(a, b int) bool{
+	"==": func(a, b int) bool { return a == b },
+	"!=": func(a, b int) bool { return a != b },
+	"<":  func(a, b int) bool { return a < b },
+	"<=": func(a, b int) bool { return a <= b },
+	">":  func(a, b int) bool { return a > b },
+	">=": func(a, b int) bool { return a >= b },
+}
+
+// refExists tells whether the repository has a branch or tag of the
+// given name, which may be short or a full ref.
+func (repo *Repository) refExists(kind string, name string) bool {
+	prefix := "refs/heads/"
+	if kind == "tag" {
+		prefix = "refs/tags/"
+	}
+	if !strings.HasPrefix(name, "refs/") {
+		name = prefix + name
+	}
+	if kind == "branch" {
+		return repo.branchset().Contains(name)
+	}
+	for _, event := range repo.events {
+		switch e := event.(type) {
+		case *Tag:
+			if "refs/tags/"+strings.TrimPrefix(e.name, "refs/tags/") == name {
+				return true
+			}
+		case *Reset:
+			if e.ref == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkAssertion evaluates the check described by text against the
+// selection. It returns a description of the first failure, or the
+// empty string if the check holds. A malformed check throws.
+func (rs *Reposurgeon) checkAssertion(selection []int, text string) string {
+	words, err := shlex.Split(text, true)
+	if err != nil {
+		panic(throw("command", "check parse failed, %s", err))
+	}
+	negate := len(words) > 0 && words[0] == "not"
+	if negate {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		panic(throw("command", "no check specified"))
+	}
+	repo := rs.chosen()
+	kind, args := words[0], words[1:]
+	switch kind {
+	case "count":
+		op := "=="
+		if len(args) == 2 {
+			op, args = args[0], args[1:]
+		}
+		compare, ok := countComparisons[op]
+		if !ok || len(args) != 1 || negate {
+			panic(throw("command", "count takes an optional comparison and a number"))
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			panic(throw("command", "count needs a number, not %q", args[0]))
+		}
+		if !compare(len(selection), n) {
+			return fmt.Sprintf("selection has %d events, expected %s %d", len(selection), op, n)
+		}
+		return ""
+	case "branch", "tag":
+		if len(args) != 1 {
+			panic(throw("command", "%s takes one name", kind))
+		}
+		if exists := repo.refExists(kind, args[0]); exists == negate {
+			if exists {
+				return fmt.Sprintf("%s %s exists", kind, args[0])
+			}
+			return fmt.Sprintf("no %s named %s", kind, args[0])
+		}
+		return ""
+	case "path", "manifest", "author", "committer", "treehash":
+		checked := 0
+		for _, ei := range selection {
+			commit, ok := repo.events[ei].(*Commit)
+			if !ok {
+				continue
+			}
+			checked++
+			if msg := checkCommit(commit, kind, args, negate); msg != "" {
+				return fmt.Sprintf("event %d: %s", ei+1, msg)
+			}
+		}
+		if checked == 0 {
+			panic(throw("command", "%s check needs a selection containing commits", kind))
+		}
+		return ""
+	}
+	panic(throw("command", "unknown check %q", kind))
+}
+
+// checkCommit evaluates a check on the content or metadata of one commit.
+func checkCommit(commit *Commit, kind string, args []string, negate bool) string {
+	switch kind {
+	case "path":
+		if len(args) == 0 {
+			panic(throw("command", "path takes one or more paths"))
+		}
+		for _, pathname := range args {
+			if _, present := commit.manifest().get(pathname); present == negate {
+				if present {
+					return fmt.Sprintf("%s is present", pathname)
+				}
+				return fmt.Sprintf("%s is not present", pathname)
+			}
+		}
+	case "manifest":
+		expected := newOrderedStringSet(args...)
+		actual := newOrderedStringSet(commit.manifest().pathnames()...)
+		missing := expected.Subtract(actual)
+		extra := actual.Subtract(expected)
+		matches := len(missing) == 0 && len(extra) == 0
+		if matches && negate {
+			return "manifest matches"
+		} else if !matches && !negate {
+			sort.Strings(missing)
+			sort.Strings(extra)
+			problems := make([]string, 0, 2)
+			if len(missing) > 0 {
+				problems = append(problems, "lacks "+strings.Join(missing, ", "))
+			}
+			if len(extra) > 0 {
+				problems = append(problems, "has unexpected "+strings.Join(extra, ", "))
+			}
+			return "manifest " + strings.Join(problems, "; ")
+		}
+	case "author", "committer":
+		if len(args) != 2 {
+			panic(throw("command", "%s takes a field and a value", kind))
+		}
+		attr := &commit.committer
+		if kind == "author" && len(commit.authors) > 0 {
+			attr = &commit.authors[0]
+		}
+		var actual string
+		var holds bool
+		switch args[0] {
+		case "name":
+			actual = attr.fullname
+			holds = actual == args[1]
+		case "email":
+			actual = attr.email
+			holds = actual == args[1]
+		case "date":
+			expected, err := newDate(args[1])
+			if err != nil {
+				panic(throw("command", "malformed date %q", args[1]))
+			}
+			actual = attr.date.rfc3339()
+			holds = attr.date.Equal(expected)
+		default:
+			panic(throw("command", "%s field must be name, email or date", kind))
+		}
+		if holds == negate {
+			if negate {
+				return fmt.Sprintf("%s %s is %q", kind, args[0], actual)
+			}
+			return fmt.Sprintf("%s %s is %q, expected %q", kind, args[0], actual, args[1])
+		}
+	case "treehash":
+		if len(args) != 1 || len(args[0]) < 4 {
+			panic(throw("command", "treehash takes a hash of at least four hex digits"))
+		}
+		actual := commit.treeHash()
+		if strings.HasPrefix(actual, strings.ToLower(args[0])) == negate {
+			return fmt.Sprintf("tree hash is %s", actual)
+		}
+	}
+	return ""
+}
+
+// assertion runs an assert or expect command. A failed assert croaks,
+// so it ends a script unless relax is set; a failed expect is
+// reported and counted, and the enclosing script fails when it ends.
+func (rs *Reposurgeon) assertion(verb string, line string) {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen")
+		return
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = rs.chosen().all()
+	}
+	defer func() {
+		if e := catch("command", recover()); e != nil {
+			croak("%s: %s", verb, e.message)
+		}
+	}()
+	msg := rs.checkAssertion(selection, strings.TrimSpace(line))
+	if msg == "" {
+		return
+	}
+	if verb == "assert" {
+		croak("assertion failed: %s", msg)
+	} else {
+		rs.expectFails++
+		control.baton.printLogString("reposurgeon: expectation failed: " + msg + "\n")
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * JSON-RPC server mode
+ *
+ * Lets another program drive a long-lived interpreter session by
+ * exchanging JSON-RPC 2.0 messages, one per line, over stdin/stdout
+ * or a Unix-domain socket. Command output that would have gone to the
+ * terminal is captured and returned in the result; failures come back
+ * as error objects whose codes follow the exception class; progress
+ * reports from the baton are sent as notifications while a command
+ * runs.
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package surgeon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// Error codes. The first four are fixed by the JSON-RPC specification;
+// the rest are in its implementation-defined server error range.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcFailed         = -32000
+)
+
+// rpcClassCodes maps exception classes to error codes.
+var rpcClassCodes = map[string]int{
+	"command":   -32001,
+	"parse":     -32002,
+	"extractor": -32003,
+	"extract":   -32003,
+	"msgbox":    -32004,
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcConn serializes messages to one client; the baton goroutine
+// writes progress notifications concurrently with responses.
+type rpcConn struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (conn *rpcConn) send(msg interface{}) {
+	text, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	conn.w.Write(append(text, '\n'))
+}
+
+// rpcFailure builds an error object from an exception.
+func rpcFailure(e *exception, output string) *rpcError {
+	code, ok := rpcClassCodes[e.class]
+	if !ok {
+		code = rpcFailed
+	}
+	return &rpcError{
+		Code:    code,
+		Message: e.message,
+		Data:    map[string]string{"class": e.class, "output": output},
+	}
+}
+
+// serve answers requests read from r until end of input or a
+// shutdown request, and reports whether the session should end.
+func (rs *Reposurgeon) serve(ctx context.Context, r io.Reader, w io.Writer) bool {
+	conn := &rpcConn{w: w}
+	var captured bytes.Buffer
+	oldStream := control.baton.setStream(&captured)
+	defer control.baton.setStream(oldStream)
+	// Kommandant writes some messages, such as help listings, itself,
+	// through readline if that is on.
+	if rs.cmd != nil {
+		if rs.cmd.ReadlineEnabled() {
+			rs.cmd.EnableReadline(false)
+			defer rs.cmd.EnableReadline(true)
+		}
+		oldStdout := rs.cmd.GetStdout()
+		rs.cmd.SetStdout(&captured)
+		defer rs.cmd.SetStdout(oldStdout)
+	}
+	control.baton.setProgressFunc(func(msg string) {
+		conn.send(rpcNotification{"2.0", "progress", map[string]string{"message": msg}})
+	})
+	defer control.baton.setProgressFunc(nil)
+	control.baton.setInteractivity(true)
+	defer control.baton.setInteractivity(control.flagOptions["interactive"])
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			conn.send(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"),
+				Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			conn.send(rpcResponse{JSONRPC: "2.0", ID: rpcID(req.ID),
+				Error: &rpcError{Code: rpcInvalidRequest, Message: "not a JSON-RPC 2.0 request"}})
+			continue
+		}
+		captured.Reset()
+		result, rerr, stop := rs.dispatch(ctx, req, &captured)
+		// Requests without an id are notifications and get no answer.
+		if req.ID != nil {
+			if rerr != nil {
+				conn.send(rpcResponse{JSONRPC: "2.0", ID: req.ID, Error: rerr})
+			} else {
+				conn.send(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result})
+			}
+		}
+		if stop {
+			return true
+		}
+	}
+	return false
+}
+
+func rpcID(id json.RawMessage) json.RawMessage {
+	if id == nil {
+		return json.RawMessage("null")
+	}
+	return id
+}
+
+// dispatch carries out one request.
+func (rs *Reposurgeon) dispatch(ctx context.Context, req rpcRequest, captured *bytes.Buffer) (interface{}, *rpcError, bool) {
+	var params struct {
+		Line       string `json:"line"`
+		Expression string `json:"expression"`
+	}
+	if req.Params != nil {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}, false
+		}
+	}
+	switch req.Method {
+	case "command":
+		stop, e := rs.execute(ctx, params.Line)
+		control.baton.Sync()
+		if e != nil {
+			return nil, rpcFailure(e, captured.String()), false
+		}
+		return map[string]interface{}{"output": captured.String(), "stop": stop}, nil, stop
+	case "select":
+		if rs.chosen() == nil {
+			return nil, rpcFailure(throw("command", "no repo has been chosen"), ""), false
+		}
+		selection, err := (&Session{rs}).Select(params.Expression)
+		if err != nil {
+			e, ok := err.(*exception)
+			if !ok {
+				e = throw("command", "%s", err)
+			}
+			return nil, rpcFailure(e, ""), false
+		}
+		events := make([]int, len(selection))
+		for i, ei := range selection {
+			events[i] = ei + 1
+		}
+		return map[string]interface{}{"events": events}, nil, false
+	case "repositories":
+		chosen := ""
+		if rs.chosen() != nil {
+			chosen = rs.chosen().name
+		}
+		return map[string]interface{}{"chosen": chosen, "names": rs.reponames()}, nil, false
+	case "shutdown":
+		return map[string]interface{}{}, nil, true
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "no such method as " + req.Method}, false
+}
+
+// listen serves clients connecting to a Unix-domain socket, one at a
+// time, until one of them asks for shutdown.
+func (rs *Reposurgeon) listen(ctx context.Context, path string) error {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		stop := rs.serve(ctx, conn, conn)
+		conn.Close()
+		if stop {
+			return nil
+		}
+	}
+}
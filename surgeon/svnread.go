@@ -25,12 +25,14 @@
 
 // SPDX-License-Identifier: BSD-2-Clause
 
-package main
+package surgeon
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
@@ -42,6 +44,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 	"unsafe" // Actually safe - only uses Sizeof
 )
 
@@ -68,6 +71,10 @@ type svnReader struct {
 	// of branch deletions since the commit recreating the branch is also root)
 	// Filled in LinkFixups
 	branchRoots map[string][]*Commit
+	// Revision-property disposition rules from --revprops, and the
+	// notes text they generated, keyed by the commit it annotates.
+	revpropRules []revpropRule
+	revpropNotes map[*Commit]string
 }
 
 // Helpers for branch analysis
@@ -93,15 +100,139 @@ func trimSep(s string) string {
 	return s
 }
 
-// isDeclaredBranch returns true iff the user requested that this path be treated as a branch or tag.
-func isDeclaredBranch(path string) bool {
+// revisionScope is the revision range over which a branchify or branchmap
+// entry applies. A zero bound is open.
+type revisionScope struct {
+	lo revidx
+	hi revidx
+}
+
+func (s revisionScope) contains(rev revidx) bool {
+	return (s.lo == 0 || rev >= s.lo) && (s.hi == 0 || rev <= s.hi)
+}
+
+func (s revisionScope) String() string {
+	if s.lo == 0 && s.hi == 0 {
+		return ""
+	} else if s.lo == s.hi {
+		return fmt.Sprintf("@%d", s.lo)
+	}
+	out := "@"
+	if s.lo != 0 {
+		out += fmt.Sprintf("%d", s.lo)
+	}
+	out += "-"
+	if s.hi != 0 {
+		out += fmt.Sprintf("%d", s.hi)
+	}
+	return out
+}
+
+var revisionScopeRE = regexp.MustCompile(`^([0-9]*)-([0-9]*)$|^([0-9]+)$`)
+
+// parseRevisionScope interprets a range qualifier of the form N-M, N-, -M
+// or N, as found after the @ in a scoped branchify or branchmap entry.
+func parseRevisionScope(spec string) (revisionScope, error) {
+	var scope revisionScope
+	m := revisionScopeRE.FindStringSubmatch(spec)
+	if m == nil || spec == "-" {
+		return scope, fmt.Errorf("ill-formed revision range %q", spec)
+	}
+	bound := func(s string) (revidx, error) {
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("bad revision in range %q: %v", spec, err)
+		}
+		if n > int(^revidx(0)) {
+			return 0, fmt.Errorf("revision %s in range %q is too large", s, spec)
+		}
+		return revidx(n), nil
+	}
+	var err error
+	if m[3] != "" {
+		if scope.lo, err = bound(m[3]); err != nil {
+			return scope, err
+		}
+		scope.hi = scope.lo
+	} else {
+		if scope.lo, err = bound(m[1]); err != nil {
+			return scope, err
+		}
+		if scope.hi, err = bound(m[2]); err != nil {
+			return scope, err
+		}
+	}
+	if scope.hi != 0 && scope.lo > scope.hi {
+		return scope, fmt.Errorf("revision range %q is backwards", spec)
+	}
+	return scope, nil
+}
+
+// splitBranchifyEntry separates a branchify entry into its path and the
+// scope over which it applies.  Text after the last @ is a scope only if
+// it is made of digits and hyphens; otherwise the @ belongs to the path.
+// Entries without a scope apply to every revision.
+func splitBranchifyEntry(entry string) (string, revisionScope, error) {
+	at := strings.LastIndex(entry, "@")
+	if at == -1 || strings.Trim(entry[at+1:], "0123456789-") != "" {
+		return entry, revisionScope{}, nil
+	}
+	scope, err := parseRevisionScope(entry[at+1:])
+	return entry[:at], scope, err
+}
+
+// branchifyEntry is a branchify entry split into its path and scope.
+type branchifyEntry struct {
+	path  string
+	scope revisionScope
+}
+
+// setBranchify installs a branchify list, parsing its entries once so
+// that branch tests during a read need not. A malformed entry is
+// reported and leaves the list in force unchanged.
+func setBranchify(entries orderedStringSet) error {
+	parsed := make([]branchifyEntry, len(entries))
+	for i, entry := range entries {
+		path, scope, err := splitBranchifyEntry(entry)
+		if err != nil {
+			return fmt.Errorf("branchify entry %s: %s", entry, err)
+		}
+		parsed[i] = branchifyEntry{path, scope}
+	}
+	control.listOptions["svn_branchify"] = entries
+	control.branchify = parsed
+	return nil
+}
+
+// isDeclaredBranch returns true iff the user requested that this path be
+// treated as a branch or tag at the given revision.
+func isDeclaredBranch(path string, rev revidx) bool {
+	return declaredBranch(path, rev, false)
+}
+
+// isScopedBranch is isDeclaredBranch considering only the entries that
+// carry a revision range.  The handling of layout changes is confined
+// to branches declared this way, so reads without scoped entries are
+// not affected by it.
+func isScopedBranch(path string, rev revidx) bool {
+	return declaredBranch(path, rev, true)
+}
+
+func declaredBranch(path string, rev revidx, scopedOnly bool) bool {
 	if path == "" {
 		return false
 	}
 	np := trimSep(path)
 	maybeBranch := false
 	isNamespace := false
-	for _, trial := range control.listOptions["svn_branchify"] {
+	for _, entry := range control.branchify {
+		trial, scope := entry.path, entry.scope
+		if !scope.contains(rev) || (scopedOnly && scope == revisionScope{}) {
+			continue
+		}
 		if trial == "*" {
 			// Replace it by rvnSepWithStar so that the next test will
 			// trim it to "", which is what containingDir() returns for
@@ -124,8 +255,8 @@ func isDeclaredBranch(path string) bool {
 	return maybeBranch && !isNamespace
 }
 
-// splitSVNBranchPath splits a node path into the part that identifies the branch and the rest, as determined by the current branch map
-func splitSVNBranchPath(path string) (string, string) {
+// splitSVNBranchPath splits a node path into the part that identifies the branch and the rest, as determined by the current branch map at the given revision
+func splitSVNBranchPath(path string, rev revidx) (string, string) {
 	candidate := path
 	for {
 		split := strings.LastIndex(candidate, svnSep)
@@ -133,7 +264,7 @@ func splitSVNBranchPath(path string) (string, string) {
 			return "", path
 		}
 		candidate = path[:split]
-		if isDeclaredBranch(candidate) {
+		if isDeclaredBranch(candidate, rev) {
 			return candidate, path[split+1:]
 		}
 	}
@@ -351,6 +482,13 @@ func appendRevisionRecords(slice []RevisionRecord, data ...RevisionRecord) []Rev
 }
 
 func (sp *StreamParser) parseSubversion(ctx context.Context, options *stringSet, baton *Baton, filesize int64) {
+	sp.readSubversion(ctx, options, baton, filesize)
+	sp.svnProcess(ctx, *options, baton)
+}
+
+// readSubversion performs phase 1, deserializing the dump into revision
+// records without doing any analysis on them.
+func (sp *StreamParser) readSubversion(ctx context.Context, options *stringSet, baton *Baton, filesize int64) {
 	defer trace.StartRegion(ctx, "SVN phase 1: read dump file").End()
 	sp.revisions = make([]RevisionRecord, 0)
 	sp.hashmap = make(map[string]*NodeAction)
@@ -570,7 +708,6 @@ func (sp *StreamParser) parseSubversion(ctx context.Context, options *stringSet,
 	}
 	logit(logSVNPARSE, "revision parsing, line %d: ends with %d records", sp.importLine, sp.repo.legacyCount)
 	sp.timeMark("parsing")
-	sp.svnProcess(ctx, *options, baton)
 }
 
 const maxRevidx = int(^revidx(0)) // Use for bounds-checking in range loops.
@@ -702,6 +839,115 @@ func newRevisionRecord(nodes []*NodeAction, props OrderedMap, revision revidx) *
 	return rr
 }
 
+// revpropRule says what to do with Subversion revision properties whose
+// names match a glob pattern.
+type revpropRule struct {
+	pattern     string
+	disposition string // trailer, note, property, or drop
+	name        string // Name to use in gitspace; empty means derive it
+}
+
+var revpropDispositions = orderedStringSet{"trailer", "note", "property", "drop"}
+
+// readRevpropRules parses a revision-property rule file. Each line is
+// a glob pattern, a disposition, and an optional gitspace name; blank
+// lines and lines beginning with # are ignored.
+func readRevpropRules(fp io.Reader) ([]revpropRule, error) {
+	rules := make([]revpropRule, 0)
+	scanner := bufio.NewScanner(fp)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected pattern, disposition and optional name", lineno)
+		}
+		if _, err := filepath.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("line %d: bad pattern %q", lineno, fields[0])
+		}
+		if !revpropDispositions.Contains(fields[1]) {
+			return nil, fmt.Errorf("line %d: unknown disposition %q", lineno, fields[1])
+		}
+		rule := revpropRule{pattern: fields[0], disposition: fields[1]}
+		if len(fields) == 3 {
+			rule.name = fields[2]
+		}
+		if rule.disposition == "trailer" && rule.name != "" && !trailerRE.MatchString(rule.name+": ") {
+			return nil, fmt.Errorf("line %d: %q is not a valid trailer name", lineno, rule.name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// trailerName derives a trailer key from a property name by capitalizing
+// its alphanumeric runs and joining them with hyphens, so that
+// bugtraq:number becomes Bugtraq-Number.
+func trailerName(prop string) string {
+	parts := strings.FieldsFunc(prop, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+	for i, part := range parts {
+		parts[i] = strings.ToUpper(part[:1]) + part[1:]
+	}
+	return strings.Join(parts, "-")
+}
+
+// applyRevpropRules disposes of the revision properties left over after
+// log, author and date have been extracted, according to the rules.
+func (sp *StreamParser) applyRevpropRules(commit *Commit, props *OrderedMap, warned stringSet) {
+	trailers := make([]string, 0)
+	var note strings.Builder
+	for _, key := range props.keys {
+		value := props.get(key)
+		var rule *revpropRule
+		for i := range sp.revpropRules {
+			if ok, _ := filepath.Match(sp.revpropRules[i].pattern, key); ok {
+				rule = &sp.revpropRules[i]
+				break
+			}
+		}
+		if rule == nil {
+			if !warned.Contains(key) {
+				logit(logWARN, "revision property %s has no --revprops rule and is discarded", key)
+				warned.Add(key)
+			}
+			continue
+		}
+		name := rule.name
+		switch rule.disposition {
+		case "trailer":
+			if name == "" {
+				name = trailerName(key)
+			}
+			folded := strings.Replace(strings.TrimSpace(value), "\n", "\n ", -1)
+			trailers = append(trailers, name+": "+folded)
+		case "note":
+			if name == "" {
+				name = key
+			}
+			note.WriteString(name + ": " + strings.TrimRight(value, "\n") + "\n")
+		case "property":
+			if name == "" {
+				name = key
+			}
+			if commit.properties == nil {
+				newprops := newOrderedMap()
+				commit.properties = &newprops
+			}
+			commit.properties.set(name, value)
+		}
+	}
+	commit.Comment = appendTrailers(commit.Comment, trailers...)
+	if note.Len() > 0 {
+		sp.revpropNotes[commit] = note.String()
+	}
+}
+
 func walkRevisions(revs []RevisionRecord, hook func(int, *RevisionRecord)) {
 	if control.flagOptions["serial"] {
 		for i := range revs {
@@ -910,8 +1156,12 @@ func (sp *StreamParser) svnProcess(ctx context.Context, options stringSet, baton
 	timeit("dejunk")
 	svnProcessDebubble(ctx, sp, options, baton)
 	timeit("debubbling")
+	svnProcessGitSvnIDs(ctx, sp, options, baton)
+	timeit("git-svn-ids")
 	svnProcessRenumber(ctx, sp, options, baton)
 	timeit("renumbering")
+	svnProcessNotes(ctx, sp, options, baton)
+	timeit("notes")
 
 	// Treat this in-core state as though it was read from an SVN repo
 	sp.repo.hint("svn", "", true)
@@ -1089,7 +1339,7 @@ func svnExpandCopies(ctx context.Context, sp *StreamParser, options stringSet, b
 				// that are taken in all cases.  The reason we suppress expansion on a declared branch is that
 				// we are later going to turn this directory delete into a git deleteall for the branch.
 				if node.action == sdDELETE || node.action == sdREPLACE {
-					if !nobranch && isDeclaredBranch(node.path) {
+					if !nobranch && isDeclaredBranch(node.path, node.revision) {
 						logit(logEXTRACT, "r%d-%d~%s: declaring as sdNUKE", node.revision, node.index, node.path)
 						node.action = sdNUKE
 					} else {
@@ -1097,7 +1347,28 @@ func svnExpandCopies(ctx context.Context, sp *StreamParser, options stringSet, b
 						// can occur if the directory is empty.
 						// We can just ignore that case. Otherwise...
 						if node.fromSet != nil {
+							nuked := newStringSet()
 							node.fromSet.iter(func(child string, _ interface{}) {
+								// Branches inside the deleted directory,
+								// as when a whole namespace goes away
+								// in a layout change, are deleted as
+								// branches rather than file by file.
+								if !nobranch {
+									branch, _ := splitSVNBranchPath(child, node.revision)
+									if branch != "" && strings.HasPrefix(branch+svnSep, node.path) && isScopedBranch(branch, node.revision) {
+										if !nuked.Contains(branch) {
+											nuked.Add(branch)
+											logit(logEXTRACT, "r%d-%d~%s: declaring %s as sdNUKE", node.revision, node.index, node.path, branch)
+											newnode := new(NodeAction)
+											newnode.path = branch + svnSep
+											newnode.revision = node.revision
+											newnode.action = sdNUKE
+											newnode.kind = sdDIR
+											appendExpanded(newnode)
+										}
+										return
+									}
+								}
 								logit(logEXTRACT, "r%d-%d~%s: deleting %s", node.revision, node.index, node.path, child)
 								newnode := new(NodeAction)
 								newnode.path = child
@@ -1112,7 +1383,7 @@ func svnExpandCopies(ctx context.Context, sp *StreamParser, options stringSet, b
 				// Handle directory copies.
 				if node.isCopy() {
 					copyType := "directory"
-					if isDeclaredBranch(node.path) && isDeclaredBranch(node.fromPath) {
+					if isDeclaredBranch(node.path, node.revision) && isDeclaredBranch(node.fromPath, node.fromRev) {
 						copyType = "branch"
 					}
 					logit(logEXTRACT, "r%d-%d: %s copy to %s from r%d~%s",
@@ -1209,8 +1480,28 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 	// Revisions with no nodes are skipped here. This guarantees
 	// being able to assign them to a branch later.
 	//
+	// Revision properties other than log, author and date are
+	// discarded unless a --revprops rule file says what to do
+	// with them.
+	//
 	defer trace.StartRegion(ctx, "SVN Phase 5: build commits").End()
 	logit(logEXTRACT, "SVN Phase 5: build commits")
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--revprops=") {
+			rulefile := option[len("--revprops="):]
+			fp, err := os.Open(rulefile)
+			if err != nil {
+				panic(throw("parse", "can't open revprop rule file %s: %v", rulefile, err))
+			}
+			sp.revpropRules, err = readRevpropRules(fp)
+			fp.Close()
+			if err != nil {
+				panic(throw("parse", "in revprop rule file %s, %v", rulefile, err))
+			}
+			sp.revpropNotes = make(map[*Commit]string)
+		}
+	}
+	warned := newStringSet()
 	baton.startProgress("SVN phase 5: build commits", uint64(len(sp.revisions)))
 
 	var lastcommit *Commit
@@ -1273,7 +1564,10 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 			commit.committer.date.timestamp = time.Unix(int64(ri*360), 0)
 			commit.committer.date.setTZ("UTC")
 		}
-		if record.props.Len() > 0 {
+		if sp.revpropRules != nil {
+			sp.applyRevpropRules(commit, &record.props, warned)
+			record.props.Clear()
+		} else if record.props.Len() > 0 {
 			commit.properties = &record.props
 			record.props.Clear()
 		}
@@ -1442,10 +1736,10 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 			tooMany := false
 			for _, node := range record.nodes {
 				var branch string
-				if node.kind == sdDIR && isDeclaredBranch(node.path) {
+				if node.kind == sdDIR && isDeclaredBranch(node.path, node.revision) {
 					branch = node.path
 				} else {
-					branch, _ = splitSVNBranchPath(node.path)
+					branch, _ = splitSVNBranchPath(node.path, node.revision)
 				}
 				if branch != "" && foundbranch != "" && branch != foundbranch {
 					tooMany = true
@@ -1526,6 +1820,7 @@ func svnSplitResolve(ctx context.Context, sp *StreamParser, options stringSet, b
 		if commit, ok := event.(*Commit); ok {
 			var oldbranch string
 			cliqueIndices := make([]int, 0)
+			revision, _ := strconv.Atoi(commit.legacyID)
 			// We only generated M and D ops, or special deleteall
 			// ops with their path set, therefore every
 			// fileop has a Path member.  Wacky hack: by stashing
@@ -1533,7 +1828,7 @@ func svnSplitResolve(ctx context.Context, sp *StreamParser, options stringSet, b
 			// nembers, we avoid having to recompute these when we
 			// actually have to use tem
 			for j, fileop := range commit.fileops {
-				commit.fileops[j].Source, commit.fileops[j].Target = splitSVNBranchPath(fileop.Path)
+				commit.fileops[j].Source, commit.fileops[j].Target = splitSVNBranchPath(fileop.Path, revidx(revision))
 				if j == 0 || commit.fileops[j].Source != oldbranch {
 					cliqueIndices = append([]int{j}, cliqueIndices...)
 					oldbranch = commit.fileops[j].Source
@@ -1618,13 +1913,13 @@ func svnProcessBranches(ctx context.Context, sp *StreamParser, options stringSet
 				}
 				// Contiguity assumption
 				node := sp.revisions[n].nodes[0]
-				if node.kind == sdDIR && isDeclaredBranch(node.path) {
+				if node.kind == sdDIR && isDeclaredBranch(node.path, node.revision) {
 					commit.Branch = node.path
 					if strings.HasSuffix(commit.Branch, svnSep) {
 						commit.Branch = commit.Branch[:len(commit.Branch)-1]
 					}
 				} else {
-					commit.Branch, _ = splitSVNBranchPath(node.path)
+					commit.Branch, _ = splitSVNBranchPath(node.path, node.revision)
 				}
 			} else {
 				// Normal case
@@ -1641,7 +1936,11 @@ func svnProcessBranches(ctx context.Context, sp *StreamParser, options stringSet
 			sp.markToSVNBranch[commit.mark] = commit.Branch
 			maplock.Unlock()
 			matched := false
+			revision, _ := strconv.Atoi(strings.Split(commit.legacyID, ".")[0])
 			for _, item := range control.branchMappings {
+				if !item.scope.contains(revidx(revision)) {
+					continue
+				}
 				result := GoReplacer(item.match, commit.Branch+svnSep, item.replace)
 				if result != commit.Branch+svnSep {
 					matched = true
@@ -1737,6 +2036,7 @@ func svnDisambiguateRefs(ctx context.Context, sp *StreamParser, options stringSe
 	// For each branch, iterate through commits with that branch, searching for
 	// deleteall-only commits that mean the branch is being deleted.
 	usedRefs := map[string]int{}
+	moves := make([]*Commit, 0)
 	processed := 0
 	seen := 0
 	baton.startProgress("SVN phase 8c: disambiguate deleted refs.", uint64(commitCount))
@@ -1745,6 +2045,20 @@ func svnDisambiguateRefs(ctx context.Context, sp *StreamParser, options stringSe
 		for i, commit := range commits {
 			ops := commit.operations()
 			if len(ops) > 0 && ops[len(ops)-1].op == deleteall {
+				// If the same revision recreates this ref from a
+				// different Subversion directory, the layout changed
+				// under the branch rather than the branch being
+				// deleted.  Keep its history on the ref.
+				if successor := movedBranch(sp, commits, i); successor != nil {
+					logit(logTAGFIX, "r%s (%s): %s moved to %s, keeping ref %s.",
+						commit.legacyID, commit.mark,
+						sp.markToSVNBranch[commit.mark],
+						sp.markToSVNBranch[successor.mark], branch)
+					moves = append(moves, commit)
+					seen++
+					baton.percentProgress(uint64(seen) + 1)
+					continue
+				}
 				// Fix the branch of all the previous commits whose branch has
 				// not yet been fixed.
 				if !strings.HasPrefix(branch, "refs/") {
@@ -1771,6 +2085,51 @@ func svnDisambiguateRefs(ctx context.Context, sp *StreamParser, options stringSe
 	}
 	logit(logTAGFIX, "%d deleted refs were put away.", processed)
 	baton.endProgress()
+	// The deleteall commits left behind by layout moves would clobber
+	// the content of the ref they continue; drop them.  Parent links
+	// are recomputed in the next phase, so nothing else needs fixing.
+	if len(moves) > 0 {
+		deletia := newOrderedIntSet()
+		for _, commit := range moves {
+			commit.setOperations(nil)
+			delete(sp.repo.legacyMap, "SVN:"+commit.legacyID)
+			deletia.Add(sp.repo.eventToIndex(commit))
+		}
+		sp.repo.delete(deletia, nil)
+	}
+}
+
+// movedBranch returns the commit that recreates the ref of commits[i], a
+// branch deletion, from a different Subversion directory in the same
+// revision, or nil if there is none.  Only moves to or from a branch
+// declared by a scoped branchify entry count.
+func movedBranch(sp *StreamParser, commits []*Commit, i int) *Commit {
+	revision := strings.Split(commits[i].legacyID, ".")[0]
+	svnbranch := sp.markToSVNBranch[commits[i].mark]
+	n, err := strconv.Atoi(revision)
+	if err != nil {
+		return nil
+	}
+	rev := intToRevidx(n)
+	// Commits are in event order, so the other parts of a split
+	// revision on the same ref are adjacent to this one.
+	for _, step := range []int{-1, 1} {
+		for j := i + step; j >= 0 && j < len(commits); j += step {
+			if strings.Split(commits[j].legacyID, ".")[0] != revision {
+				break
+			}
+			successor := sp.markToSVNBranch[commits[j].mark]
+			if successor == svnbranch {
+				continue
+			}
+			// The old directory's entry may end just before the move.
+			if isScopedBranch(svnbranch, rev-1) || isScopedBranch(successor, rev) {
+				return commits[j]
+			}
+			return nil
+		}
+	}
+	return nil
 }
 
 func svnLinkFixups(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
@@ -1907,12 +2266,28 @@ func svnLinkFixups(ctx context.Context, sp *StreamParser, options stringSet, bat
 			if rev > 0 && rev < len(sp.revisions) {
 				record := sp.revisions[rev]
 				for _, node := range record.nodes {
-					if node.kind == sdDIR && node.fromRev != 0 &&
-						trimSep(node.path) == branch {
-						frombranch := node.fromPath
-						if !isDeclaredBranch(frombranch) {
-							frombranch, _ = splitSVNBranchPath(node.fromPath)
+					if node.kind != sdDIR || node.fromRev == 0 {
+						baton.twirl()
+						continue
+					}
+					var frombranch string
+					if trimSep(node.path) == branch {
+						frombranch = node.fromPath
+						if !isDeclaredBranch(frombranch, node.fromRev) {
+							frombranch, _ = splitSVNBranchPath(node.fromPath, node.fromRev)
 						}
+					} else if strings.HasPrefix(branch, node.path) {
+						// A copy of a directory containing the branch,
+						// as when a whole namespace is moved in a layout
+						// change. The branch came from the corresponding
+						// directory under the copy source.
+						frombranch = node.fromPath + branch[len(node.path):]
+						if !isDeclaredBranch(frombranch, node.fromRev) {
+							baton.twirl()
+							continue
+						}
+					}
+					if frombranch != "" {
 						parent := lastRelevantCommit(sp, node.fromRev, frombranch)
 						if parent != nil {
 							logit(logTOPOLOGY,
@@ -1940,14 +2315,14 @@ func svnLinkFixups(ctx context.Context, sp *StreamParser, options stringSet, bat
 					// file nodes (maybe expanded from a dir copy). If the
 					// branch dir creation node had a fromRev it would have
 					// been catched by the normal logic above.
-					destbranch, _ := splitSVNBranchPath(trimSep(node.path))
+					destbranch, _ := splitSVNBranchPath(trimSep(node.path), node.revision)
 					if node.kind == sdFILE && node.action == sdADD && destbranch == branch &&
 						!strings.HasSuffix(node.path, ".gitignore") {
 						if node.fromRev == 0 {
 							maxfrom = 0
 							break
 						}
-						newfrom, _ := splitSVNBranchPath(trimSep(node.fromPath))
+						newfrom, _ := splitSVNBranchPath(trimSep(node.fromPath), node.fromRev)
 						if frombranch == "" {
 							frombranch = newfrom
 						} else if frombranch != newfrom {
@@ -2143,7 +2518,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 			// corresponding to the revision on the branch whose
 			// mergeinfo has been modified
 			branch := trimSep(node.path)
-			if !isDeclaredBranch(branch) {
+			if !isDeclaredBranch(branch, revidx(revision)) {
 				continue
 			}
 			commit := lastRelevantCommit(sp, revidx(revision), branch)
@@ -2176,7 +2551,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 			for fromPath, revs := range newMerges {
 				baton.twirl()
 				fromPath = trimSep(fromPath)
-				if !isDeclaredBranch(fromPath) {
+				if len(revs) == 0 || !isDeclaredBranch(fromPath, revidx(revs[len(revs)-1].max)) {
 					continue
 				}
 				// Ranges were unified when parsing if they were
@@ -2448,7 +2823,7 @@ func svnProcessIgnores(ctx context.Context, sp *StreamParser, options stringSet,
 			}
 			path := filepath.Join(trimSep(node.path), ".gitignore")
 			branch := ""
-			branch, path = splitSVNBranchPath(path)
+			branch, path = splitSVNBranchPath(path, revidx(revision))
 			if branch != mybranch {
 				continue
 			}
@@ -2461,7 +2836,7 @@ func svnProcessIgnores(ctx context.Context, sp *StreamParser, options stringSet,
 				newvalue = node.props.get("svn:ignore")
 			}
 			if node.action == sdDELETE {
-				_, dirpath := splitSVNBranchPath(node.path)
+				_, dirpath := splitSVNBranchPath(node.path, revidx(revision))
 				// Also remove all subdirectory .gitignores
 				currentIgnores.iter(func(childPath string, _ interface{}) {
 					if strings.HasPrefix(childPath, dirpath) {
@@ -2757,6 +3132,42 @@ func svnProcessDebubble(ctx context.Context, sp *StreamParser, options stringSet
 	baton.endProgress()
 }
 
+func svnProcessGitSvnIDs(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
+	// Phase D2:
+	// If asked to, append git-svn-style trailers to each surviving
+	// commit, giving the URL of its branch directory, its revision,
+	// and the repository UUID.  Done late so tagified commits don't
+	// get one, but before renumbering so commits can still be mapped
+	// to their Subversion branches.
+	var baseURL string
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--git-svn-id=") {
+			baseURL = strings.TrimRight(option[len("--git-svn-id="):], "/")
+		}
+	}
+	if baseURL == "" {
+		return
+	}
+	defer trace.StartRegion(ctx, "SVN Phase D2: git-svn-id trailers").End()
+	logit(logEXTRACT, "SVN Phase D2: git-svn-id trailers")
+	baton.startProgress("SVN phase D2: git-svn-id trailers", uint64(len(sp.repo.events)))
+	walkEvents(sp.repo.events, func(idx int, event Event) {
+		if commit, ok := event.(*Commit); ok && commit.legacyID != "" {
+			url := baseURL
+			if branch := sp.markToSVNBranch[commit.mark]; branch != "" {
+				url += svnSep + branch
+			}
+			trailer := fmt.Sprintf("git-svn-id: %s@%s", url, strings.Split(commit.legacyID, ".")[0])
+			if sp.repo.uuid != "" {
+				trailer += " " + sp.repo.uuid
+			}
+			commit.Comment = appendTrailers(commit.Comment, trailer)
+		}
+		baton.percentProgress(uint64(idx) + 1)
+	})
+	baton.endProgress()
+}
+
 func svnProcessRenumber(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
 	// Phase E:
 	// Renumber all commits and add an end event.
@@ -2767,4 +3178,396 @@ func svnProcessRenumber(ctx context.Context, sp *StreamParser, options stringSet
 	//sp.repo.events = append(sp.repo.events, newPassthrough(sp.repo, "end\n"))
 }
 
+func svnProcessNotes(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
+	// Phase F:
+	// Attach the revision properties that --revprops rules sent to
+	// notes.  This has to wait until the commit set and marks are
+	// final, since notes refer to the commits they annotate by mark.
+	if len(sp.revpropNotes) == 0 {
+		return
+	}
+	defer trace.StartRegion(ctx, "SVN Phase F: revision property notes").End()
+	logit(logEXTRACT, "SVN Phase F: revision property notes")
+	notes := newCommit(sp.repo)
+	for _, event := range sp.repo.events {
+		if commit, ok := event.(*Commit); ok {
+			if text, ok := sp.revpropNotes[commit]; ok {
+				fileop := newFileOp(sp.repo)
+				fileop.construct(opN, "inline", commit.mark)
+				fileop.inline = []byte(text)
+				notes.appendOperation(fileop)
+				sp.repo.inlines++
+				notes.committer = commit.committer
+			}
+		}
+	}
+	if len(notes.operations()) == 0 {
+		return
+	}
+	notes.Comment = "Subversion revision properties\n"
+	notes.setBranch("refs/notes/commits")
+	notes.setMark(sp.repo.newmark())
+	sp.repo.addEvent(notes)
+	sp.repo.declareSequenceMutation("adding revision property notes")
+}
+
+// Layout analysis
+//
+// The layout command reads a dump with the same phase-1 parse used by
+// parseSubversion, then looks at the directory copies and deletions in
+// it to find the directories that behave like branch and tag roots.
+// None of the later phases are run, so this is cheap compared to a full
+// read, and its output is meant to help set up branchify and branchmap
+// before committing to one.
+
+// layoutRoot is a directory the layout analyzer believes to be a branch
+// or tag root.
+type layoutRoot struct {
+	path     string
+	fromPath string
+	fromRev  revidx
+	created  revidx
+	deleted  revidx // Zero while the root is live
+	nested   string // Enclosing root at creation time, if any
+	commits  int    // Later revisions touching content under the root
+}
+
+func (r *layoutRoot) liveAt(rev revidx) bool {
+	return r.created <= rev && (r.deleted == 0 || r.deleted > rev)
+}
+
+func (r *layoutRoot) overlaps(other *layoutRoot) bool {
+	return (other.deleted == 0 || r.created < other.deleted) &&
+		(r.deleted == 0 || other.created < r.deleted)
+}
+
+func (r *layoutRoot) trunklike() bool {
+	return r.path == "trunk" || strings.HasSuffix(r.path, svnSep+"trunk")
+}
+
+func (r *layoutRoot) kind() string {
+	namespace := filepath.Base(containingDir(r.path))
+	if r.trunklike() {
+		return "trunk"
+	} else if namespace == "tags" || (namespace != "branches" && r.commits == 0) {
+		return "tag"
+	}
+	return "branch"
+}
+
+// svnLayout is the result of a layout analysis.
+type svnLayout struct {
+	roots     []*layoutRoot
+	live      map[string]*layoutRoot
+	changes   []string
+	misplaced []string
+}
+
+// isStandardRoot says whether a directory created without a copy is
+// named like a branch or tag root in the standard layout.
+func isStandardRoot(path string) bool {
+	parent := filepath.Base(containingDir(path))
+	return filepath.Base(path) == "trunk" || parent == "branches" || parent == "tags"
+}
+
+// enclosingRoot returns the live root containing path, if any.
+func (l *svnLayout) enclosingRoot(path string) *layoutRoot {
+	for p := path; p != ""; p = containingDir(p) {
+		if r, ok := l.live[p]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// rootsAt returns the roots at or beneath dir that were live at rev.
+func (l *svnLayout) rootsAt(dir string, rev revidx) []*layoutRoot {
+	found := make([]*layoutRoot, 0)
+	for _, r := range l.roots {
+		if r.liveAt(rev) && (r.path == dir || strings.HasPrefix(r.path, dir+svnSep)) {
+			found = append(found, r)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].path < found[j].path })
+	return found
+}
+
+func (l *svnLayout) addRoot(path string, from *layoutRoot, fromRev revidx, rev revidx) *layoutRoot {
+	r := &layoutRoot{path: path, fromRev: fromRev, created: rev}
+	if from != nil {
+		r.fromPath = from.path
+	}
+	if outer := l.enclosingRoot(containingDir(path)); outer != nil {
+		r.nested = outer.path
+	}
+	l.roots = append(l.roots, r)
+	l.live[path] = r
+	return r
+}
+
+func newSvnLayout(revisions []RevisionRecord) *svnLayout {
+	l := new(svnLayout)
+	l.live = make(map[string]*layoutRoot)
+	for _, record := range revisions {
+		rev := record.revision
+		touched := make(map[*layoutRoot]bool)
+		deleted := newOrderedStringSet()
+		copies := make([][2]string, 0)
+		created := make([]*layoutRoot, 0)
+		lost := make([]*layoutRoot, 0)
+		for _, node := range record.nodes {
+			path := trimSep(node.path)
+			if node.action == sdDELETE || node.action == sdREPLACE {
+				deleted.Add(path)
+				for p, r := range l.live {
+					if p == path || strings.HasPrefix(p, path+svnSep) {
+						r.deleted = rev
+						delete(l.live, p)
+						lost = append(lost, r)
+					}
+				}
+			}
+			if node.kind == sdDIR && (node.action == sdADD || node.action == sdREPLACE) {
+				if node.isCopy() {
+					from := trimSep(node.fromPath)
+					sources := l.rootsAt(from, node.fromRev)
+					for _, src := range sources {
+						created = append(created,
+							l.addRoot(path+src.path[len(from):], src, node.fromRev, rev))
+					}
+					if len(sources) > 0 {
+						copies = append(copies, [2]string{from, path})
+						continue
+					}
+				} else if l.enclosingRoot(path) == nil && isStandardRoot(path) {
+					created = append(created, l.addRoot(path, nil, 0, rev))
+					continue
+				}
+			}
+			if r := l.enclosingRoot(path); r != nil && r.created != rev {
+				touched[r] = true
+			}
+		}
+		for r := range touched {
+			r.commits++
+		}
+
+		// A copy whose source went away in the same revision is a move.
+		movedFrom := newOrderedStringSet()
+		movedTo := newOrderedStringSet()
+		for _, pair := range copies {
+			for _, d := range deleted {
+				if pair[0] == d || strings.HasPrefix(pair[0], d+svnSep) {
+					l.changes = append(l.changes,
+						fmt.Sprintf("r%d: %s moved to %s", rev, pair[0], pair[1]))
+					movedFrom.Add(pair[0])
+					movedTo.Add(pair[1])
+					break
+				}
+			}
+		}
+		within := func(path string, dirs orderedStringSet) bool {
+			for _, d := range dirs {
+				if path == d || strings.HasPrefix(path, d+svnSep) {
+					return true
+				}
+			}
+			return false
+		}
+		// lost was filled from a map; sort it so reports are stable.
+		sort.Slice(lost, func(i, j int) bool { return lost[i].path < lost[j].path })
+		for _, r := range lost {
+			if r.trunklike() && !within(r.path, movedFrom) {
+				l.changes = append(l.changes, fmt.Sprintf("r%d: %s deleted", rev, r.path))
+			}
+		}
+		for _, r := range created {
+			if r.trunklike() && r.nested == "" && !within(r.path, movedTo) {
+				if r.fromPath == "" {
+					l.changes = append(l.changes, fmt.Sprintf("r%d: %s created", rev, r.path))
+				} else {
+					l.changes = append(l.changes,
+						fmt.Sprintf("r%d: %s copied from %s@r%d", rev, r.path, r.fromPath, r.fromRev))
+				}
+			}
+		}
+	}
+
+	namespaces := l.namespaces()
+	for _, r := range l.roots {
+		parent := containingDir(r.path)
+		if r.nested != "" {
+			l.misplaced = append(l.misplaced,
+				fmt.Sprintf("r%d: %s%s is nested inside %s", r.created, r.path, r.source(), r.nested))
+		} else if parent != "" && !r.trunklike() && namespaces[parent] == 0 {
+			l.misplaced = append(l.misplaced,
+				fmt.Sprintf("r%d: %s%s is outside any branch namespace", r.created, r.path, r.source()))
+		}
+	}
+	return l
+}
+
+func (r *layoutRoot) source() string {
+	if r.fromPath == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (copied from %s@r%d)", r.fromPath, r.fromRev)
+}
+
+// namespaces returns the directories that hold branch or tag roots,
+// with the number of distinct roots seen in each.
+func (l *svnLayout) namespaces() map[string]int {
+	seen := newStringSet()
+	ns := make(map[string]int)
+	for _, r := range l.roots {
+		if r.nested == "" && !r.trunklike() && !seen.Contains(r.path) {
+			seen.Add(r.path)
+			if parent := containingDir(r.path); parent != "" {
+				ns[parent]++
+			}
+		}
+	}
+	for parent, n := range ns {
+		base := filepath.Base(parent)
+		if n < 2 && base != "branches" && base != "tags" {
+			delete(ns, parent)
+		}
+	}
+	return ns
+}
+
+// suggestions returns branchify and branchmap arguments reproducing the
+// analyzed layout.
+func (l *svnLayout) suggestions() (orderedStringSet, orderedStringSet) {
+	namespaces := l.namespaces()
+	trunks := newOrderedStringSet()
+	others := newOrderedStringSet()
+	trunkRoots := make([]*layoutRoot, 0)
+	for _, r := range l.roots {
+		if r.nested != "" {
+			continue
+		} else if r.trunklike() {
+			trunks.Add(r.path)
+			trunkRoots = append(trunkRoots, r)
+		} else if namespaces[containingDir(r.path)] == 0 {
+			others.Add(r.path)
+		}
+	}
+	// If no two trunks were ever live at the same time, they are
+	// successive locations of one line of development.
+	singleLine := true
+	for i := range trunkRoots {
+		for j := i + 1; j < len(trunkRoots); j++ {
+			if trunkRoots[i].path != trunkRoots[j].path && trunkRoots[i].overlaps(trunkRoots[j]) {
+				singleLine = false
+			}
+		}
+	}
+	nslist := make([]string, 0, len(namespaces))
+	for ns := range namespaces {
+		nslist = append(nslist, ns)
+	}
+	sort.Strings(trunks)
+	sort.Strings(nslist)
+	sort.Strings(others)
+
+	branchify := newOrderedStringSet()
+	branchmap := newOrderedStringSet()
+	for _, trunk := range trunks {
+		branchify.Add(trunk)
+		prefix := containingDir(trunk)
+		if singleLine && trunk != "trunk" {
+			branchmap.Add(fmt.Sprintf("@^%s/$@heads/master@", regexp.QuoteMeta(trunk)))
+		} else if !singleLine && prefix != "" {
+			branchmap.Add(fmt.Sprintf("@^%s/$@heads/%s/master@", regexp.QuoteMeta(trunk), prefix))
+		}
+	}
+	for _, ns := range nslist {
+		branchify.Add(ns + svnSepWithStar)
+		prefix := containingDir(ns)
+		if prefix == "" {
+			continue
+		}
+		reftype := "heads"
+		if filepath.Base(ns) == "tags" {
+			reftype = "tags"
+		}
+		if singleLine {
+			branchmap.Add(fmt.Sprintf(`@^%s/([^/]+)/$@%s/\1@`, regexp.QuoteMeta(ns), reftype))
+		} else {
+			branchmap.Add(fmt.Sprintf(`@^%s/([^/]+)/$@%s/%s/\1@`, regexp.QuoteMeta(ns), reftype, prefix))
+		}
+	}
+	for _, other := range others {
+		branchify.Add(other)
+	}
+	return branchify, branchmap
+}
+
+// report writes a human-readable layout report, ending with lift-script
+// settings that can be pasted into a script.
+func (l *svnLayout) report(w io.Writer) {
+	plural := func(n int, what string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, what)
+		}
+		return fmt.Sprintf("%d %ss", n, what)
+	}
+	fmt.Fprintf(w, "Branch and tag roots:\n")
+	for _, r := range l.roots {
+		span := fmt.Sprintf("r%d-", r.created)
+		if r.deleted != 0 {
+			span += fmt.Sprintf("r%d", r.deleted)
+		}
+		fmt.Fprintf(w, "  %-32s %-10s %s, %s\n", r.path, span, r.kind(), plural(r.commits, "commit"))
+	}
+	namespaces := l.namespaces()
+	nslist := make([]string, 0, len(namespaces))
+	for ns := range namespaces {
+		nslist = append(nslist, ns)
+	}
+	sort.Strings(nslist)
+	fmt.Fprintf(w, "Branch namespaces:\n")
+	for _, ns := range nslist {
+		fmt.Fprintf(w, "  %-32s %s\n", ns, plural(namespaces[ns], "root"))
+	}
+	fmt.Fprintf(w, "Copy-from relationships:\n")
+	for _, r := range l.roots {
+		if r.fromPath != "" {
+			fmt.Fprintf(w, "  r%d: %s <- %s@r%d\n", r.created, r.path, r.fromPath, r.fromRev)
+		}
+	}
+	fmt.Fprintf(w, "Layout changes:\n")
+	for _, change := range l.changes {
+		fmt.Fprintf(w, "  %s\n", change)
+	}
+	fmt.Fprintf(w, "Possibly misplaced branches:\n")
+	for _, item := range l.misplaced {
+		fmt.Fprintf(w, "  %s\n", item)
+	}
+	branchify, branchmap := l.suggestions()
+	fmt.Fprintf(w, "# Suggested lift-script settings\n")
+	fmt.Fprintf(w, "branchify %s\n", strings.Join(branchify, " "))
+	if len(branchmap) > 0 {
+		fmt.Fprintf(w, "branchmap %s\n", strings.Join(branchmap, " "))
+	}
+}
+
+// analyzeLayout reads a Subversion dump and analyzes its directory layout.
+func (sp *StreamParser) analyzeLayout(ctx context.Context, fp io.Reader) *svnLayout {
+	var filesize int64
+	sp.fp = bufio.NewReader(fp)
+	if fileobj, ok := fp.(*os.File); ok && isfile(fileobj.Name()) {
+		sp.repo.seekstream = fileobj
+		filesize = getsize(fileobj.Name())
+	}
+	line := sp.readline()
+	if !bytes.HasPrefix(line, []byte("SVN-fs-dump-format-version: ")) {
+		sp.error("layout analysis requires a Subversion dump")
+	}
+	options := newStringSet()
+	sp.readSubversion(ctx, &options, control.baton, filesize)
+	return newSvnLayout(sp.revisions)
+}
+
 // end
@@ -0,0 +1,12 @@
+## test making commits from patches
+set testmode
+read <apply.fi
+# The first hunk applies one line lower than it says
+:6 apply <apply.mbox
+# A bare diff, with -p0 paths, onto a branch of its own
+:6 apply --strip=0 --branch=readme apply.diff
+# A bare diff whose headers are older than its parent keeps their date
+:6 apply --strip=0 --branch=early apply-early.diff
+write -
+# Content that does not match
+:6 apply apply-bad.diff
@@ -0,0 +1,34 @@
+## test assert and expect
+read <sample1.fi
+=C assert count 18
+=C assert count >= 10
+=T assert count < 5
+assert branch master
+assert branch refs/heads/master
+assert not branch nosuch
+assert tag annotated
+assert not tag nosuch
+:2 assert manifest README
+:4 assert path README .gitignore
+:4 assert not path hello
+:2 assert author name "Eric S. Raymond"
+:2 assert committer email esr@thyrsus.com
+:2 assert author date 2012-12-02T05:37:55Z
+:2 assert treehash 0610d020
+:2 assert not treehash 4b825dc642cb6eb9a060e54bf8d69288fbee4904
+# Every one of these fails, and all are reported
+expect count 3
+:4 expect manifest README hello
+:2 expect author email nobody@example.com
+:2 expect treehash 4b825dc6
+:2 expect not path README
+expect tag nosuch
+# Under relax a failed assertion or malformed check does not end the script
+set relax
+expect frobnicate
+expect count ~ 3
+:6 assert path hello
+clear relax
+print still running
+:6 assert path hello
+print not reached
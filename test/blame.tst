@@ -0,0 +1,7 @@
+## test line-level blame
+read <blame.fi
+# Lines come from both sides of a merge and across a rename
+:13 blame greek.txt
+# Before the rename
+:6 blame list.txt
+:13 blame nosuch.txt
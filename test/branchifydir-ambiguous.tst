@@ -0,0 +1,4 @@
+## test that branchifydir refuses an ambiguous source
+read <carve.fi
+:16 reset refs/tags/appwork create
+branchifydir lib library appwork
@@ -0,0 +1,8 @@
+## test turning a subdirectory into a branch
+read <carve.fi
+branchifydir --dry-run lib
+branchifydir lib library
+write -
+branchifydir --remove app
+write -
+branchifydir nosuch
@@ -0,0 +1,13 @@
+## test carving a subdirectory into its own repository
+read <carve.fi
+carve lib
+choose carve-lib
+write -
+# The original is untouched
+choose carve
+=C resolve
+# Empty commits as tags, and a name given
+carve --tagify lib/ library
+choose library
+tags
+carve nosuch
@@ -0,0 +1,5 @@
+## test static script checking
+check controlflow.tst assert.tst
+print clean scripts pass
+check checkscript.lift
+print not reached
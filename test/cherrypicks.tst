@@ -0,0 +1,7 @@
+## Test detection and annotation of cherry-picks between branches
+read <cherrypicks.svn
+cherrypicks
+cherrypicks annotate
+cherrypicks annotate
+prefer git
+<5>,<7> msgout
@@ -0,0 +1,46 @@
+## Test script control flow and variables
+read <deleteall.fi
+let greeting hello world
+print ${greeting}
+print literal $${greeting}
+for b branches
+  print branch ${b}
+  if <${b}> & /branch/c
+    print ${b} has a commit mentioning branch
+  else
+    print ${b} has no commit mentioning branch
+  end
+end
+for t tags
+  print tag ${t}
+end
+=C & /sample/ let samples
+print samples are ${samples}
+for e over ${samples}
+  ${e} list
+end
+let nothing
+if ${nothing}
+  print empty variable tested true
+else
+  print empty variable tested false
+end
+if not =T
+  print no tags
+else
+  print there are tags
+end
+for w in alpha "beta gamma" delta
+  if "${w}" != delta
+    print word ${w}
+  end
+end
+define show {
+print show sees ${greeting}, not $${greeting}
+}
+do show
+script controlflow2.tst inner
+print back in outer, greeting is ${greeting}
+let
+# An unset variable is left as it is
+print ${undefined} stays
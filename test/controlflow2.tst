@@ -0,0 +1,3 @@
+## Helper for controlflow.tst
+let greeting goodbye from $1
+print ${greeting}
@@ -0,0 +1,37 @@
+## test the script debugger
+read <sample1.fi
+define show {
+print showing {0}
+=T list
+}
+break debug.tst:25
+break show:2
+break tagify
+break 3
+break
+break <<EOF
+where
+list
+step
+:2 list
+frobnicate
+step
+next
+continue
+continue
+EOF
+print not stopped here
+1..3 tagify
+do show tags
+script controlflow2.tst nested
+unbreak tagify
+unbreak
+break
+1..3 tagify
+break <<EOF
+abort
+EOF
+break squash
+print still running
+1 squash
+print not reached
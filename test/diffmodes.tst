@@ -0,0 +1,15 @@
+## test diff output modes
+read <diffmodes.fi
+# One commit is compared with its first parent
+:10 diff
+:10 diff --name-status
+:10 diff --name-status --find-renames
+:10 diff --name-status --find-copies
+:10 diff --stat --find-copies
+:10 diff --find-copies
+# A root commit is compared with the empty tree
+:5 diff --stat
+# Limiting by path and by regexp
+:5,:10 diff --name-status README.md /\.(sh|bin)$/
+# Path limits apply to copies too
+:10 diff --name-status --find-copies README.md
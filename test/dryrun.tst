@@ -0,0 +1,23 @@
+## test dry runs of mutating commands
+read <sample1.fi
+:2 expunge --dry-run README
+:6 squash --dry-run
+:6 delete --dry-run --pushback
+:2,:4 path --dry-run README rename READ.ME
+# The repository is as it was
+=C assert count 18
+:2 assert path README
+:31 assert treehash e722433a
+# The flag makes the supported commands dry runs throughout
+set dryrun
+:6 squash
+read --dry-run <min.fi
+# Still working on sample1
+=C assert count 18
+# Reads are not affected
+read <min.fi
+=C assert count 2
+choose sample1
+clear dryrun
+:2 expunge README
+=C assert count 17
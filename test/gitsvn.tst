@@ -0,0 +1,5 @@
+## Test recovery of Subversion legacy IDs from git-svn-id trailers
+read <gitsvn.fi
+legacy git-svn --strip
+legacy write
+write -
@@ -0,0 +1,4 @@
+## Test generation of git-svn-id trailers on a Subversion read
+read --git-svn-id=https://svn.example.org/repo <cherry-pick.svn
+prefer git
+write -
@@ -0,0 +1,7 @@
+## Test inference of hand-made merges
+read <handmerge.svn
+infermerges
+infermerges --apply
+=M list
+infermerges --threshold=50 --apply
+=M list
@@ -0,0 +1,4 @@
+## Test layout analysis of Subversion dumps
+layout <layoutmove.svn
+layout <branchmap.svn
+layout <nesting.svn
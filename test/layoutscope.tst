@@ -0,0 +1,6 @@
+## Test revision-scoped branchify and branchmap across a layout change
+branchify trunk@-5 branches/*@-5 tags/*@-5 project/trunk@6- project/branches/*@6- project/tags/*@6-
+branchmap @^project/trunk/$@heads/master@@6- @^project/branches/([^/]+)/$@heads/\1@@6- @^project/tags/([^/]+)/$@tags/\1@@6-
+read <layoutmove.svn
+prefer git
+write -
@@ -0,0 +1,15 @@
+## test generating changelogs from commit history
+read <mkchangelog.fi
+# Bob's two commits are on different days, so get a header each
+mkchangelog
+# The tag closes release 1.0; the rest is unreleased
+mkchangelog --format=debian --package=alpha
+:2,:4 mkchangelog --format=markdown
+mkchangelog --format=markdown --version=1.1
+# The ChangeLog goes into the tip's tree
+mkchangelog --commit=master
+:8 manifest
+# Only the release's own history goes into its tree
+mkchangelog --format=debian --commit=v1.0
+write -
+mkchangelog --format=yaml
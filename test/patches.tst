@@ -0,0 +1,12 @@
+## test writing commits as a patch series
+set testmode
+read <replay.fi
+# A root commit is diffed against the empty tree
+:3 patches
+# Renames are detected, and the subjects numbered
+:7,:9 patches
+# The series applies back onto the tip of master
+:7,:9 patches >/tmp/rspatches$$$$
+:5 apply --branch=again </tmp/rspatches$$$$
+shell rm /tmp/rspatches$$$$
+write -
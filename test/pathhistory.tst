@@ -0,0 +1,14 @@
+## test path history across renames and copies
+read <pathhistory.fi
+# Back through a rename and a copy made by reusing a blob
+history guide.txt
+# The old name still has its own history
+history notes.txt
+# Restricted by a selection
+:10..$ history guide.txt
+# The matching selection function
+@hist(guide.txt) list
+@hist(guide.txt) & =M resolve
+# Parentheses in a path must balance
+@hist(guide.txt) | @hist(notes(old).txt) resolve
+history nosuch.txt
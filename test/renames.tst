@@ -0,0 +1,8 @@
+## test inference of renames and copies
+read <renames.fi
+# Exact renames only, as a dry run
+renames --dry-run
+# Renames by similarity, and copies
+renames --similarity=80 --copies
+:10 inspect
+write -
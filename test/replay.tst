@@ -0,0 +1,12 @@
+## test replaying commits with pick and rebase
+read <replay.fi
+# Copy the first two topic commits onto master
+:7,:9 pick --branch=picked master
+# Alpha was changed on both sides, so this conflicts
+:11 pick --force --branch=forced master
+:7,:9 rebase --dry-run master
+# The unselected child :11 keeps its tree
+:7,:9 rebase master
+write -
+# After the rebase :11 changes alpha 2, and :3 has alpha 1
+:11 pick :3
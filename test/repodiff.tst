@@ -0,0 +1,16 @@
+## test structural comparison of repositories
+read <sample1.fi
+read <sample1.fi
+# Identical repositories
+repodiff sample1 sample12
+# Alter the second copy
+:2 expunge README
+=C assert count 17
+:17 squash
+:10 setfield comment "Rewritten comment.\n"
+:12 setfield branch refs/heads/other
+path README2 rename README3
+repodiff sample1 sample12
+repodiff --match=tree sample1 sample12
+choose sample1
+repodiff sample12-expunges
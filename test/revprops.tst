@@ -0,0 +1,7 @@
+## Test mapping of Subversion revision properties with --revprops
+read --revprops=revprops.rules <revprops.svn
+prefer git
+write -
+# Only bzr can carry commit properties
+prefer bzr
+:3 write -
@@ -0,0 +1,23 @@
+## test uniting repositories into subdirectories
+read <unitelib.fi
+rename lib
+read <uniteapp.fi
+rename app
+unite --subdirs lib app
+write -
+# The mainline tip has both subdirectories
+:14 manifest
+# The application joining the mainline at a given commit
+drop lib+app
+read <unitelib.fi
+rename lib
+read <uniteapp.fi
+rename app
+unite --subdirs --join=app::4 lib app
+write -
+drop lib+app
+read <unitelib.fi
+rename lib
+read <uniteapp.fi
+rename app
+unite --subdirs --join=nosuch::1 lib app